@@ -0,0 +1,408 @@
+package bkdtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+//WriteBatch collects inserts and erases which are applied all-or-nothing by (*BkdTree).Apply. The zero value is an empty batch.
+//Points are identified by Vals and UserData, the same as Erase.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	erase   bool
+	point   Point
+	payload []byte
+}
+
+//Insert appends an insert of the given point.
+func (b *WriteBatch) Insert(point Point) {
+	b.InsertWithPayload(point, nil)
+}
+
+//InsertWithPayload appends an insert of the given point with its payload. nil is the empty payload.
+func (b *WriteBatch) InsertWithPayload(point Point, payload []byte) {
+	b.ops = append(b.ops, batchOp{point: point, payload: payload})
+}
+
+//Erase appends an erase of the given point.
+func (b *WriteBatch) Erase(point Point) {
+	b.ops = append(b.ops, batchOp{erase: true, point: point})
+}
+
+//Len returns the number of operations.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+//Reset empties the batch.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+/**
+ * Journal:
+ * Apply and Update reduce operations to net operations on each point, by cancelling an insert with a later erase of the
+ * same point. The remaining erases go first, each of which erases one copy of a point there before the batch.
+ * The net operations are recorded in the journal before touching any file, then applied, then the journal is removed.
+ * Before applying each operation, its index and NumPoints are appended to the journal. Each operation changes NumPoints
+ * if it takes effect, so Open replays the journal left by a crash from the last recorded operation if NumPoints is
+ * unchanged, otherwise from the next one. A torn journal is left by a crash before any file has been touched, and is
+ * dropped. A torn progress record is left by a crash before its operation starts, and is dropped.
+ * If applying fails, operations which have taken effect are undone in reverse order, an insert by erasing the point and
+ * an erase by inserting the point with the payload of the erased copy. Before undoing each operation, its index with
+ * the undo bit and NumPoints are appended to the journal, so Open replays from the operation if the undo has taken
+ * effect, otherwise from the next one. Once all are undone, the journal is truncated to be torn, and removed.
+ * If undoing fails as well, the tree is closed, and the next Open completes the batch.
+ * Journal layout: uint32 length of operations. For each operation, 1 byte kind (0 insert, 1 erase), the point encoded
+ * without payload reference, uint32 length of the payload and the payload. Then CRC-32 (IEEE) of all above.
+ * Then progress records, each of which is uint32 index of the operation, whose top bit is the undo bit, uint64
+ * NumPoints, and CRC-32 of both.
+ */
+
+//journalRecordSize is the size of a progress record of the journal.
+const journalRecordSize int = 4 + 8 + 4
+
+//journalUndo is the undo bit of the index of a progress record.
+const journalUndo uint32 = 1 << 31
+
+//appliedOp is an operation which has taken effect, along with the payload of the copy erased by it.
+type appliedOp struct {
+	idx     int
+	payload []byte
+}
+
+//JournalPath returns the journal path
+func (bkd *BkdTree) JournalPath() string {
+	return filepath.Join(bkd.dir, fmt.Sprintf("%s_journal", bkd.prefix))
+}
+
+//Apply validates all operations of the batch, and applies them under one lock acquisition. Either all operations or
+//none of them take effect, including across compactions triggered by the batch and crashes. Refers to Journal.
+//An erase of a point which isn't there is a no-op, the same as Erase. An insert of a point which is there adds another
+//copy, the same as Insert. If applying fails halfway, e.g. on an I/O error, operations done are undone before the error
+//is returned. If undoing fails as well, the tree is closed, and the next Open completes the batch.
+func (bkd *BkdTree) Apply(batch *WriteBatch) (err error) {
+	bkd.rwlock.Lock()
+	defer bkd.unlock()
+	if err = bkd.finishMerge(); err != nil {
+		return
+	}
+	if !bkd.open {
+		err = errors.Wrap(ErrClosed, "(*BkdTree).Apply")
+		return
+	}
+	for i, op := range batch.ops {
+		if err = bkd.checkPoint(fmt.Sprintf("batch[%d].point", i), op.point); err != nil {
+			return
+		} else if err = bkd.checkPayload(fmt.Sprintf("batch[%d].payload", i), op.payload); err != nil {
+			return
+		}
+	}
+	ops := bkd.resolveBatch(batch)
+	if len(ops) == 0 {
+		return
+	}
+	err = bkd.applyJournaled(ops)
+	return
+}
+
+//resolveBatch reduces the batch to net operations, erases first. It doesn't look up the tree.
+func (bkd *BkdTree) resolveBatch(batch *WriteBatch) (ops []batchOp) {
+	type state struct {
+		erases  []batchOp //erases of copies there before the batch
+		inserts []batchOp //inserts not cancelled yet
+	}
+	states := make(map[string]*state)
+	var keys []string
+	for _, op := range batch.ops {
+		key := string(bkd.tombstoneKey(op.point))
+		st, ok := states[key]
+		if !ok {
+			st = &state{}
+			states[key] = st
+			keys = append(keys, key)
+		}
+		if !op.erase {
+			st.inserts = append(st.inserts, op)
+		} else if len(st.inserts) != 0 {
+			//the latest insert is cancelled
+			st.inserts = st.inserts[:len(st.inserts)-1]
+		} else {
+			st.erases = append(st.erases, op)
+		}
+	}
+	for _, key := range keys {
+		ops = append(ops, states[key].erases...)
+	}
+	for _, key := range keys {
+		ops = append(ops, states[key].inserts...)
+	}
+	return
+}
+
+//applyJournaled applies net operations protected by the journal. Refers to Journal.
+func (bkd *BkdTree) applyJournaled(ops []batchOp) (err error) {
+	f, err := bkd.writeJournal(ops)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var done []appliedOp
+	if done, err = bkd.applyOps(f, ops, 0, true); err != nil {
+		if errU := bkd.undoOps(f, ops, done); errU != nil {
+			//the journal is left for the next Open
+			bkd.close()
+			return
+		}
+	}
+	if errR := bkd.removeJournal(); errR != nil && err == nil {
+		err = errR
+	}
+	return
+}
+
+//applyOps applies net operations from ops[from], and records the progress in the journal f before each of them.
+//done are operations which have taken effect. If undoable is true, erases carry payloads of erased copies.
+func (bkd *BkdTree) applyOps(f *os.File, ops []batchOp, from int, undoable bool) (done []appliedOp, err error) {
+	for i := from; i < len(ops); i++ {
+		if err = bkd.writeProgress(f, i, false); err != nil {
+			return
+		}
+		numPoints := bkd.NumPoints
+		var payload []byte
+		if op := ops[i]; op.erase {
+			if undoable && bkd.hasPayload() {
+				if payload, err = bkd.erasedPayload(op.point); err != nil {
+					return
+				}
+			}
+			_, err = bkd.erase(op.point)
+		} else {
+			if i == from || ops[i-1].erase {
+				//inserts follow erases, which drop the cached view
+				bkd.pinSnapshot(len(ops) - i)
+			}
+			err = bkd.insert(op.point, op.payload)
+		}
+		if bkd.NumPoints != numPoints {
+			done = append(done, appliedOp{idx: i, payload: payload})
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+//undoOps undoes operations which have taken effect in reverse order, and records the progress in the journal f before
+//each of them. The journal is truncated at last. Refers to Journal.
+func (bkd *BkdTree) undoOps(f *os.File, ops []batchOp, done []appliedOp) (err error) {
+	for i := len(done) - 1; i >= 0; i-- {
+		if err = bkd.writeProgress(f, done[i].idx, true); err != nil {
+			return
+		}
+		if op := ops[done[i].idx]; op.erase {
+			err = bkd.insert(op.point, done[i].payload)
+		} else {
+			_, err = bkd.erase(op.point)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if err = f.Truncate(0); err == nil && bkd.durability == DurabilitySync {
+		err = f.Sync()
+	}
+	if err != nil {
+		err = errors.Wrap(err, "")
+	}
+	return
+}
+
+//erasedPayload returns the payload of the copy of the given point which erase removes, which is the first one visited.
+func (bkd *BkdTree) erasedPayload(point Point) (payload []byte, err error) {
+	collector := &PayloadCollector{LowPoint: point, HighPoint: point}
+	if err = bkd.intersect(visitorAdapter{collector}); err != nil {
+		return
+	}
+	for j, p := range collector.Points {
+		if p.Equal(point) {
+			payload = collector.Payloads[j]
+			return
+		}
+	}
+	return
+}
+
+//writeProgress appends the progress record of the idx-th operation to the journal f. undo is true if the operation
+//is going to be undone.
+func (bkd *BkdTree) writeProgress(f *os.File, idx int, undo bool) (err error) {
+	var rec [journalRecordSize]byte
+	if undo {
+		binary.BigEndian.PutUint32(rec[0:], uint32(idx)|journalUndo)
+	} else {
+		binary.BigEndian.PutUint32(rec[0:], uint32(idx))
+	}
+	binary.BigEndian.PutUint64(rec[4:], uint64(bkd.NumPoints))
+	binary.BigEndian.PutUint32(rec[12:], crc32.ChecksumIEEE(rec[:12]))
+	if _, err = f.Write(rec[:]); err == nil && bkd.durability == DurabilitySync {
+		err = f.Sync()
+	}
+	if err != nil {
+		err = errors.Wrap(err, "")
+	}
+	return
+}
+
+//writeJournal writes net operations into the journal, and returns the journal opened for appending progress records.
+func (bkd *BkdTree) writeJournal(ops []batchOp) (f *os.File, err error) {
+	data := make([]byte, 4)
+	var buf [4]byte
+	for _, op := range ops {
+		kind := byte(0)
+		if op.erase {
+			kind = 1
+		}
+		data = append(data, kind)
+		data = append(data, bkd.tombstoneKey(op.point)...)
+		binary.BigEndian.PutUint32(buf[:], uint32(len(op.payload)))
+		data = append(data, buf[:]...)
+		data = append(data, op.payload...)
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	binary.BigEndian.PutUint32(buf[:], crc32.ChecksumIEEE(data))
+	data = append(data, buf[:]...)
+
+	if f, err = os.OpenFile(bkd.JournalPath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if _, err = f.Write(data); err == nil && bkd.durability == DurabilitySync {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		f = nil
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = bkd.syncDir(); err != nil {
+		f.Close()
+		f = nil
+	}
+	return
+}
+
+//readJournal decodes operations of the journal, which end at end. ok is false if they're torn.
+func (bkd *BkdTree) readJournal(data []byte) (ops []batchOp, end int, ok bool) {
+	if len(data) < 4 {
+		return
+	}
+	end = 4 + int(binary.BigEndian.Uint32(data))
+	if end+4 > len(data) || binary.BigEndian.Uint32(data[end:]) != crc32.ChecksumIEEE(data[:end]) {
+		return
+	}
+	keySize := bkd.tombstoneKeySize()
+	body := data[4:end]
+	end += 4
+	for len(body) != 0 {
+		if len(body) < 1+keySize+4 {
+			return
+		}
+		pae := PointArrayExt{
+			data:        body[1 : 1+keySize],
+			numPoints:   1,
+			byDim:       0, //not used
+			bytesPerDim: bkd.BytesPerDim,
+			dimBytes:    bkd.dimBytes,
+			numDims:     bkd.NumDims,
+			pointSize:   bkd.pointSize,
+		}
+		op := batchOp{erase: body[0] == 1, point: pae.GetPoint(0)}
+		size := int(binary.BigEndian.Uint32(body[1+keySize:]))
+		body = body[1+keySize+4:]
+		if size > len(body) {
+			return
+		} else if size != 0 {
+			op.payload = append([]byte{}, body[:size]...)
+		}
+		body = body[size:]
+		ops = append(ops, op)
+	}
+	ok = true
+	return
+}
+
+//readProgress decodes progress records of the journal, and returns the index of the operation to replay from and the
+//size of valid records. Refers to Journal.
+func (bkd *BkdTree) readProgress(data []byte) (from, size int) {
+	for ; size+journalRecordSize <= len(data); size += journalRecordSize {
+		rec := data[size : size+journalRecordSize]
+		if binary.BigEndian.Uint32(rec[12:]) != crc32.ChecksumIEEE(rec[:12]) {
+			break
+		}
+		idx := binary.BigEndian.Uint32(rec)
+		from = int(idx &^ journalUndo)
+		changed := int(binary.BigEndian.Uint64(rec[4:])) != bkd.NumPoints
+		if undo := idx&journalUndo != 0; changed != undo {
+			//the operation has taken effect, and hasn't been undone
+			from++
+		}
+	}
+	return
+}
+
+func (bkd *BkdTree) removeJournal() (err error) {
+	if err = os.Remove(bkd.JournalPath()); err != nil && !os.IsNotExist(err) {
+		err = errors.Wrap(err, "")
+		return
+	}
+	err = bkd.syncDir()
+	return
+}
+
+//replayJournal completes net operations recorded in the journal, if any. Refers to Journal.
+func (bkd *BkdTree) replayJournal() (err error) {
+	data, err := ioutil.ReadFile(bkd.JournalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = errors.Wrap(err, "")
+		}
+		return
+	}
+	if ops, end, ok := bkd.readJournal(data); ok {
+		from, size := bkd.readProgress(data[end:])
+		var f *os.File
+		if f, err = os.OpenFile(bkd.JournalPath(), os.O_WRONLY, 0600); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+		//progress records are appended after valid ones
+		if err = f.Truncate(int64(end + size)); err == nil {
+			_, err = f.Seek(int64(end+size), 0)
+		}
+		if err != nil {
+			f.Close()
+			err = errors.Wrap(err, "")
+			return
+		}
+		_, err = bkd.applyOps(f, ops, from, false)
+		f.Close()
+		if err != nil {
+			return
+		}
+	}
+	err = bkd.removeJournal()
+	return
+}
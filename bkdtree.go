@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
@@ -21,18 +22,43 @@ type KdTreeExtNodeInfo struct {
 
 const KdTreeExtNodeInfoSize int64 = 8 + 8
 
+//FormatVer is the current file format version.
+/**
+ * version history:
+ * 0. initial version.
+ * 1. KdTreeExtIntraNode carries bounding boxes of children.
+ * 2. KdTreeExtMeta carries Generation.
+ * 3. KdTreeExtMeta and KdTreeExtIntraNode carry CRC-32 (IEEE) checksums. Checksums of leaves are kept in the parent node.
+ * 4. KdTreeExtMeta carries DimTypes.
+ * 5. KdTreeExtMeta.DimDescs carries the byte width of each dimension besides the type.
+ * 6. KdTreeExtMeta carries PayloadOffEnd, PayloadWidth and PayloadMaxLen. Refers to WithFixedPayload and WithVarPayload.
+ * 7. KdTreeExtMeta carries LeafCodec. KdTreeExtIntraNode carries LeafSizes if LeafCodec isn't LeafCodecNone.
+ */
+const FormatVer uint8 = 7
+
 //KdTreeExtIntraNode is struct of intra node.
 /**
  * invariants:
  * 1. NumStrips == 1 + len(SplitValues) == len(Children).
  * 2. values in SplitValues are in non-decreasing order.
  * 3. offset in Children are in increasing order.
+ * 4. len(LowVals) == len(HighVals) == NumStrips*numDims since format version 1, otherwise 0.
+ *    The bounding box of Children[i] is [LowVals[i*numDims:(i+1)*numDims], HighVals[i*numDims:(i+1)*numDims]].
+ * 5. len(LeafChecksums) == NumStrips since format version 3, otherwise 0. LeafChecksums[i] is the checksum of
+ *    the points of Children[i] if it's a leaf, otherwise 0. Checksum covers all preceding bytes of the node.
+ * 6. len(LeafSizes) == NumStrips if the file has a leaf codec, otherwise 0. LeafSizes[i] is the stored size of
+ *    Children[i] if it's a leaf, otherwise 0.
  */
 type KdTreeExtIntraNode struct {
-	SplitDim    uint32
-	NumStrips   uint32
-	SplitValues []uint64
-	Children    []KdTreeExtNodeInfo
+	SplitDim      uint32
+	NumStrips     uint32
+	SplitValues   []uint64
+	Children      []KdTreeExtNodeInfo
+	LowVals       []uint64
+	HighVals      []uint64
+	LeafSizes     []uint32
+	LeafChecksums []uint32
+	Checksum      uint32
 }
 
 // KdTreeExtMeta is persisted at the end of file.
@@ -43,43 +69,175 @@ type KdTreeExtIntraNode struct {
  * 2. Keep KdTreeExtMeta be 4 bytes aligned.
  * 3. Keep formatVer one byte, and be the last member.
  * 4. Keep KdMetaSize be sizeof(KdTreeExtMeta);
+ * Generation orders files of a BkdTree. Each compaction produces a Ti of a new generation, which absorbs T0M and Tj, j<i.
+ * So Tj of a lower generation than some Ti, j<i, as well as T0M of a lower generation than any Ti, has been
+ * absorbed and is stale. Files of format version < 2 are of generation 0.
+ * Payloads, if enabled, are placed in [PointsOffEnd, PayloadOffEnd), between points and intra nodes.
  */
 type KdTreeExtMeta struct {
-	PointsOffEnd uint64 //the offset end of points
-	RootOff      uint64 //the offset of root KdTreeExtIntraNode
-	NumPoints    uint64 //the current number of points. Deleting points could trigger rebuilding the tree.
-	LeafCap      uint16
-	IntraCap     uint16
-	NumDims      uint8
-	BytesPerDim  uint8
-	PointSize    uint8
-	FormatVer    uint8 //the file format version. shall be the last byte of the file.
+	PointsOffEnd  uint64     //the offset end of points
+	RootOff       uint64     //the offset of root KdTreeExtIntraNode
+	NumPoints     uint64     //the current number of points. Deleting points could trigger rebuilding the tree.
+	Generation    uint64     //the generation of Ti. For T0M, the generation at which it's cleared last time.
+	Checksum      uint32     //checksum of the meta with this field being zero
+	PayloadOffEnd uint64     //the offset end of payloads. It equals to PointsOffEnd if there's no payload.
+	PayloadWidth  uint32     //the width of each payload if payloads are of fixed width, otherwise 0
+	PayloadMaxLen uint32     //the max length of each payload if payloads are of variable length, otherwise 0
+	LeafCodec     uint32     //the LeafCodec of leaves
+	DimDescs      [256]uint8 //DimType of each dimension in the low 4 bits, and byte width minus 1 in the high 4 bits since format version 5. The length is fixed to keep the meta a fixed-size struct.
+	LeafCap       uint16
+	IntraCap      uint16
+	NumDims       uint8
+	BytesPerDim   uint8
+	PointSize     uint8
+	FormatVer     uint8 //the file format version. shall be the last byte of the file.
 }
 
 //KdTreeExtMetaSize is sizeof(KdTreeExtMeta)
-const KdTreeExtMetaSize int = 8*3 + 4 + 4
+const KdTreeExtMetaSize int = 8*4 + 4 + 8 + 4 + 4 + 4 + 256 + 4 + 4
+
+//metaChecksumOff is the offset of KdTreeExtMeta.Checksum since format version 3.
+const metaChecksumOff int = 8 * 4
+
+//metaSize returns sizeof(KdTreeExtMeta) of the given format version.
+func metaSize(formatVer uint8) int {
+	switch {
+	case formatVer < 2:
+		return 8*3 + 4 + 4
+	case formatVer < 3:
+		return 8*4 + 4 + 4
+	case formatVer < 4:
+		return 8*4 + 4 + 4 + 4
+	case formatVer < 6:
+		return 8*4 + 4 + 256 + 4 + 4
+	case formatVer < 7:
+		return 8*4 + 4 + 8 + 4 + 4 + 256 + 4 + 4
+	}
+	return KdTreeExtMetaSize
+}
+
+//decodeMeta decodes meta of any supported format version. The checksum is verified since format version 3.
+func decodeMeta(data []byte, meta *KdTreeExtMeta) (err error) {
+	formatVer := data[len(data)-1]
+	if formatVer >= 3 {
+		checksum := binary.BigEndian.Uint32(data[metaChecksumOff:])
+		if want := metaChecksum(data); checksum != want {
+			err = errors.Wrapf(ErrCorrupt, "meta checksum %d, want %d", checksum, want)
+			return
+		}
+	}
+	if formatVer >= 7 {
+		if err = binary.Read(bytes.NewReader(data), binary.BigEndian, meta); err != nil {
+			err = errors.Wrap(err, "")
+		}
+		return
+	}
+	//legacy layouts: 3 or 4 uint64 fields, optional Checksum, optional payload fields, optional DimDescs, followed by
+	//LeafCap, IntraCap, NumDims, BytesPerDim, PointSize and FormatVer
+	*meta = KdTreeExtMeta{
+		PointsOffEnd: binary.BigEndian.Uint64(data[0:]),
+		RootOff:      binary.BigEndian.Uint64(data[8:]),
+		NumPoints:    binary.BigEndian.Uint64(data[16:]),
+	}
+	off := 24
+	if formatVer >= 2 {
+		meta.Generation = binary.BigEndian.Uint64(data[24:])
+		off = 32
+	}
+	if formatVer >= 3 {
+		meta.Checksum = binary.BigEndian.Uint32(data[metaChecksumOff:])
+		off += 4
+	}
+	meta.PayloadOffEnd = meta.PointsOffEnd
+	if formatVer >= 6 {
+		meta.PayloadOffEnd = binary.BigEndian.Uint64(data[off:])
+		meta.PayloadWidth = binary.BigEndian.Uint32(data[off+8:])
+		meta.PayloadMaxLen = binary.BigEndian.Uint32(data[off+12:])
+		off += 16
+	}
+	if formatVer >= 4 {
+		copy(meta.DimDescs[:], data[off:])
+		off += len(meta.DimDescs)
+	}
+	meta.LeafCap = binary.BigEndian.Uint16(data[off:])
+	meta.IntraCap = binary.BigEndian.Uint16(data[off+2:])
+	meta.NumDims = data[off+4]
+	meta.BytesPerDim = data[off+5]
+	meta.PointSize = data[off+6]
+	meta.FormatVer = data[off+7]
+	return
+}
+
+//metaChecksum returns the checksum of the encoded meta with Checksum being zero. The format version shall be no less than 3.
+func metaChecksum(data []byte) uint32 {
+	h := crc32.NewIEEE()
+	h.Write(data[:metaChecksumOff])
+	h.Write([]byte{0, 0, 0, 0})
+	h.Write(data[metaChecksumOff+4:])
+	return h.Sum32()
+}
+
+//encodeMeta seals the meta with its checksum and encodes it. Only the current format version is supported.
+func encodeMeta(meta *KdTreeExtMeta) (data []byte) {
+	var bb bytes.Buffer
+	binary.Write(&bb, binary.BigEndian, meta) //writing to bytes.Buffer never fails
+	data = bb.Bytes()
+	meta.Checksum = metaChecksum(data)
+	binary.BigEndian.PutUint32(data[metaChecksumOff:], meta.Checksum)
+	return
+}
 
 type BkdSubTree struct {
-	meta KdTreeExtMeta
-	f    *os.File
-	data []byte //file content via mmap
+	meta  KdTreeExtMeta
+	f     *os.File
+	store storage //file content via mmap or pread
+	data  []byte  //points and payload slots of T0M. It's a slice of the mapping if mmap is used, otherwise a copy written through store. Not used by Ti.
+	index storage //the UserData index of Ti. Refers to WithUserDataIndex.
 }
 
 //BkdTree is a BKD tree
 type BkdTree struct {
-	t0mCap      int // M in the paper, the capacity of in-memory buffer
-	leafCap     int // limit of points a leaf node can hold
-	intraCap    int // limit of children of a intra node can hold
-	NumDims     int // number of point dimensions
-	BytesPerDim int // number of bytes of each encoded dimension
-	pointSize   int
-	dir         string //directory of files which hold the persisted kdtrees
-	prefix      string //prefix of file names
-	NumPoints   int
-	t0m         BkdSubTree // T0M in the paper, in-memory buffer.
-	trees       []BkdSubTree
-	rwlock      sync.RWMutex //reader: Intersect, GetCap. writers: Insert, Erase, Open, Close, Destroy, Compact.
-	open        bool         //closed: allow Open, Close; open: allow all operations except Open.
+	t0mCap         int // M in the paper, the capacity of in-memory buffer
+	leafCap        int // limit of points a leaf node can hold
+	intraCap       int // limit of children of a intra node can hold
+	NumDims        int // number of point dimensions
+	BytesPerDim    int // number of bytes of each encoded dimension
+	pointSize      int
+	dir            string //directory of files which hold the persisted kdtrees
+	prefix         string //prefix of file names
+	NumPoints      int
+	t0m            BkdSubTree // T0M in the paper, in-memory buffer.
+	trees          []BkdSubTree
+	rwlock         sync.RWMutex             //reader: Verify, GetByUserData, creating snapshots. writers: Insert, Erase, Open, Close, Destroy, Compact, the compactor.
+	open           bool                     //closed: allow Open, Close; open: allow all operations except Open.
+	storageKind    StorageKind              //the way to access files
+	clampQuery     bool                     //saturate query bounds instead of rejecting out of range values
+	durability     Durability               //level of crash safety
+	generation     uint64                   //the latest generation of files
+	manifest       Manifest                 //the persisted manifest
+	dimTypes       []DimType                //type of each dimension
+	dimBytes       []int                    //byte width of each dimension. nil means all dimensions are of BytesPerDim bytes.
+	payloadWidth   int                      //width of each payload if payloads are of fixed width
+	payloadMaxLen  int                      //max length of each payload if payloads are of variable length
+	leafCodec      LeafCodec                //the encoding of leaves of Ti
+	tombstoneErase bool                     //erase points of Ti by tombstones. Refers to WithTombstones.
+	tombstones     map[string]*tombstone    //erased points of Ti keyed by the encoded point without payload reference
+	userDataIndex  bool                     //locate points by UserData. Refers to WithUserDataIndex.
+	t0mIndex       map[uint64][]int         //slots of T0M points by UserData if userDataIndex is set
+	snapMu         sync.Mutex               //protects snap, snapRefs and retired. Refers to Snapshots.
+	snap           *snapView                //the cached view of the latest state
+	snapRefs       map[storage]int          //number of views referring to each Ti store
+	retired        map[storage]retiredStore //Ti stores closed by the tree but referred by views
+	bgCompaction   bool                     //merge frozen T0M in background. Refers to WithBackgroundCompaction.
+	bgConcurrency  int                      //number of goroutines partitioning points on bulk-loading
+	bgRateLimit    int                      //max bytes per second written by a background merge. 0 means unlimited.
+	frozen         *BkdSubTree              //the frozen T0M being merged in background. Refers to Background compaction.
+	merging        bool                     //the compactor is merging the frozen buffer
+	mergeCond      *sync.Cond               //broadcasted when a background merge is done or the tree is closed
+	wake           chan struct{}            //wakes the compactor up
+	quit           chan struct{}            //stops the compactor
+	mergeErr       error                    //the error of the failed background merge, returned by Close
+	limiter        *rateLimiter             //paces writes of the background merge in progress
 }
 
 func (n *KdTreeExtIntraNode) Read(r io.Reader) (err error) {
@@ -111,6 +269,50 @@ func (n *KdTreeExtIntraNode) Read(r io.Reader) (err error) {
 	return
 }
 
+//ReadBounds reads bounding boxes of children. It shall be invoked after Read.
+func (n *KdTreeExtIntraNode) ReadBounds(r io.Reader, numDims int) (err error) {
+	n.LowVals = make([]uint64, int(n.NumStrips)*numDims)
+	err = binary.Read(r, binary.BigEndian, &n.LowVals)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	n.HighVals = make([]uint64, int(n.NumStrips)*numDims)
+	err = binary.Read(r, binary.BigEndian, &n.HighVals)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	return
+}
+
+//ReadLeafSizes reads sizes of leaves. It shall be invoked after ReadBounds.
+func (n *KdTreeExtIntraNode) ReadLeafSizes(r io.Reader) (err error) {
+	n.LeafSizes = make([]uint32, n.NumStrips)
+	err = binary.Read(r, binary.BigEndian, &n.LeafSizes)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	return
+}
+
+//ReadChecksums reads checksums. It shall be invoked after ReadBounds, and ReadLeafSizes if any.
+func (n *KdTreeExtIntraNode) ReadChecksums(r io.Reader) (err error) {
+	n.LeafChecksums = make([]uint32, n.NumStrips)
+	err = binary.Read(r, binary.BigEndian, &n.LeafChecksums)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	err = binary.Read(r, binary.BigEndian, &n.Checksum)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	return
+}
+
 func (n *KdTreeExtIntraNode) Write(w io.Writer) (err error) {
 	//According to https://golang.org/pkg/encoding/binary/#Write,
 	//"Data must be a fixed-size value or a slice of fixed-size values, or a pointer to such data."
@@ -135,14 +337,164 @@ func (n *KdTreeExtIntraNode) Write(w io.Writer) (err error) {
 		err = errors.Wrap(err, "")
 		return
 	}
+	err = binary.Write(w, binary.BigEndian, &n.LowVals)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	err = binary.Write(w, binary.BigEndian, &n.HighVals)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if len(n.LeafSizes) != 0 {
+		err = binary.Write(w, binary.BigEndian, &n.LeafSizes)
+		if err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+	}
+	if len(n.LeafChecksums) == 0 {
+		return
+	}
+	err = binary.Write(w, binary.BigEndian, &n.LeafChecksums)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	err = binary.Write(w, binary.BigEndian, &n.Checksum)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	return
+}
+
+//encodeIntraNode seals the node with its checksum if it carries LeafChecksums, and encodes it.
+func encodeIntraNode(node *KdTreeExtIntraNode) (data []byte, err error) {
+	var bb bytes.Buffer
+	if err = node.Write(&bb); err != nil {
+		return
+	}
+	data = bb.Bytes()
+	if len(node.LeafChecksums) != 0 {
+		node.Checksum = crc32.ChecksumIEEE(data[:len(data)-4])
+		binary.BigEndian.PutUint32(data[len(data)-4:], node.Checksum)
+	}
+	return
+}
+
+//intraNodeSize returns the encoded size of an intra node.
+func intraNodeSize(meta *KdTreeExtMeta, numStrips int) (size int) {
+	size = 4 + 4 + 8*(numStrips-1) + int(KdTreeExtNodeInfoSize)*numStrips
+	if meta.FormatVer >= 1 {
+		size += 2 * 8 * numStrips * int(meta.NumDims)
+	}
+	if meta.LeafCodec != uint32(LeafCodecNone) {
+		size += 4 * numStrips
+	}
+	if meta.FormatVer >= 3 {
+		size += 4*numStrips + 4
+	}
+	return
+}
+
+//readIntraNode reads the intra node at the given offset.
+func readIntraNode(store storage, meta *KdTreeExtMeta, nodeOffset int) (node KdTreeExtIntraNode, err error) {
+	var data []byte
+	if data, err = store.ReadAt(nil, nodeOffset, 8); err != nil {
+		return
+	}
+	numStrips := int(binary.BigEndian.Uint32(data[4:]))
+	if numStrips <= 0 {
+		err = errors.Wrapf(ErrCorrupt, "intra node at %d has %d strips", nodeOffset, numStrips)
+		return
+	}
+	if data, err = store.ReadAt(nil, nodeOffset, intraNodeSize(meta, numStrips)); err != nil {
+		return
+	}
+	br := bytes.NewReader(data)
+	if err = node.Read(br); err != nil {
+		return
+	}
+	if meta.FormatVer >= 1 {
+		if err = node.ReadBounds(br, int(meta.NumDims)); err != nil {
+			return
+		}
+	}
+	if meta.LeafCodec != uint32(LeafCodecNone) {
+		if err = node.ReadLeafSizes(br); err != nil {
+			return
+		}
+	}
+	if meta.FormatVer >= 3 {
+		if err = node.ReadChecksums(br); err != nil {
+			return
+		}
+		if checksum := crc32.ChecksumIEEE(data[:len(data)-4]); checksum != node.Checksum {
+			err = errors.Wrapf(ErrCorrupt, "intra node at %d checksum %d, want %d", nodeOffset, node.Checksum, checksum)
+		}
+	}
+	return
+}
+
+//leafSize returns the stored size of node.Children[i], which shall be a leaf.
+func (bkd *BkdTree) leafSize(node *KdTreeExtIntraNode, i int) int {
+	if len(node.LeafSizes) != 0 {
+		return int(node.LeafSizes[i])
+	}
+	return int(node.Children[i].NumPoints) * bkd.pointSize
+}
+
+//readLeaf returns points of the given leaf of the given stored size. buf is used if the leaf needs to be copied or decoded.
+func (bkd *BkdTree) readLeaf(store storage, meta *KdTreeExtMeta, buf []byte, child KdTreeExtNodeInfo, size int) (pae PointArrayExt, err error) {
+	var data []byte
+	if meta.LeafCodec != uint32(LeafCodecNone) {
+		if data, err = store.ReadAt(nil, int(child.Offset), size); err != nil {
+			return
+		}
+		pae, err = bkd.decodeLeaf(data, int(child.NumPoints), meta.PointsOffEnd, buf)
+		return
+	}
+	if data, err = store.ReadAt(buf, int(child.Offset), int(child.NumPoints)*bkd.pointSize); err != nil {
+		return
+	}
+	pae = PointArrayExt{
+		data:        data,
+		numPoints:   int(child.NumPoints),
+		byDim:       0, //not used
+		bytesPerDim: bkd.BytesPerDim,
+		dimBytes:    bkd.dimBytes,
+		numDims:     bkd.NumDims,
+		pointSize:   bkd.pointSize,
+	}
+	return
+}
+
+//newLeafBuf allocates a buffer able to hold any leaf. It's nil if mmap is used and leaves aren't encoded.
+func (bkd *BkdTree) newLeafBuf() (buf []byte) {
+	if bkd.storageKind != StorageMmap || bkd.leafCodec != LeafCodecNone {
+		buf = make([]byte, bkd.leafCap*bkd.pointSize)
+	}
 	return
 }
 
 //NewBkdTree creates a BKDTree. This is used for construct a BkdTree from scratch. Existing files, if any, will be removed.
-func NewBkdTree(t0mCap, leafCap, intraCap, numDims, bytesPerDim int, dir, prefix string) (bkd *BkdTree, err error) {
-	if t0mCap <= 0 || leafCap <= 0 || leafCap >= int(^uint16(0)) || intraCap <= 2 ||
-		numDims <= 0 || (bytesPerDim != 1 && bytesPerDim != 2 && bytesPerDim != 4 && bytesPerDim != 8) {
-		err = errors.Errorf("invalid parameter")
+func NewBkdTree(t0mCap, leafCap, intraCap, numDims, bytesPerDim int, dir, prefix string, opts ...Option) (bkd *BkdTree, err error) {
+	if t0mCap <= 0 {
+		err = newInvalidArgument("t0mCap", t0mCap)
+		return
+	} else if leafCap <= 0 || leafCap >= int(^uint16(0)) {
+		err = newInvalidArgument("leafCap", leafCap)
+		return
+	} else if intraCap <= 2 || intraCap >= int(^uint16(0)) {
+		err = newInvalidArgument("intraCap", intraCap)
+		return
+	} else if numDims <= 0 || numDims > int(^uint8(0)) {
+		err = newInvalidArgument("numDims", numDims)
+		return
+	} else if bytesPerDim != 1 && bytesPerDim != 2 && bytesPerDim != 4 && bytesPerDim != 8 {
+		err = newInvalidArgument("bytesPerDim", bytesPerDim)
 		return
 	}
 	bkd = &BkdTree{
@@ -151,26 +503,62 @@ func NewBkdTree(t0mCap, leafCap, intraCap, numDims, bytesPerDim int, dir, prefix
 		intraCap:    intraCap,
 		NumDims:     numDims,
 		BytesPerDim: bytesPerDim,
-		pointSize:   numDims*bytesPerDim + 8,
 		dir:         dir,
 		prefix:      prefix,
 		//t0m is initialized later
 		trees: make([]BkdSubTree, 0),
 	}
+	for _, opt := range opts {
+		opt(bkd)
+	}
+	if err = bkd.checkDimBytes(); err != nil {
+		return
+	}
+	if err = bkd.checkPayloadOpts(); err != nil {
+		return
+	} else if err = bkd.checkCompactorOpts(); err != nil {
+		return
+	} else if bkd.leafCodec < LeafCodecNone || bkd.leafCodec > LeafCodecPrefix {
+		err = newInvalidArgument("leafCodec", bkd.leafCodec)
+		return
+	}
+	if bkd.dimTypes == nil {
+		bkd.dimTypes = make([]DimType, numDims)
+	} else if err = bkd.checkDimTypes(); err != nil {
+		return
+	}
 	if err = bkd.initT0M(); err != nil {
 		return
 	}
+	bkd.indexT0M()
 	if err = rmTreeList(dir, prefix); err != nil {
 		return
 	}
+	if err = os.Remove(bkd.TombstonesPath()); err != nil && !os.IsNotExist(err) {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = os.Remove(bkd.JournalPath()); err != nil && !os.IsNotExist(err) {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = os.Remove(bkd.FrozenPath()); err != nil && !os.IsNotExist(err) {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = bkd.initManifest(); err != nil {
+		return
+	}
 	bkd.open = true
+	bkd.startCompactor()
 	return
 }
 
 //Destroy close and remove all files
 func (bkd *BkdTree) Destroy() (err error) {
 	bkd.rwlock.Lock()
-	defer bkd.rwlock.Unlock()
+	defer bkd.unlock()
+	bkd.waitMerge()
 	if err = bkd.close(); err != nil {
 		return
 	}
@@ -180,14 +568,36 @@ func (bkd *BkdTree) Destroy() (err error) {
 	if err = os.Remove(bkd.T0mPath()); err != nil {
 		return
 	}
+	if err = os.Remove(bkd.ManifestPath()); err != nil && !os.IsNotExist(err) {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = os.Remove(bkd.TombstonesPath()); err != nil && !os.IsNotExist(err) {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = os.Remove(bkd.JournalPath()); err != nil && !os.IsNotExist(err) {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = os.Remove(bkd.FrozenPath()); err != nil && !os.IsNotExist(err) {
+		err = errors.Wrap(err, "")
+		return
+	}
+	err = nil
 	return
 }
 
-//Close close unmap and all files
+//Close close unmap and all files. It waits for the background merge in progress, and returns the error of the failed
+//background merge, if any. The frozen buffer left by a failed merge is merged by the next Open.
 func (bkd *BkdTree) Close() (err error) {
 	bkd.rwlock.Lock()
-	defer bkd.rwlock.Unlock()
-	err = bkd.close()
+	defer bkd.unlock()
+	bkd.waitMerge()
+	if err = bkd.close(); err != nil {
+		return
+	}
+	err, bkd.mergeErr = bkd.mergeErr, nil
 	return
 }
 
@@ -197,19 +607,34 @@ func (bkd *BkdTree) close() (err error) {
 		return
 	}
 	bkd.open = false
+	bkd.stopCompactor()
+	err = bkd.closeStores()
+	return
+}
 
-	if err = FileMunmap(bkd.t0m.data); err != nil {
-		return
-	} else if err = bkd.t0m.f.Close(); err != nil {
-		return
+//closeStores closes all opened files.
+func (bkd *BkdTree) closeStores() (err error) {
+	if bkd.t0m.store != nil {
+		if err = bkd.t0m.store.Close(); err != nil {
+			return
+		}
+		bkd.t0m.store = nil
+	}
+	if bkd.frozen != nil {
+		if err = bkd.frozen.store.Close(); err != nil {
+			return
+		}
+		bkd.frozen = nil
 	}
 	for i := 0; i < len(bkd.trees); i++ {
-		if bkd.trees[i].meta.NumPoints == 0 {
+		if bkd.trees[i].store == nil {
 			continue
 		}
-		if err = FileMunmap(bkd.trees[i].data); err != nil {
+		if err = bkd.retireSubTree(i, false); err != nil {
 			return
-		} else if err = bkd.trees[i].f.Close(); err != nil {
+		}
+		bkd.trees[i].store = nil
+		if err = bkd.closeUserDataIndex(i, false); err != nil {
 			return
 		}
 	}
@@ -217,11 +642,14 @@ func (bkd *BkdTree) close() (err error) {
 }
 
 //NewBkdTreeExt create a BKdTree based on exisiting files.
-func NewBkdTreeExt(dir, prefix string) (bkd *BkdTree, err error) {
+func NewBkdTreeExt(dir, prefix string, opts ...Option) (bkd *BkdTree, err error) {
 	bkd = &BkdTree{
 		dir:    dir,
 		prefix: prefix,
 	}
+	for _, opt := range opts {
+		opt(bkd)
+	}
 	err = bkd.Open()
 	return
 }
@@ -229,18 +657,41 @@ func NewBkdTreeExt(dir, prefix string) (bkd *BkdTree, err error) {
 //Open open existing files. Assumes dir and prefix are already poluplated.
 func (bkd *BkdTree) Open() (err error) {
 	bkd.rwlock.Lock()
-	defer bkd.rwlock.Unlock()
+	defer bkd.unlock()
 	if bkd.open {
-		err = errors.Errorf("(*BkdTree).Open is not allowed at open state")
+		err = errors.Wrap(ErrAlreadyOpen, "(*BkdTree).Open")
+		return
+	}
+	if err = bkd.checkCompactorOpts(); err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			bkd.closeStores()
+		}
+	}()
 
 	var nums []int
+	//temp files are left by an interrupted compaction or build
+	if err = FilepathGlobRm(bkd.dir, fmt.Sprintf("^%s_(t[0-9]+|t[0-9]+\\.uidx|t0m|build|manifest|tombstones)\\.tmp$", bkd.prefix)); err != nil {
+		return
+	}
 	if err = bkd.openT0M(); err != nil {
 		return
 	}
-	bkd.NumPoints = int(bkd.t0m.meta.NumPoints)
-	if nums, err = getTreeList(bkd.dir, bkd.prefix); err != nil {
+	if err = bkd.openFrozen(); err != nil {
+		return
+	}
+	var found bool
+	bkd.manifest = Manifest{}
+	bkd.trees = nil
+	if found, err = bkd.readManifest(); err != nil {
+		return
+	} else if found {
+		for _, s := range bkd.manifest.Subtrees {
+			nums = append(nums, s.Level)
+		}
+	} else if nums, err = getTreeList(bkd.dir, bkd.prefix); err != nil {
 		return
 	}
 	for _, num := range nums {
@@ -254,12 +705,90 @@ func (bkd *BkdTree) Open() (err error) {
 			}
 		}
 		fp := bkd.TiPath(num)
-		if err = bkd.trees[num].open(fp); err != nil {
+		if err = bkd.trees[num].open(fp, bkd.storageKind); err != nil {
+			return
+		}
+	}
+	if err = bkd.recover(); err != nil {
+		return
+	}
+	if err = bkd.reconcileManifest(); err != nil {
+		return
+	}
+	if err = bkd.loadTombstones(); err != nil {
+		return
+	}
+	bkd.indexT0M()
+	for i := range bkd.trees {
+		if err = bkd.openUserDataIndex(i); err != nil {
 			return
 		}
-		bkd.NumPoints += int(bkd.trees[num].meta.NumPoints)
+	}
+	bkd.NumPoints = int(bkd.t0m.meta.NumPoints)
+	if bkd.frozen != nil {
+		bkd.NumPoints += int(bkd.frozen.meta.NumPoints)
+	}
+	for _, tree := range bkd.trees {
+		bkd.NumPoints += int(tree.meta.NumPoints)
+	}
+	for _, ts := range bkd.tombstones {
+		bkd.NumPoints -= len(ts.gens)
+	}
+	if bkd.frozen != nil {
+		//the background merge has been interrupted
+		if err = bkd.compactTo(bkd.getMinCompactPos(0), nil); err != nil {
+			return
+		}
+	}
+	if err = bkd.replayJournal(); err != nil {
+		return
 	}
 	bkd.open = true
+	bkd.startCompactor()
+	return
+}
+
+//recover drops files which have been absorbed by an interrupted compaction. Refers to KdTreeExtMeta for generations.
+func (bkd *BkdTree) recover() (err error) {
+	var maxGen uint64
+	var removed bool
+	for i := len(bkd.trees) - 1; i >= 0; i-- {
+		if bkd.trees[i].store == nil {
+			continue
+		}
+		gen := bkd.trees[i].meta.Generation
+		if gen >= maxGen {
+			maxGen = gen
+			continue
+		}
+		//absorbed by a tree of higher level
+		if err = bkd.trees[i].store.Close(); err != nil {
+			return
+		} else if err = os.Remove(bkd.TiPath(i)); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+		bkd.trees[i] = BkdSubTree{}
+		removed = true
+	}
+	if removed {
+		if err = bkd.syncDir(); err != nil {
+			return
+		}
+	}
+	if bkd.frozen != nil && bkd.frozen.meta.Generation < maxGen {
+		//absorbed by a tree
+		if err = bkd.dropFrozen(); err != nil {
+			return
+		}
+	}
+	if bkd.t0m.meta.Generation < maxGen {
+		//absorbed by a tree
+		if err = bkd.clearT0M(maxGen); err != nil {
+			return
+		}
+	}
+	bkd.generation = bkd.t0m.meta.Generation
 	return
 }
 
@@ -280,66 +809,164 @@ func (bkd *BkdTree) initT0M() (err error) {
 		err = errors.Wrap(err, "")
 		return
 	}
-	fT0M, err1 := os.OpenFile(bkd.T0mPath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err1 != nil {
-		err = errors.Wrap(err1, "")
+	meta := KdTreeExtMeta{
+		PointsOffEnd:  uint64(bkd.pointSize * bkd.t0mCap),
+		RootOff:       0, //not used in T0M
+		NumPoints:     0,
+		PayloadOffEnd: uint64(bkd.pointSize * bkd.t0mCap),
+		PayloadWidth:  uint32(bkd.payloadWidth),
+		PayloadMaxLen: uint32(bkd.payloadMaxLen),
+		LeafCodec:     uint32(bkd.leafCodec),
+		LeafCap:       uint16(bkd.leafCap),
+		IntraCap:      uint16(bkd.intraCap),
+		NumDims:       uint8(bkd.NumDims),
+		BytesPerDim:   uint8(bkd.BytesPerDim),
+		PointSize:     uint8(bkd.pointSize),
+		FormatVer:     FormatVer,
+		DimDescs:      bkd.metaDimDescs(),
+	}
+	if bkd.hasPayload() {
+		meta.PayloadOffEnd += uint64(bkd.payloadSlotSize() * bkd.t0mCap)
+	}
+	if err = bkd.writeT0M(nil, &meta); err != nil {
 		return
 	}
-	meta := KdTreeExtMeta{
-		PointsOffEnd: uint64(bkd.pointSize * bkd.t0mCap),
-		RootOff:      0, //not used in T0M
-		NumPoints:    0,
-		LeafCap:      uint16(bkd.leafCap),
-		IntraCap:     uint16(bkd.intraCap),
-		NumDims:      uint8(bkd.NumDims),
-		BytesPerDim:  uint8(bkd.BytesPerDim),
-		PointSize:    uint8(bkd.pointSize),
-		FormatVer:    0,
-	}
-	buf := make([]byte, meta.PointsOffEnd)
-	if _, err = fT0M.Write(buf); err != nil {
+	bkd.t0m = BkdSubTree{}
+	if err = bkd.t0m.open(bkd.T0mPath(), bkd.storageKind); err != nil {
+		return
+	}
+	err = bkd.t0m.loadT0M()
+	return
+}
+
+//writeT0M atomically replaces the T0M file with the given points, payloads and meta.
+func (bkd *BkdTree) writeT0M(data []byte, meta *KdTreeExtMeta) (err error) {
+	fp := bkd.T0mPath()
+	tmpFp := fp + ".tmp"
+	f, err := os.OpenFile(tmpFp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
 		err = errors.Wrap(err, "")
+		return
 	}
-	if err = binary.Write(fT0M, binary.BigEndian, &meta); err != nil {
+	defer f.Close()
+	buf := make([]byte, meta.PayloadOffEnd)
+	copy(buf, data)
+	if _, err = f.Write(buf); err != nil {
 		err = errors.Wrap(err, "")
+		return
 	}
-	data, err := FileMmap(fT0M)
-	if err != nil {
+	if _, err = f.Write(encodeMeta(meta)); err != nil {
+		err = errors.Wrap(err, "")
 		return
 	}
-	bkd.t0m = BkdSubTree{
-		meta: meta,
-		f:    fT0M,
-		data: data,
+	if bkd.durability == DurabilitySync {
+		if err = f.Sync(); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
 	}
+	if err = os.Rename(tmpFp, fp); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	err = bkd.syncDir()
 	return
 }
 
 func (bkd *BkdTree) openT0M() (err error) {
 	bkd.t0m = BkdSubTree{}
-	if err = bkd.t0m.open(bkd.T0mPath()); err != nil {
+	if err = bkd.t0m.open(bkd.T0mPath(), bkd.storageKind); err != nil {
 		return
 	}
-	bkd.t0mCap = (len(bkd.t0m.data) - KdTreeExtMetaSize) / int(bkd.t0m.meta.PointSize)
+	if err = bkd.t0m.loadT0M(); err != nil {
+		return
+	}
+	if bkd.t0m.meta.FormatVer < FormatVer {
+		//upgrade T0M to the current format version
+		meta := bkd.t0m.meta
+		meta.FormatVer = FormatVer
+		data := append([]byte(nil), bkd.t0m.data...)
+		if err = bkd.t0m.store.Close(); err != nil {
+			return
+		}
+		bkd.t0m = BkdSubTree{}
+		if err = bkd.writeT0M(data, &meta); err != nil {
+			return
+		}
+		if err = bkd.t0m.open(bkd.T0mPath(), bkd.storageKind); err != nil {
+			return
+		}
+		if err = bkd.t0m.loadT0M(); err != nil {
+			return
+		}
+	}
+	bkd.t0mCap = int(bkd.t0m.meta.PointsOffEnd) / int(bkd.t0m.meta.PointSize)
 	bkd.NumDims = int(bkd.t0m.meta.NumDims)
 	bkd.BytesPerDim = int(bkd.t0m.meta.BytesPerDim)
 	bkd.pointSize = int(bkd.t0m.meta.PointSize)
 	bkd.leafCap = int(bkd.t0m.meta.LeafCap)
 	bkd.intraCap = int(bkd.t0m.meta.IntraCap)
+	bkd.dimTypes, bkd.dimBytes = parseDimDescs(&bkd.t0m.meta)
+	bkd.payloadWidth = int(bkd.t0m.meta.PayloadWidth)
+	bkd.payloadMaxLen = int(bkd.t0m.meta.PayloadMaxLen)
+	bkd.leafCodec = LeafCodec(bkd.t0m.meta.LeafCodec)
+	if bkd.leafCodec > LeafCodecPrefix {
+		err = errors.Wrapf(ErrCorrupt, "%s leaf codec %d is not supported", bkd.T0mPath(), bkd.leafCodec)
+	}
 	return
 }
 
-func (bst *BkdSubTree) open(fp string) (err error) {
+//loadT0M populates data with points and payload slots of T0M.
+func (bst *BkdSubTree) loadT0M() (err error) {
+	bst.data, err = bst.store.ReadAt(nil, 0, int(bst.meta.PayloadOffEnd))
+	return
+}
+
+func (bst *BkdSubTree) open(fp string, kind StorageKind) (err error) {
 	if bst.f, err = os.OpenFile(fp, os.O_RDWR, 0600); err != nil {
 		err = errors.Wrap(err, "")
 		return
 	}
-	if bst.data, err = FileMmap(bst.f); err != nil {
+	var info os.FileInfo
+	if info, err = bst.f.Stat(); err != nil {
+		bst.f.Close()
+		err = errors.Wrap(err, "")
+		return
+	} else if info.Size() == 0 {
+		bst.f.Close()
+		err = errors.Wrapf(ErrCorrupt, "%s is empty", fp)
+		return
+	}
+	if bst.store, err = newStorage(bst.f, kind); err != nil {
+		bst.f.Close()
 		return
 	}
-	br := bytes.NewReader(bst.data[len(bst.data)-KdTreeExtMetaSize:])
-	if err = binary.Read(br, binary.BigEndian, &bst.meta); err != nil {
-		err = errors.Wrap(err, "")
+	var data []byte
+	size := bst.store.Size()
+	//the last byte is the format version, which decides the meta size
+	if data, err = bst.store.ReadAt(nil, size-1, 1); err != nil {
+		bst.store.Close()
+		return
+	}
+	formatVer := data[0]
+	if formatVer > FormatVer {
+		bst.store.Close()
+		err = errors.Wrapf(ErrCorrupt, "%s format version %d is not supported", fp, formatVer)
+		return
+	}
+	mSize := metaSize(formatVer)
+	if size < mSize {
+		bst.store.Close()
+		err = errors.Wrapf(ErrCorrupt, "%s size %d is less than meta size", fp, size)
+		return
+	}
+	if data, err = bst.store.ReadAt(nil, size-mSize, mSize); err != nil {
+		bst.store.Close()
+		return
+	}
+	if err = decodeMeta(data, &bst.meta); err != nil {
+		bst.store.Close()
+		err = errors.WithMessage(err, fp)
 		return
 	}
 	return
@@ -365,7 +992,7 @@ func getTreeList(dir, prefix string) (numList []int, err error) {
 }
 
 func rmTreeList(dir, prefix string) (err error) {
-	patt := fmt.Sprintf("^%s_t(?P<num>[0-9]+)$", prefix)
+	patt := fmt.Sprintf("^%s_t(?P<num>[0-9]+)(\\.uidx)?$", prefix)
 	err = FilepathGlobRm(dir, patt)
 	return
 }
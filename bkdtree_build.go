@@ -0,0 +1,119 @@
+package bkdtree
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//PointIterator is a source of points. *BkdIterator is a PointIterator.
+type PointIterator interface {
+	Next() bool
+	Point() Point
+	Err() error
+}
+
+//BkdParams are parameters of a BkdTree. Refers to NewBkdTree for the meaning of each field.
+type BkdParams struct {
+	T0mCap      int
+	LeafCap     int
+	IntraCap    int
+	NumDims     int
+	BytesPerDim int
+}
+
+//BuildBkdTree creates a BkdTree from the given unsorted point stream. Existing files, if any, will be removed.
+//All points are spilled to a temp file and bulk-loaded into one tree of the smallest level able to hold them.
+func BuildBkdTree(dir, prefix string, params BkdParams, source PointIterator, opts ...Option) (bkd *BkdTree, err error) {
+	bkd, err = NewBkdTree(params.T0mCap, params.LeafCap, params.IntraCap, params.NumDims, params.BytesPerDim, dir, prefix, opts...)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			bkd.Destroy()
+			bkd = nil
+		}
+	}()
+
+	//spill all points into a temp file
+	tmpFp := filepath.Join(dir, fmt.Sprintf("%s_build.tmp", prefix))
+	tmpF, err := os.OpenFile(tmpFp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	defer os.Remove(tmpFp)
+	defer tmpF.Close()
+	bw := bufio.NewWriter(tmpF)
+	buf := make([]byte, bkd.pointSize)
+	var numPoints int
+	for source.Next() {
+		point := source.Point()
+		if err = bkd.checkPoint(fmt.Sprintf("points[%d]", numPoints), point); err != nil {
+			return
+		}
+		bkd.encodePoint(buf, point)
+		if _, err = bw.Write(buf); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+		numPoints++
+	}
+	if err = source.Err(); err != nil {
+		return
+	}
+	if err = bw.Flush(); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if numPoints == 0 {
+		return
+	}
+
+	//bulk load the temp file into trees[k]
+	k := bkd.getMinCompactPos(numPoints)
+	bkd.appendTrees(k)
+	gen := bkd.generation + 1
+	meta, err := bkd.bulkLoad(tmpF, gen, 0)
+	if err != nil {
+		return
+	}
+	if bkd.durability == DurabilitySync {
+		if err = tmpF.Sync(); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+	}
+	sub, err := bkd.newManifestSubtree(k, tmpF, meta, time.Now())
+	if err != nil {
+		return
+	}
+	fpK := bkd.TiPath(k)
+	if err = os.Rename(tmpFp, fpK); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = bkd.syncDir(); err != nil {
+		return
+	}
+	if err = bkd.commitSubtree(k, sub); err != nil {
+		return
+	}
+	if err = bkd.trees[k].open(fpK, bkd.storageKind); err != nil {
+		return
+	}
+	if err = bkd.openUserDataIndex(k); err != nil {
+		return
+	}
+	bkd.generation = gen
+	if err = bkd.clearT0M(gen); err != nil {
+		return
+	}
+	bkd.NumPoints = numPoints
+	return
+}
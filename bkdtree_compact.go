@@ -14,8 +14,18 @@ func (bkd *BkdTree) Compact() (err error) {
 	}
 
 	bkd.rwlock.Lock()
-	err = bkd.compactTo(k)
-	bkd.rwlock.Unlock()
+	defer bkd.unlock()
+	//the merge in progress, if any, changes trees
+	if err = bkd.finishMerge(); err != nil {
+		return
+	}
+	if !bkd.open {
+		return
+	} else if k = bkd.getMaxCompactPos(); k < 0 {
+		return
+	}
+	bkd.pinSnapshot(bkd.t0mCap)
+	err = bkd.compactTo(k, nil)
 	return
 }
 
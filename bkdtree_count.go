@@ -0,0 +1,82 @@
+package bkdtree
+
+//Count returns the number of points inside [lowPoint, highPoint].
+//Subtrees whose bounding box is inside the query contribute their NumPoints without decoding any point.
+func (bkd *BkdTree) Count(lowPoint, highPoint Point) (cnt int, err error) {
+	snap, err := bkd.snapshot("(*BkdTree).Count")
+	if err != nil {
+		return
+	}
+	defer snap.Release()
+	cnt, err = snap.Count(lowPoint, highPoint)
+	return
+}
+
+//count counts points without locking. It's invoked on the view of a snapshot with the checked query.
+func (bkd *BkdTree) count(lowPoint, highPoint Point) (cnt int, err error) {
+	pae := PointArrayExt{
+		data:        bkd.t0m.data,
+		numPoints:   int(bkd.t0m.meta.NumPoints),
+		byDim:       0, //not used
+		bytesPerDim: bkd.BytesPerDim,
+		dimBytes:    bkd.dimBytes,
+		numDims:     bkd.NumDims,
+		pointSize:   bkd.pointSize,
+	}
+	cnt = pae.Count(lowPoint, highPoint)
+	buf := bkd.newLeafBuf()
+	for i := 0; i < len(bkd.trees); i++ {
+		if bkd.trees[i].meta.NumPoints <= 0 {
+			continue
+		}
+		var cntI int
+		meta := &bkd.trees[i].meta
+		cntI, err = bkd.countNode(lowPoint, highPoint, bkd.trees[i].store, meta, int(meta.RootOff), buf)
+		if err != nil {
+			return
+		}
+		//erased points are still counted by the tree
+		cnt += cntI - bkd.countTombstones(meta.Generation, lowPoint, highPoint)
+	}
+	return
+}
+
+func (bkd *BkdTree) countNode(lowPoint, highPoint Point, store storage, meta *KdTreeExtMeta, nodeOffset int,
+	buf []byte) (cnt int, err error) {
+	node, err := readIntraNode(store, meta, nodeOffset)
+	if err != nil {
+		return
+	}
+	compare := func(lowVals, highVals []uint64) Relation {
+		return CompareBox(lowVals, highVals, lowPoint, highPoint)
+	}
+	for i, child := range node.Children {
+		if child.NumPoints <= 0 {
+			continue
+		}
+		rel := relateChild(&node, i, bkd.NumDims, compare, lowPoint, highPoint)
+		if rel == CellOutsideQuery {
+			continue
+		} else if rel == CellInsideQuery {
+			cnt += int(child.NumPoints)
+			continue
+		}
+		var cntC int
+		if child.Offset < meta.PointsOffEnd {
+			//leaf node
+			var pae PointArrayExt
+			if pae, err = bkd.readLeaf(store, meta, buf, child, bkd.leafSize(&node, i)); err != nil {
+				return
+			}
+			cntC = pae.Count(lowPoint, highPoint)
+		} else {
+			//intra node
+			cntC, err = bkd.countNode(lowPoint, highPoint, store, meta, int(child.Offset), buf)
+			if err != nil {
+				return
+			}
+		}
+		cnt += cntC
+	}
+	return
+}
@@ -1,8 +1,7 @@
 package bkdtree
 
 import (
-	"bytes"
-	"encoding/binary"
+	"hash/crc32"
 
 	"github.com/pkg/errors"
 )
@@ -10,22 +9,39 @@ import (
 //Erase erases given point.
 func (bkd *BkdTree) Erase(point Point) (found bool, err error) {
 	bkd.rwlock.Lock()
-	defer bkd.rwlock.Unlock()
+	defer bkd.unlock()
+	if err = bkd.finishMerge(); err != nil {
+		return
+	}
 	if !bkd.open {
-		err = errors.Errorf("(*BkdTree).Erase is not allowed at closed state")
+		err = errors.Wrap(ErrClosed, "(*BkdTree).Erase")
+		return
+	}
+	if err = bkd.checkPoint("point", point); err != nil {
 		return
 	}
+	found, err = bkd.erase(point)
+	return
+}
 
+//erase erases given point. Assumes write lock has been acquired.
+func (bkd *BkdTree) erase(point Point) (found bool, err error) {
 	//Query T0M with p; if found, delete it and return.
-	found = bkd.eraseT0M(point)
-	if found {
+	found, err = bkd.eraseT0M(point)
+	if err != nil {
+		return
+	} else if found {
 		bkd.NumPoints--
 		return
 	}
 
 	//Query each non-empty tree in the forest with p; if found, delete it and return
 	for i := 0; i < len(bkd.trees); i++ {
-		found, err = bkd.eraseTi(point, i)
+		if bkd.eraseInPlace(bkd.trees[i].store) {
+			found, err = bkd.eraseTi(point, i)
+		} else {
+			found, err = bkd.tombstoneTi(point, i)
+		}
 		if err != nil {
 			return
 		} else if found {
@@ -36,19 +52,59 @@ func (bkd *BkdTree) Erase(point Point) (found bool, err error) {
 	return
 }
 
-func (bkd *BkdTree) eraseT0M(point Point) (found bool) {
+func (bkd *BkdTree) eraseT0M(point Point) (found bool, err error) {
 	pae := PointArrayExt{
 		data:        bkd.t0m.data,
 		numPoints:   int(bkd.t0m.meta.NumPoints),
 		byDim:       0, //not used
 		bytesPerDim: bkd.BytesPerDim,
+		dimBytes:    bkd.dimBytes,
 		numDims:     bkd.NumDims,
 		pointSize:   bkd.pointSize,
 	}
-	found = pae.Erase(point)
-	if found {
-		bkd.t0m.meta.NumPoints--
-		writeMetaNumPoints(bkd.t0m.data, &bkd.t0m.meta)
+	idx := pae.Index(point)
+	if idx < 0 {
+		return
+	}
+	found = true
+	if err = bkd.eraseT0MAt(&pae, idx); err != nil {
+		return
+	}
+	bkd.t0m.meta.NumPoints--
+	if err = writeMetaNumPoints(bkd.t0m.store, &bkd.t0m.meta); err != nil {
+		return
+	}
+	err = bkd.syncStore(bkd.t0m.store)
+	return
+}
+
+//eraseT0MAt erases the idx-th point of T0M and writes through points and payloads. The caller updates the meta.
+func (bkd *BkdTree) eraseT0MAt(pae *PointArrayExt, idx int) (err error) {
+	if bkd.t0mIndex != nil {
+		last := pae.numPoints - 1
+		bkd.moveT0MSlot(bkd.userDataAt(pae, idx), idx, -1)
+		if idx != last {
+			bkd.moveT0MSlot(bkd.userDataAt(pae, last), last, idx)
+		}
+	}
+	pae.EraseAt(idx)
+	if bkd.hasPayload() && idx != pae.numPoints && bkd.getPayloadRef(pae, idx) != 0 {
+		//the i-th point refers to the i-th payload slot, so the payload moves together with the point
+		slotSize := bkd.payloadSlotSize()
+		dst := int(bkd.t0m.meta.PointsOffEnd) + idx*slotSize
+		src := int(bkd.t0m.meta.PointsOffEnd) + pae.numPoints*slotSize
+		copy(bkd.t0m.data[dst:dst+slotSize], bkd.t0m.data[src:src+slotSize])
+		bkd.setPayloadRef(pae, idx, uint64(dst))
+		if err = bkd.t0m.store.WriteAt(bkd.t0m.data[dst:dst+slotSize], dst); err != nil {
+			return
+		}
+	}
+	//write through the erased slot and the last slot which has been moved into the former
+	for _, i := range []int{idx, pae.numPoints} {
+		off := i * bkd.pointSize
+		if err = bkd.t0m.store.WriteAt(bkd.t0m.data[off:off+bkd.pointSize], off); err != nil {
+			return
+		}
 	}
 	return
 }
@@ -60,22 +116,30 @@ func (bkd *BkdTree) eraseTi(point Point, idx int) (found bool, err error) {
 
 	//depth-first erasing from the root node
 	meta := &bkd.trees[idx].meta
-	found, err = bkd.eraseNode(point, bkd.trees[idx].data, meta, int(meta.RootOff))
+	store := bkd.trees[idx].store
+	if bkd.erasedCopies(meta.Generation, bkd.tombstoneKey(point)) != 0 {
+		//copies left by tombstones are erased in place
+		if found, err = bkd.hasLiveCopy(point, idx, bkd.newLeafBuf()); err != nil || !found {
+			return
+		}
+	}
+	found, err = bkd.eraseNode(point, store, meta, int(meta.RootOff), bkd.newLeafBuf())
 	if err != nil {
 		return
 	}
 	if found {
 		bkd.trees[idx].meta.NumPoints--
-		writeMetaNumPoints(bkd.trees[idx].data, &bkd.trees[idx].meta)
+		if err = writeMetaNumPoints(store, &bkd.trees[idx].meta); err != nil {
+			return
+		}
+		err = bkd.syncStore(store)
 		return
 	}
 	return
 }
 
-func (bkd *BkdTree) eraseNode(point Point, data []byte, meta *KdTreeExtMeta, nodeOffset int) (found bool, err error) {
-	var node KdTreeExtIntraNode
-	br := bytes.NewReader(data[nodeOffset:])
-	err = node.Read(br)
+func (bkd *BkdTree) eraseNode(point Point, store storage, meta *KdTreeExtMeta, nodeOffset int, buf []byte) (found bool, err error) {
+	node, err := readIntraNode(store, meta, nodeOffset)
 	if err != nil {
 		return
 	}
@@ -85,29 +149,210 @@ func (bkd *BkdTree) eraseNode(point Point, data []byte, meta *KdTreeExtMeta, nod
 		}
 		if child.Offset < meta.PointsOffEnd {
 			//leaf node
-			pae := PointArrayExt{
-				data:        data[int(child.Offset):],
-				numPoints:   int(child.NumPoints),
-				byDim:       0, //not used
-				bytesPerDim: bkd.BytesPerDim,
-				numDims:     bkd.NumDims,
-				pointSize:   bkd.pointSize,
+			var pae PointArrayExt
+			if pae, err = bkd.readLeaf(store, meta, buf, child, bkd.leafSize(&node, i)); err != nil {
+				return
+			}
+			if idx := pae.Index(point); idx >= 0 {
+				found = true
+				pae.EraseAt(idx)
+				err = bkd.writeLeaf(store, meta, &node, i, &pae)
 			}
-			found = pae.Erase(point)
 		} else {
 			//intra node
-			found, err = bkd.eraseNode(point, data, meta, int(child.Offset))
+			found, err = bkd.eraseNode(point, store, meta, int(child.Offset), buf)
 		}
 		if err != nil {
 			return
 		}
 		if found {
-			child.NumPoints--
-			//Attention: offset calculation shall be synced with KdTreeExtIntraNode definion.
-			off := nodeOffset + 8*int(node.NumStrips) + 16*i + 8
-			binary.BigEndian.PutUint64(data[off:], child.NumPoints)
+			//rewrite the node in its own format version, which keeps the size
+			node.Children[i].NumPoints--
+			var data []byte
+			if data, err = encodeIntraNode(&node); err != nil {
+				return
+			}
+			err = store.WriteAt(data, nodeOffset)
 			break
 		}
 	}
 	return
 }
+
+//writeLeaf rewrites node.Children[i] in place after points have been erased from it, and updates its size and checksum
+//in the node. The caller rewrites the node.
+func (bkd *BkdTree) writeLeaf(store storage, meta *KdTreeExtMeta, node *KdTreeExtIntraNode, i int, pae *PointArrayExt) (err error) {
+	//erased slots of raw points are zeroed and written as well
+	data, stored := pae.data, pae.data[:pae.numPoints*bkd.pointSize]
+	if meta.LeafCodec != uint32(LeafCodecNone) {
+		//the encoded leaf never grows, so it's rewritten in place
+		data = bkd.encodeLeaf(pae, meta.PointsOffEnd)
+		stored = data
+		node.LeafSizes[i] = uint32(len(data))
+	}
+	if err = store.WriteAt(data, int(node.Children[i].Offset)); err != nil {
+		return
+	}
+	if len(node.LeafChecksums) != 0 {
+		node.LeafChecksums[i] = crc32.ChecksumIEEE(stored)
+	}
+	return
+}
+
+//EraseRange erases all points inside [lowPoint, highPoint] in one pass, and returns the number of erased points.
+//Children of Ti whose bounding boxes are inside the query are dropped as a whole without reading them. If the tree
+//erases by tombstones, a tombstone is recorded for each erased point of Ti instead. Refers to WithTombstones.
+func (bkd *BkdTree) EraseRange(lowPoint, highPoint Point) (n int, err error) {
+	bkd.rwlock.Lock()
+	defer bkd.unlock()
+	if err = bkd.finishMerge(); err != nil {
+		return
+	}
+	if !bkd.open {
+		err = errors.Wrap(ErrClosed, "(*BkdTree).EraseRange")
+		return
+	}
+	if lowPoint, highPoint, err = bkd.checkQuery(lowPoint, highPoint); err != nil {
+		return
+	}
+
+	n, err = bkd.eraseRangeT0M(lowPoint, highPoint)
+	bkd.NumPoints -= n
+	for i := 0; i < len(bkd.trees) && err == nil; i++ {
+		var nI int
+		if bkd.eraseInPlace(bkd.trees[i].store) {
+			nI, err = bkd.eraseRangeTi(lowPoint, highPoint, i)
+		} else {
+			nI, err = bkd.tombstoneRangeTi(lowPoint, highPoint, i)
+		}
+		bkd.NumPoints -= nI
+		n += nI
+	}
+	return
+}
+
+func (bkd *BkdTree) eraseRangeT0M(lowPoint, highPoint Point) (n int, err error) {
+	pae := PointArrayExt{
+		data:        bkd.t0m.data,
+		numPoints:   int(bkd.t0m.meta.NumPoints),
+		byDim:       0, //not used
+		bytesPerDim: bkd.BytesPerDim,
+		dimBytes:    bkd.dimBytes,
+		numDims:     bkd.NumDims,
+		pointSize:   bkd.pointSize,
+	}
+	//the last point moves into the erased slot, and it has been checked already
+	for i := pae.numPoints - 1; i >= 0; i-- {
+		point := pae.GetPoint(i)
+		if !point.Inside(lowPoint, highPoint) {
+			continue
+		}
+		if err = bkd.eraseT0MAt(&pae, i); err != nil {
+			return
+		}
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	bkd.t0m.meta.NumPoints = uint64(pae.numPoints)
+	if err = writeMetaNumPoints(bkd.t0m.store, &bkd.t0m.meta); err != nil {
+		return
+	}
+	err = bkd.syncStore(bkd.t0m.store)
+	return
+}
+
+func (bkd *BkdTree) eraseRangeTi(lowPoint, highPoint Point, idx int) (n int, err error) {
+	if bkd.trees[idx].meta.NumPoints <= 0 {
+		return
+	}
+	meta := &bkd.trees[idx].meta
+	store := bkd.trees[idx].store
+	compare := func(lowVals, highVals []uint64) Relation {
+		return CompareBox(lowVals, highVals, lowPoint, highPoint)
+	}
+	n, err = bkd.eraseRangeNode(lowPoint, highPoint, compare, store, meta, int(meta.RootOff), bkd.newLeafBuf())
+	if err != nil || n == 0 {
+		return
+	}
+	meta.NumPoints -= uint64(n)
+	if err = writeMetaNumPoints(store, meta); err != nil {
+		return
+	}
+	if err = bkd.syncStore(store); err != nil {
+		return
+	}
+	//points erased by tombstones inside the query have been erased physically as well
+	if dropped := bkd.dropTombstones(meta.Generation, lowPoint, highPoint); dropped != 0 {
+		n -= dropped
+		err = bkd.writeTombstones()
+	}
+	return
+}
+
+//eraseRangeNode erases points inside the query from the subtree rooted at the given intra node.
+//It returns the number of erased points.
+func (bkd *BkdTree) eraseRangeNode(lowPoint, highPoint Point, compare func(lowVals, highVals []uint64) Relation,
+	store storage, meta *KdTreeExtMeta, nodeOffset int, buf []byte) (n int, err error) {
+	node, err := readIntraNode(store, meta, nodeOffset)
+	if err != nil {
+		return
+	}
+	for i, child := range node.Children {
+		if child.NumPoints <= 0 {
+			continue
+		}
+		rel := relateChild(&node, i, bkd.NumDims, compare, lowPoint, highPoint)
+		if rel == CellOutsideQuery {
+			continue
+		}
+		var cnt int
+		if rel == CellInsideQuery {
+			//drop the whole child. Children without points are skipped by all readers.
+			cnt = int(child.NumPoints)
+			if child.Offset < meta.PointsOffEnd {
+				if len(node.LeafSizes) != 0 {
+					node.LeafSizes[i] = 0
+				}
+				if len(node.LeafChecksums) != 0 {
+					node.LeafChecksums[i] = crc32.ChecksumIEEE(nil)
+				}
+			}
+		} else if child.Offset < meta.PointsOffEnd {
+			//leaf node
+			var pae PointArrayExt
+			if pae, err = bkd.readLeaf(store, meta, buf, child, bkd.leafSize(&node, i)); err != nil {
+				return
+			}
+			//the last point moves into the erased slot, and it has been checked already
+			for j := pae.numPoints - 1; j >= 0; j-- {
+				if point := pae.GetPoint(j); point.Inside(lowPoint, highPoint) {
+					pae.EraseAt(j)
+					cnt++
+				}
+			}
+			if cnt != 0 {
+				err = bkd.writeLeaf(store, meta, &node, i, &pae)
+			}
+		} else {
+			//intra node
+			cnt, err = bkd.eraseRangeNode(lowPoint, highPoint, compare, store, meta, int(child.Offset), buf)
+		}
+		if err != nil {
+			return
+		}
+		node.Children[i].NumPoints -= uint64(cnt)
+		n += cnt
+	}
+	if n == 0 {
+		return
+	}
+	//rewrite the node in its own format version, which keeps the size
+	var data []byte
+	if data, err = encodeIntraNode(&node); err != nil {
+		return
+	}
+	err = store.WriteAt(data, nodeOffset)
+	return
+}
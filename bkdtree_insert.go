@@ -1,10 +1,12 @@
 package bkdtree
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/pkg/errors"
@@ -12,151 +14,385 @@ import (
 
 //Insert inserts given point. Fail if the tree is full.
 func (bkd *BkdTree) Insert(point Point) (err error) {
+	err = bkd.InsertWithPayload(point, nil)
+	return
+}
+
+//InsertWithPayload inserts given point with its payload. nil is the empty payload. Refers to WithFixedPayload and WithVarPayload.
+func (bkd *BkdTree) InsertWithPayload(point Point, payload []byte) (err error) {
 	bkd.rwlock.Lock()
-	defer bkd.rwlock.Unlock()
+	defer bkd.unlock()
 	if !bkd.open {
-		err = errors.Errorf("(*BkdTree).Inset is not allowed at closed state")
+		err = errors.Wrap(ErrClosed, "(*BkdTree).Insert")
+		return
+	}
+	if err = bkd.checkPoint("point", point); err != nil {
+		return
+	}
+	if err = bkd.checkPayload("payload", payload); err != nil {
 		return
 	}
+	bkd.pinSnapshot(1)
+	if bkd.bgCompaction {
+		err = bkd.insertBackground(point, payload)
+		return
+	}
+	err = bkd.insert(point, payload)
+	return
+}
 
+//insert inserts given point with its payload. Assumes write lock has been acquired.
+func (bkd *BkdTree) insert(point Point, payload []byte) (err error) {
 	//insert into in-memory buffer t0m. If t0m is not full, return.
-	bkd.insertT0M(point)
+	if err = bkd.insertT0M([]Point{point}, [][]byte{payload}); err != nil {
+		return
+	}
 	bkd.NumPoints++
 	if int(bkd.t0m.meta.NumPoints) < bkd.t0mCap {
 		return
 	}
-	//find the smallest index k in [0, len(trees)) at which trees[k] is empty, or its capacity is no less than the sum of size of t0m + trees[0:k+1]
-	k := bkd.getMinCompactPos()
-	if k == len(bkd.trees) {
-		kd := BkdSubTree{
-			meta: KdTreeExtMeta{
-				PointsOffEnd: 0,
-				RootOff:      0,
-				NumPoints:    0,
-				LeafCap:      uint16(bkd.leafCap),
-				IntraCap:     uint16(bkd.intraCap),
-				NumDims:      uint8(bkd.NumDims),
-				BytesPerDim:  uint8(bkd.BytesPerDim),
-				PointSize:    uint8(bkd.pointSize),
-				FormatVer:    0,
-			},
+	//find the smallest index k in [0, len(trees)] at which trees[k] capacity is no less than the sum of size of t0m + trees[0:k+1]
+	k := bkd.getMinCompactPos(0)
+	err = bkd.compactTo(k, nil)
+	return
+}
+
+//InsertBatch inserts given points with one lock acquisition.
+//If the batch doesn't fit into T0M, T0M, the batch and trees[0:k+1] are bulk-loaded into trees[k] directly.
+func (bkd *BkdTree) InsertBatch(points []Point) (err error) {
+	bkd.rwlock.Lock()
+	defer bkd.unlock()
+	if !bkd.open {
+		err = errors.Wrap(ErrClosed, "(*BkdTree).InsertBatch")
+		return
+	}
+	if len(points) == 0 {
+		return
+	}
+	for i, point := range points {
+		if err = bkd.checkPoint(fmt.Sprintf("points[%d]", i), point); err != nil {
+			return
 		}
-		bkd.trees = append(bkd.trees, kd)
 	}
 
-	err = bkd.compactTo(k)
+	bkd.pinSnapshot(len(points))
+	if int(bkd.t0m.meta.NumPoints)+len(points) < bkd.t0mCap {
+		if err = bkd.insertT0M(points, nil); err != nil {
+			return
+		}
+		bkd.NumPoints += len(points)
+		return
+	}
+	//the batch is bulk-loaded with trees, which are read by the merge in progress
+	bkd.waitMerge()
+	if !bkd.open {
+		err = errors.Wrap(ErrClosed, "(*BkdTree).InsertBatch")
+		return
+	}
+	k := bkd.getMinCompactPos(len(points))
+	if err = bkd.compactTo(k, points); err != nil {
+		return
+	}
+	bkd.NumPoints += len(points)
 	return
 }
 
-//caclulate the min compoint position. Returns len(bkd.trees) if not found.
-func (bkd *BkdTree) getMinCompactPos() (k int) {
-	//find the smallest index k in [0, len(trees)) at which trees[k] is empty, or its capacity is no less than the sum of size of t0m + trees[0:k+1]
-	sum := int(bkd.t0m.meta.NumPoints)
-	for k = 0; k < len(bkd.trees); k++ {
-		if bkd.trees[k].meta.NumPoints == 0 {
-			return
+//caclulate the min compoint position with extra points to be inserted.
+//Returns the smallest index k at which the capacity of trees[k] is no less than the sum of size of extra + the frozen
+//buffer + t0m + trees[0:k+1]. It could be no less than len(bkd.trees).
+func (bkd *BkdTree) getMinCompactPos(extra int) (k int) {
+	sum := int(bkd.t0m.meta.NumPoints) + extra
+	if bkd.frozen != nil {
+		sum += int(bkd.frozen.meta.NumPoints)
+	}
+	for k = 0; ; k++ {
+		if k < len(bkd.trees) {
+			sum += int(bkd.trees[k].meta.NumPoints)
 		}
-		sum += int(bkd.trees[k].meta.NumPoints)
 		capK := bkd.t0mCap << uint(k)
 		if capK >= sum {
 			return
 		}
 	}
+}
+
+//appendTrees appends empty trees until len(bkd.trees) > k.
+func (bkd *BkdTree) appendTrees(k int) {
+	for len(bkd.trees) <= k {
+		kd := BkdSubTree{
+			meta: KdTreeExtMeta{
+				PointsOffEnd:  0,
+				RootOff:       0,
+				NumPoints:     0,
+				PayloadWidth:  uint32(bkd.payloadWidth),
+				PayloadMaxLen: uint32(bkd.payloadMaxLen),
+				LeafCodec:     uint32(bkd.leafCodec),
+				LeafCap:       uint16(bkd.leafCap),
+				IntraCap:      uint16(bkd.intraCap),
+				NumDims:       uint8(bkd.NumDims),
+				BytesPerDim:   uint8(bkd.BytesPerDim),
+				PointSize:     uint8(bkd.pointSize),
+				FormatVer:     FormatVer,
+				DimDescs:      bkd.metaDimDescs(),
+			},
+		}
+		bkd.trees = append(bkd.trees, kd)
+	}
+}
+
+//compact the frozen buffer, T0M, extra points and trees[0:k+1] into tree[k]. Assumes write lock has been acquired.
+func (bkd *BkdTree) compactTo(k int, extra []Point) (err error) {
+	bkd.appendTrees(k)
+	tmpFK, meta, sub, err := bkd.buildMerged(k, bkd.generation+1, true, extra)
+	if err != nil {
+		return
+	}
+	defer tmpFK.Close()
+	err = bkd.installMerged(k, tmpFK, meta, sub, true)
 	return
 }
 
-//compact T0M and trees[0:k+1] into tree[k]. Assumes write lock has been acquired.
-func (bkd *BkdTree) compactTo(k int) (err error) {
-	//extract all points from t0m and trees[0:k+1] into a file F
-	fpK := bkd.TiPath(k)
-	tmpFpK := fpK + ".tmp"
-	tmpFK, err := os.OpenFile(tmpFpK, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+//buildMerged bulk-loads points of the frozen buffer, T0M if withT0M is true, extra points and trees[0:k+1] into the
+//temp file of trees[k], makes it durable, and describes it by sub. The caller shall close the returned file.
+func (bkd *BkdTree) buildMerged(k int, gen uint64, withT0M bool, extra []Point) (tmpFK *os.File, meta *KdTreeExtMeta, sub ManifestSubtree, err error) {
+	//extract all points into a file F
+	tmpFK, err = os.OpenFile(bkd.TiPath(k)+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		err = errors.Wrap(err, "")
 		return
 	}
-	defer tmpFK.Close()
+	defer func() {
+		if err != nil {
+			tmpFK.Close()
+			tmpFK = nil
+		}
+	}()
 
-	err = bkd.extractT0M(tmpFK)
+	//payloads are placed after all points
+	bufs := bkd.buffers(withT0M)
+	numPoints := len(extra)
+	for _, bst := range bufs {
+		numPoints += int(bst.meta.NumPoints)
+	}
+	for i := 0; i <= k; i++ {
+		numPoints += int(bkd.trees[i].meta.NumPoints)
+		if bkd.trees[i].meta.NumPoints > 0 {
+			numPoints -= bkd.numTombstones(bkd.trees[i].meta.Generation)
+		}
+	}
+	payloadOff := int64(numPoints * bkd.pointSize)
+	for _, bst := range bufs {
+		if err = bkd.extractT0M(bst, tmpFK, &payloadOff); err != nil {
+			return
+		}
+	}
+	err = bkd.extractPoints(tmpFK, extra)
 	if err != nil {
 		return
 	}
 	for i := 0; i <= k; i++ {
-		err = bkd.extractTi(tmpFK, i)
+		err = bkd.extractTi(tmpFK, i, &payloadOff)
 		if err != nil {
 			return
 		}
 	}
-	meta, err := bkd.bulkLoad(tmpFK)
-	if err != nil {
+	if bkd.userDataIndex {
+		//bulk-loading reorders points
+		if err = bkd.buildMergedIndex(k, gen, tmpFK, numPoints); err != nil {
+			return
+		}
+	}
+	if meta, err = bkd.bulkLoad(tmpFK, gen, payloadOff); err != nil {
+		return
+	}
+
+	//make the new tree durable before dropping any source of its points
+	if bkd.durability == DurabilitySync {
+		if err = tmpFK.Sync(); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+	}
+	sub, err = bkd.newManifestSubtree(k, tmpFK, meta, time.Now())
+	return
+}
+
+//installMerged renames the temp file built by buildMerged to trees[k], and drops the sources of its points.
+//Assumes write lock has been acquired.
+func (bkd *BkdTree) installMerged(k int, tmpFK *os.File, meta *KdTreeExtMeta, sub ManifestSubtree, withT0M bool) (err error) {
+	fpK := bkd.TiPath(k)
+	if err = os.Rename(fpK+".tmp", fpK); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = bkd.syncDir(); err != nil {
+		return
+	}
+	if err = bkd.commitSubtree(k, sub); err != nil {
 		return
 	}
 
-	//empty T0M and Ti, 0<=i<k
-	bkd.clearT0M()
+	//empty the frozen buffer, T0M and Ti, 0<=i<k. The old trees[k] has been replaced by the rename.
+	//A crash from now on leaves stale files, which are detected by generation at Open.
+	bkd.generation = meta.Generation
+	if withT0M {
+		if err = bkd.clearT0M(meta.Generation); err != nil {
+			return
+		}
+	}
+	if err = bkd.dropFrozen(); err != nil {
+		return
+	}
 	for i := 0; i <= k; i++ {
-		if bkd.trees[i].meta.NumPoints <= 0 {
+		if bkd.trees[i].store == nil {
 			continue
-		} else if err = FileMunmap(bkd.trees[i].data); err != nil {
+		} else if err = bkd.retireSubTree(i, i < k); err != nil {
 			return
-		} else if err = bkd.trees[i].f.Close(); err != nil {
-			err = errors.Wrap(err, "")
+		} else if err = bkd.closeUserDataIndex(i, i < k); err != nil {
 			return
-		} else if err = os.Remove(bkd.trees[i].f.Name()); err != nil {
+		}
+		bkd.trees[i].store = nil
+		bkd.trees[i].meta.NumPoints = 0
+	}
+	if bkd.userDataIndex {
+		if err = os.Rename(bkd.UserDataIndexPath(k)+".tmp", bkd.UserDataIndexPath(k)); err != nil {
 			err = errors.Wrap(err, "")
 			return
 		}
-		bkd.trees[i].meta.NumPoints = 0
 	}
-	if err = os.Rename(tmpFpK, fpK); err != nil {
-		err = errors.Wrap(err, "")
+	if err = bkd.syncDir(); err != nil {
 		return
 	}
-	fK, err := os.OpenFile(fpK, os.O_RDWR, 0600)
-	if err != nil {
-		err = errors.Wrap(err, "")
+	var kd BkdSubTree
+	if err = kd.open(fpK, bkd.storageKind); err != nil {
 		return
 	}
-	data, err := FileMmap(fK)
-	if err != nil {
+	bkd.trees[k] = kd
+	if err = bkd.openUserDataIndex(k); err != nil {
 		return
 	}
-	bkd.trees[k] = BkdSubTree{
-		meta: *meta,
-		f:    fK,
-		data: data,
-	}
+	//tombstones of absorbed trees have been applied
+	err = bkd.pruneTombstones()
 	return
 }
 
-func writeMetaNumPoints(data []byte, meta *KdTreeExtMeta) {
-	off := len(data) - KdTreeExtMetaSize
-	off += int(unsafe.Offsetof(meta.NumPoints))
-	binary.BigEndian.PutUint64(data[off:], meta.NumPoints)
+//writeMetaNumPoints patches NumPoints of the meta in its own format version, and updates the checksum if any.
+func writeMetaNumPoints(store storage, meta *KdTreeExtMeta) (err error) {
+	mSize := metaSize(meta.FormatVer)
+	off := store.Size() - mSize
+	data, err := store.ReadAt(nil, off, mSize)
+	if err != nil {
+		return
+	}
+	data = append([]byte(nil), data...)
+	binary.BigEndian.PutUint64(data[unsafe.Offsetof(meta.NumPoints):], meta.NumPoints) //the same among all format versions
+	if meta.FormatVer >= 3 {
+		meta.Checksum = metaChecksum(data)
+		binary.BigEndian.PutUint32(data[metaChecksumOff:], meta.Checksum)
+	}
+	err = store.WriteAt(data, off)
+	return
 }
 
-func (bkd *BkdTree) insertT0M(point Point) {
+//insertT0M appends points to T0M. payloads is either nil or of the same length as points.
+func (bkd *BkdTree) insertT0M(points []Point, payloads [][]byte) (err error) {
 	pae := PointArrayExt{
 		data:        bkd.t0m.data,
 		numPoints:   int(bkd.t0m.meta.NumPoints),
 		byDim:       0, //not used
 		bytesPerDim: bkd.BytesPerDim,
+		dimBytes:    bkd.dimBytes,
 		numDims:     bkd.NumDims,
 		pointSize:   bkd.pointSize,
 	}
-	pae.Append(point)
-	bkd.t0m.meta.NumPoints++
-	writeMetaNumPoints(bkd.t0m.data, &bkd.t0m.meta)
+	slotSize := bkd.payloadSlotSize()
+	for i, point := range points {
+		pae.Append(point)
+		if bkd.t0mIndex != nil {
+			bkd.t0mIndex[point.UserData] = append(bkd.t0mIndex[point.UserData], pae.numPoints)
+		}
+		if bkd.hasPayload() {
+			//the slot could be left by an erased point, so the reference is always rewritten
+			var ref uint64
+			if payloads != nil && payloads[i] != nil {
+				ref = bkd.t0m.meta.PointsOffEnd + uint64(pae.numPoints*slotSize)
+				bkd.encodePayload(bkd.t0m.data[ref:ref], payloads[i]) //appends into the slot in place
+			}
+			bkd.setPayloadRef(&pae, pae.numPoints, ref)
+		}
+		pae.numPoints++
+	}
+	begin := int(bkd.t0m.meta.NumPoints) * bkd.pointSize
+	end := pae.numPoints * bkd.pointSize
+	if err = bkd.t0m.store.WriteAt(bkd.t0m.data[begin:end], begin); err != nil {
+		return
+	}
+	if bkd.hasPayload() {
+		begin = int(bkd.t0m.meta.PointsOffEnd) + int(bkd.t0m.meta.NumPoints)*slotSize
+		end = int(bkd.t0m.meta.PointsOffEnd) + pae.numPoints*slotSize
+		if err = bkd.t0m.store.WriteAt(bkd.t0m.data[begin:end], begin); err != nil {
+			return
+		}
+	}
+	bkd.t0m.meta.NumPoints = uint64(pae.numPoints)
+	if err = writeMetaNumPoints(bkd.t0m.store, &bkd.t0m.meta); err != nil {
+		return
+	}
+	err = bkd.syncStore(bkd.t0m.store)
+	return
 }
 
-func (bkd *BkdTree) clearT0M() {
+//clearT0M empties T0M and marks it with the given generation in one write.
+func (bkd *BkdTree) clearT0M(gen uint64) (err error) {
 	bkd.t0m.meta.NumPoints = 0
-	writeMetaNumPoints(bkd.t0m.data, &bkd.t0m.meta)
+	bkd.t0m.meta.Generation = gen
+	if bkd.t0mIndex != nil {
+		bkd.t0mIndex = make(map[uint64][]int)
+	}
+	if err = bkd.t0m.store.WriteAt(encodeMeta(&bkd.t0m.meta), bkd.t0m.store.Size()-KdTreeExtMetaSize); err != nil {
+		return
+	}
+	err = bkd.syncStore(bkd.t0m.store)
+	return
+}
+
+//syncStore fsyncs the given storage if DurabilitySync is set.
+func (bkd *BkdTree) syncStore(store storage) (err error) {
+	if bkd.durability == DurabilitySync {
+		err = store.Sync()
+	}
+	return
 }
 
-func (bkd *BkdTree) extractT0M(tmpF *os.File) (err error) {
-	size := int(bkd.t0m.meta.NumPoints) * bkd.pointSize
-	_, err = tmpF.Write(bkd.t0m.data[:size])
+//syncDir fsyncs the directory if DurabilitySync is set.
+func (bkd *BkdTree) syncDir() (err error) {
+	if bkd.durability == DurabilitySync {
+		err = FileSyncDir(bkd.dir)
+	}
+	return
+}
+
+//extractT0M extracts points of the given T0M or frozen buffer.
+func (bkd *BkdTree) extractT0M(bst *BkdSubTree, tmpF *os.File, payloadOff *int64) (err error) {
+	size := int(bst.meta.NumPoints) * bkd.pointSize
+	data := bst.data[:size]
+	if bkd.hasPayload() {
+		pae := PointArrayExt{
+			data:        append([]byte{}, data...),
+			numPoints:   int(bst.meta.NumPoints),
+			byDim:       0, //not used
+			bytesPerDim: bkd.BytesPerDim,
+			dimBytes:    bkd.dimBytes,
+			numDims:     bkd.NumDims,
+			pointSize:   bkd.pointSize,
+		}
+		if err = bkd.extractPayloads(tmpF, bst.store, &bst.meta, pae, payloadOff); err != nil {
+			return
+		}
+		data = pae.data
+	}
+	bkd.limiter.wait(len(data))
+	_, err = tmpF.Write(data)
 	if err != nil {
 		err = errors.Wrap(err, "")
 		return
@@ -164,43 +400,68 @@ func (bkd *BkdTree) extractT0M(tmpF *os.File) (err error) {
 	return
 }
 
-func (bkd *BkdTree) extractTi(dstF *os.File, idx int) (err error) {
-	if bkd.trees[idx].meta.NumPoints <= 0 {
+func (bkd *BkdTree) extractPoints(tmpF *os.File, points []Point) (err error) {
+	if len(points) == 0 {
 		return
 	}
-	srcF, err := os.Open(bkd.TiPath(idx))
+	buf := make([]byte, len(points)*bkd.pointSize)
+	for i, point := range points {
+		bkd.encodePoint(buf[i*bkd.pointSize:], point)
+	}
+	_, err = tmpF.Write(buf)
 	if err != nil {
 		err = errors.Wrap(err, "")
 		return
 	}
-	defer srcF.Close()
+	return
+}
+
+func (bkd *BkdTree) extractTi(dstF *os.File, idx int, payloadOff *int64) (err error) {
+	if bkd.trees[idx].meta.NumPoints <= 0 {
+		return
+	}
 
 	//depth-first extracting from the root node
 	meta := &bkd.trees[idx].meta
-	err = bkd.extractNode(dstF, bkd.trees[idx].data, meta, int(meta.RootOff))
+	err = bkd.extractNode(dstF, bkd.trees[idx].store, meta, int(meta.RootOff), bkd.newLeafBuf(), make(erasedSeen), payloadOff)
 	return
 }
 
-func (bkd *BkdTree) extractNode(dstF *os.File, data []byte, meta *KdTreeExtMeta, nodeOffset int) (err error) {
-	var node KdTreeExtIntraNode
-	bf := bytes.NewReader(data[nodeOffset:])
-	err = node.Read(bf)
+func (bkd *BkdTree) extractNode(dstF *os.File, store storage, meta *KdTreeExtMeta, nodeOffset int, buf []byte, seen erasedSeen, payloadOff *int64) (err error) {
+	node, err := readIntraNode(store, meta, nodeOffset)
 	if err != nil {
-		err = errors.Wrap(err, "")
 		return
 	}
-	for _, child := range node.Children {
+	for i, child := range node.Children {
+		if child.NumPoints <= 0 {
+			//dropped by EraseRange
+			continue
+		}
 		if child.Offset < meta.PointsOffEnd {
 			//leaf node
-			length := int(child.NumPoints) * int(meta.PointSize)
-			_, err = dstF.Write(data[int(child.Offset) : int(child.Offset)+length])
+			var pae PointArrayExt
+			if pae, err = bkd.readLeaf(store, meta, buf, child, bkd.leafSize(&node, i)); err != nil {
+				return
+			}
+			if len(bkd.tombstones) != 0 {
+				pae = bkd.dropErased(meta, pae, seen)
+			}
+			if bkd.hasPayload() {
+				//the leaf could be a slice of the mapping
+				pae.data = append([]byte{}, pae.data...)
+				if err = bkd.extractPayloads(dstF, store, meta, pae, payloadOff); err != nil {
+					return
+				}
+			}
+			bkd.limiter.wait(len(pae.data))
+			_, err = dstF.Write(pae.data)
 			if err != nil {
 				err = errors.Wrap(err, "")
 				return
 			}
 		} else {
 			//intra node
-			err = bkd.extractNode(dstF, data, meta, int(child.Offset))
+			err = bkd.extractNode(dstF, store, meta, int(child.Offset), buf, seen, payloadOff)
 			if err != nil {
 				return
 			}
@@ -209,12 +470,22 @@ func (bkd *BkdTree) extractNode(dstF *os.File, data []byte, meta *KdTreeExtMeta,
 	return
 }
 
-func (bkd *BkdTree) bulkLoad(tmpF *os.File) (meta *KdTreeExtMeta, err error) {
+//bulkLoad builds a tree of points in tmpF, which end at the current position. Payloads, if any, end at payloadOffEnd.
+func (bkd *BkdTree) bulkLoad(tmpF *os.File, gen uint64, payloadOffEnd int64) (meta *KdTreeExtMeta, err error) {
 	pointsOffEnd, err := tmpF.Seek(0, 1) //get current position
 	if err != nil {
 		err = errors.Wrap(err, "")
 		return
 	}
+	if payloadOffEnd > pointsOffEnd {
+		//intra nodes follow payloads
+		if _, err = tmpF.Seek(payloadOffEnd, 0); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+	} else {
+		payloadOffEnd = pointsOffEnd
+	}
 	var data []byte
 	if data, err = FileMmap(tmpF); err != nil {
 		return
@@ -222,25 +493,40 @@ func (bkd *BkdTree) bulkLoad(tmpF *os.File) (meta *KdTreeExtMeta, err error) {
 	defer FileMunmap(data)
 
 	numPoints := int(pointsOffEnd / int64(bkd.pointSize))
-	rootOff, err1 := bkd.createKdTreeExt(tmpF, data, 0, numPoints, 0)
+	var plan *kdPlan
+	if bkd.bgConcurrency > 1 {
+		//partitioning dominates bulk-loading, and strips are partitioned independently
+		plan = bkd.planKdTree(data, 0, numPoints, 0, make(chan struct{}, bkd.bgConcurrency-1))
+	}
+	rootOff, _, _, err1 := bkd.createKdTreeExt(tmpF, data, 0, numPoints, 0, plan)
 	if err1 != nil {
 		err = err1
 		return
 	}
+	if bkd.leafCodec != LeafCodecNone {
+		if rootOff, pointsOffEnd, payloadOffEnd, err = bkd.packLeaves(tmpF, data, rootOff, pointsOffEnd, payloadOffEnd); err != nil {
+			return
+		}
+	}
 	//record meta info at end
 	meta = &KdTreeExtMeta{
-		PointsOffEnd: uint64(pointsOffEnd),
-		RootOff:      uint64(rootOff),
-		NumPoints:    uint64(numPoints),
-		LeafCap:      uint16(bkd.leafCap),
-		IntraCap:     uint16(bkd.intraCap),
-		NumDims:      uint8(bkd.NumDims),
-		BytesPerDim:  uint8(bkd.BytesPerDim),
-		PointSize:    uint8(bkd.pointSize),
-		FormatVer:    0,
-	}
-	err = binary.Write(tmpF, binary.BigEndian, meta)
-	if err != nil {
+		PointsOffEnd:  uint64(pointsOffEnd),
+		RootOff:       uint64(rootOff),
+		NumPoints:     uint64(numPoints),
+		Generation:    gen,
+		PayloadOffEnd: uint64(payloadOffEnd),
+		PayloadWidth:  uint32(bkd.payloadWidth),
+		PayloadMaxLen: uint32(bkd.payloadMaxLen),
+		LeafCodec:     uint32(bkd.leafCodec),
+		LeafCap:       uint16(bkd.leafCap),
+		IntraCap:      uint16(bkd.intraCap),
+		NumDims:       uint8(bkd.NumDims),
+		BytesPerDim:   uint8(bkd.BytesPerDim),
+		PointSize:     uint8(bkd.pointSize),
+		FormatVer:     FormatVer,
+		DimDescs:      bkd.metaDimDescs(),
+	}
+	if _, err = tmpF.Write(encodeMeta(meta)); err != nil {
 		err = errors.Wrap(err, "")
 		return
 	}
@@ -256,47 +542,131 @@ func getCurrentOffset(f *os.File) (offset int64, err error) {
 	return
 }
 
-func (bkd *BkdTree) createKdTreeExt(tmpF *os.File, data []byte, begin, end, depth int) (offset int64, err error) {
-	if begin >= end {
-		err = errors.New(fmt.Sprintf("assertion begin>=end failed, begin %v, end %v", begin, end))
-		return
-	}
+//kdPlan is the partition of points[begin:end) done by createKdTreeExt, which is computed ahead by planKdTree.
+type kdPlan struct {
+	splitValues []uint64
+	splitPoses  []int
+	children    []*kdPlan //nil for leaves
+}
 
-	splitDim := depth % bkd.NumDims
-	numStrips := (end - begin + bkd.leafCap - 1) / bkd.leafCap
+//numStrips returns the number of strips of the intra node of the given number of points.
+func (bkd *BkdTree) numStrips(numPoints int) (numStrips int) {
+	numStrips = (numPoints + bkd.leafCap - 1) / bkd.leafCap
 	if numStrips > bkd.intraCap {
 		numStrips = bkd.intraCap
 	}
+	return
+}
+
+//stripRange returns the range of points of the strip-th strip of points[begin:end).
+func stripRange(begin, end, strip, numStrips int, splitPoses []int) (posBegin, posEnd int) {
+	posBegin = begin
+	if strip != 0 {
+		posBegin = begin + splitPoses[strip-1]
+	}
+	posEnd = end
+	if strip != numStrips-1 {
+		posEnd = begin + splitPoses[strip]
+	}
+	return
+}
 
+//planKdTree partitions points[begin:end) the same as createKdTreeExt. Strips are disjoint, so subtrees are planned by
+//new goroutines while sem has room.
+func (bkd *BkdTree) planKdTree(data []byte, begin, end, depth int, sem chan struct{}) (plan *kdPlan) {
+	numStrips := bkd.numStrips(end - begin)
 	pae := PointArrayExt{
 		data:        data[begin*bkd.pointSize:],
 		numPoints:   end - begin,
-		byDim:       splitDim,
+		byDim:       depth % bkd.NumDims,
 		bytesPerDim: bkd.BytesPerDim,
+		dimBytes:    bkd.dimBytes,
 		numDims:     bkd.NumDims,
 		pointSize:   bkd.pointSize,
 	}
-	splitValues, splitPoses := SplitPoints(&pae, numStrips)
+	plan = &kdPlan{children: make([]*kdPlan, numStrips)}
+	plan.splitValues, plan.splitPoses = SplitPoints(&pae, numStrips)
+	var wg sync.WaitGroup
+	for strip := 0; strip < numStrips; strip++ {
+		posBegin, posEnd := stripRange(begin, end, strip, numStrips, plan.splitPoses)
+		if posEnd-posBegin <= bkd.leafCap {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+			wg.Add(1)
+			go func(strip, posBegin, posEnd int) {
+				defer wg.Done()
+				plan.children[strip] = bkd.planKdTree(data, posBegin, posEnd, depth+1, sem)
+				<-sem
+			}(strip, posBegin, posEnd)
+		default:
+			plan.children[strip] = bkd.planKdTree(data, posBegin, posEnd, depth+1, sem)
+		}
+	}
+	wg.Wait()
+	return
+}
+
+//createKdTreeExt builds the kdtree of points[begin:end) and returns the offset and bounding box of the root node.
+//Points are partitioned as the plan if it isn't nil.
+func (bkd *BkdTree) createKdTreeExt(tmpF *os.File, data []byte, begin, end, depth int, plan *kdPlan) (offset int64, lowVals, highVals []uint64, err error) {
+	if begin >= end {
+		err = errors.New(fmt.Sprintf("assertion begin>=end failed, begin %v, end %v", begin, end))
+		return
+	}
+
+	splitDim := depth % bkd.NumDims
+	numStrips := bkd.numStrips(end - begin)
+
+	var splitValues []uint64
+	var splitPoses []int
+	if plan != nil {
+		splitValues, splitPoses = plan.splitValues, plan.splitPoses
+	} else {
+		pae := PointArrayExt{
+			data:        data[begin*bkd.pointSize:],
+			numPoints:   end - begin,
+			byDim:       splitDim,
+			bytesPerDim: bkd.BytesPerDim,
+			dimBytes:    bkd.dimBytes,
+			numDims:     bkd.NumDims,
+			pointSize:   bkd.pointSize,
+		}
+		splitValues, splitPoses = SplitPoints(&pae, numStrips)
+	}
 
 	children := make([]KdTreeExtNodeInfo, 0, numStrips)
+	leafChecksums := make([]uint32, 0, numStrips)
+	childLowVals := make([]uint64, 0, numStrips*bkd.NumDims)
+	childHighVals := make([]uint64, 0, numStrips*bkd.NumDims)
 	var childOffset int64
+	var lows, highs []uint64
 	for strip := 0; strip < numStrips; strip++ {
-		posBegin := begin
-		if strip != 0 {
-			posBegin = begin + splitPoses[strip-1]
-		}
-		posEnd := end
-		if strip != numStrips-1 {
-			posEnd = begin + splitPoses[strip]
-		}
+		posBegin, posEnd := stripRange(begin, end, strip, numStrips, splitPoses)
 		if posEnd-posBegin <= bkd.leafCap {
 			info := KdTreeExtNodeInfo{
 				Offset:    uint64(posBegin * bkd.pointSize),
 				NumPoints: uint64(posEnd - posBegin),
 			}
 			children = append(children, info)
+			leafChecksums = append(leafChecksums, crc32.ChecksumIEEE(data[posBegin*bkd.pointSize:posEnd*bkd.pointSize]))
+			leaf := PointArrayExt{
+				data:        data[posBegin*bkd.pointSize:],
+				numPoints:   posEnd - posBegin,
+				byDim:       0, //not used
+				bytesPerDim: bkd.BytesPerDim,
+				dimBytes:    bkd.dimBytes,
+				numDims:     bkd.NumDims,
+				pointSize:   bkd.pointSize,
+			}
+			lows, highs = leaf.GetBounds()
 		} else {
-			childOffset, err = bkd.createKdTreeExt(tmpF, data, posBegin, posEnd, depth+1)
+			var childPlan *kdPlan
+			if plan != nil {
+				childPlan = plan.children[strip]
+			}
+			childOffset, lows, highs, err = bkd.createKdTreeExt(tmpF, data, posBegin, posEnd, depth+1, childPlan)
 			if err != nil {
 				return
 			}
@@ -305,6 +675,22 @@ func (bkd *BkdTree) createKdTreeExt(tmpF *os.File, data []byte, begin, end, dept
 				NumPoints: uint64(posEnd - posBegin),
 			}
 			children = append(children, info)
+			leafChecksums = append(leafChecksums, 0)
+		}
+		childLowVals = append(childLowVals, lows...)
+		childHighVals = append(childHighVals, highs...)
+		if strip == 0 {
+			lowVals = append([]uint64{}, lows...)
+			highVals = append([]uint64{}, highs...)
+		} else {
+			for dim := 0; dim < bkd.NumDims; dim++ {
+				if lows[dim] < lowVals[dim] {
+					lowVals[dim] = lows[dim]
+				}
+				if highs[dim] > highVals[dim] {
+					highVals[dim] = highs[dim]
+				}
+			}
 		}
 	}
 
@@ -314,13 +700,20 @@ func (bkd *BkdTree) createKdTreeExt(tmpF *os.File, data []byte, begin, end, dept
 	}
 
 	node := &KdTreeExtIntraNode{
-		SplitDim:    uint32(splitDim),
-		NumStrips:   uint32(numStrips),
-		SplitValues: splitValues,
-		Children:    children,
+		SplitDim:      uint32(splitDim),
+		NumStrips:     uint32(numStrips),
+		SplitValues:   splitValues,
+		Children:      children,
+		LowVals:       childLowVals,
+		HighVals:      childHighVals,
+		LeafChecksums: leafChecksums,
+	}
+	var nodeData []byte
+	if nodeData, err = encodeIntraNode(node); err != nil {
+		return
 	}
-	err = node.Write(tmpF)
-	if err != nil {
+	bkd.limiter.wait(len(nodeData))
+	if _, err = tmpF.Write(nodeData); err != nil {
 		err = errors.Wrap(err, "")
 		return
 	}
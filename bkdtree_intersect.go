@@ -1,31 +1,70 @@
 package bkdtree
 
 import (
-	"bytes"
-
 	"github.com/pkg/errors"
 )
 
+//visitorAdapter adapts IntersectVisitor to IntersectVisitorExt.
+type visitorAdapter struct {
+	IntersectVisitor
+}
+
+func (v visitorAdapter) VisitPointExt(point Point) error {
+	v.VisitPoint(point)
+	return nil
+}
+
+//getCellComparer returns the function to compare a cell with the query of the given visitor.
+func getCellComparer(visitor IntersectVisitorExt) func(lowVals, highVals []uint64) Relation {
+	var v interface{} = visitor
+	if bounded, ok := v.(boundedVisitor); ok {
+		v = bounded.IntersectVisitorExt
+	}
+	if adapter, ok := v.(visitorAdapter); ok {
+		v = adapter.IntersectVisitor
+	}
+	if cv, ok := v.(IntersectCellVisitor); ok {
+		return cv.Compare
+	}
+	lowP := visitor.GetLowPoint()
+	highP := visitor.GetHighPoint()
+	return func(lowVals, highVals []uint64) Relation {
+		return CompareBox(lowVals, highVals, lowP, highP)
+	}
+}
+
 //Intersect does window query
 func (bkd *BkdTree) Intersect(visitor IntersectVisitor) (err error) {
-	bkd.rwlock.RLock()
-	defer bkd.rwlock.RUnlock()
-	if !bkd.open {
-		err = errors.Errorf("(*BkdTree).Intersect is not allowed at closed state")
+	err = bkd.IntersectExt(visitorAdapter{visitor})
+	return
+}
+
+//IntersectExt does window query. The traversal stops as soon as visitor.VisitPointExt returns non-nil error.
+//The error is returned to the caller unless it's ErrStopVisit. It queries a snapshot, so it never waits for a compaction.
+func (bkd *BkdTree) IntersectExt(visitor IntersectVisitorExt) (err error) {
+	snap, err := bkd.snapshot("(*BkdTree).Intersect")
+	if err != nil {
 		return
 	}
+	defer snap.Release()
+	err = snap.IntersectExt(visitor)
+	return
+}
 
-	bkd.intersectT0M(visitor)
-	for i := 0; i < len(bkd.trees); i++ {
+//intersect does window query without locking. It's invoked on the view of a snapshot with the checked query.
+func (bkd *BkdTree) intersect(visitor IntersectVisitorExt) (err error) {
+	err = bkd.intersectT0M(visitor)
+	for i := 0; i < len(bkd.trees) && err == nil; i++ {
 		err = bkd.intersectTi(visitor, i)
-		if err != nil {
-			return
-		}
+	}
+	if errors.Is(err, ErrStopVisit) {
+		err = nil
 	}
 	return
 }
 
-func (bkd *BkdTree) intersectT0M(visitor IntersectVisitor) {
+func (bkd *BkdTree) intersectT0M(visitor IntersectVisitorExt) (err error) {
+	pv := bkd.getPayloadVisitor(visitor)
 	lowP := visitor.GetLowPoint()
 	highP := visitor.GetHighPoint()
 	pae := PointArrayExt{
@@ -33,69 +72,95 @@ func (bkd *BkdTree) intersectT0M(visitor IntersectVisitor) {
 		numPoints:   int(bkd.t0m.meta.NumPoints),
 		byDim:       0, //not used
 		bytesPerDim: bkd.BytesPerDim,
+		dimBytes:    bkd.dimBytes,
 		numDims:     bkd.NumDims,
 		pointSize:   bkd.pointSize,
 	}
 	for i := 0; i < pae.numPoints; i++ {
 		point := pae.GetPoint(i)
 		if point.Inside(lowP, highP) {
-			visitor.VisitPoint(point)
+			if err = bkd.visitPoint(visitor, pv, bkd.t0m.store, &bkd.t0m.meta, &pae, i, point); err != nil {
+				return
+			}
 		}
 	}
 	return
 }
 
-func (bkd *BkdTree) intersectTi(visitor IntersectVisitor, idx int) (err error) {
+func (bkd *BkdTree) intersectTi(visitor IntersectVisitorExt, idx int) (err error) {
 	if bkd.trees[idx].meta.NumPoints <= 0 {
 		return
 	}
 	//depth-first visiting from the root node
 	meta := &bkd.trees[idx].meta
-	err = bkd.intersectNode(visitor, bkd.trees[idx].data, meta, int(meta.RootOff))
+	compare := getCellComparer(visitor)
+	buf := bkd.newLeafBuf()
+	err = bkd.intersectNode(visitor, compare, bkd.trees[idx].store, meta, int(meta.RootOff), false, buf, make(erasedSeen))
 	return
 }
 
-func (bkd *BkdTree) intersectNode(visitor IntersectVisitor, data []byte,
-	meta *KdTreeExtMeta, nodeOffset int) (err error) {
+//relateChild returns the relation between node.Children[i] and the query. It degrades to pruning with split values
+//if the node doesn't carry bounding boxes, in which case CellInsideQuery is never returned.
+func relateChild(node *KdTreeExtIntraNode, i, numDims int, compare func(lowVals, highVals []uint64) Relation,
+	lowPoint, highPoint Point) (rel Relation) {
+	if len(node.LowVals) != 0 {
+		rel = compare(node.LowVals[i*numDims:(i+1)*numDims], node.HighVals[i*numDims:(i+1)*numDims])
+		return
+	}
+	rel = CellOutsideQuery
+	if i < int(node.NumStrips)-1 && node.SplitValues[i] < lowPoint.Vals[node.SplitDim] {
+		return
+	}
+	if i != 0 && node.SplitValues[i-1] > highPoint.Vals[node.SplitDim] {
+		return
+	}
+	rel = CellCrossesQuery
+	return
+}
+
+//intersectNode visits the subtree rooted at the given intra node. All points of the subtree match the query if inside is true.
+//buf is used to read leaves. seen is shared by the traversal of the tree.
+func (bkd *BkdTree) intersectNode(visitor IntersectVisitorExt, compare func(lowVals, highVals []uint64) Relation,
+	store storage, meta *KdTreeExtMeta, nodeOffset int, inside bool, buf []byte, seen erasedSeen) (err error) {
+	pv := bkd.getPayloadVisitor(visitor)
 	lowP := visitor.GetLowPoint()
 	highP := visitor.GetHighPoint()
-	var node KdTreeExtIntraNode
-	bf := bytes.NewReader(data[nodeOffset:])
-	err = node.Read(bf)
+	node, err := readIntraNode(store, meta, nodeOffset)
 	if err != nil {
 		return
 	}
-	lowVal := lowP.Vals[node.SplitDim]
-	highVal := highP.Vals[node.SplitDim]
 	for i, child := range node.Children {
 		if child.NumPoints <= 0 {
 			continue
 		}
-		if i < int(node.NumStrips)-1 && node.SplitValues[i] < lowVal {
-			continue
-		}
-		if i != 0 && node.SplitValues[i-1] > highVal {
-			continue
+		childInside := inside
+		if !inside {
+			rel := relateChild(&node, i, bkd.NumDims, compare, lowP, highP)
+			if rel == CellOutsideQuery {
+				continue
+			}
+			childInside = rel == CellInsideQuery
 		}
 		if child.Offset < meta.PointsOffEnd {
 			//leaf node
-			pae := PointArrayExt{
-				data:        data[int(child.Offset):],
-				numPoints:   int(child.NumPoints),
-				byDim:       0, //not used
-				bytesPerDim: bkd.BytesPerDim,
-				numDims:     bkd.NumDims,
-				pointSize:   bkd.pointSize,
+			var pae PointArrayExt
+			if pae, err = bkd.readLeaf(store, meta, buf, child, bkd.leafSize(&node, i)); err != nil {
+				return
 			}
 			for i := 0; i < pae.numPoints; i++ {
+				if bkd.isErased(meta, &pae, i, seen) {
+					continue
+				}
 				point := pae.GetPoint(i)
-				if point.Inside(lowP, highP) {
-					visitor.VisitPoint(point)
+				if childInside || point.Inside(lowP, highP) {
+					if err = bkd.visitPoint(visitor, pv, store, meta, &pae, i, point); err != nil {
+						return
+					}
 				}
 			}
 		} else {
 			//intra node
-			err = bkd.intersectNode(visitor, data, meta, int(child.Offset))
+			err = bkd.intersectNode(visitor, compare, store, meta, int(child.Offset), childInside, buf, seen)
 		}
 		if err != nil {
 			return
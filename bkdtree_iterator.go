@@ -0,0 +1,195 @@
+package bkdtree
+
+//iterFrame is the state of an intra node being iterated.
+type iterFrame struct {
+	store    storage
+	meta     *KdTreeExtMeta
+	node     KdTreeExtIntraNode
+	childIdx int  //the next child to visit
+	inside   bool //all points of the subtree match the query
+}
+
+//BkdIterator is a cursor of points inside [lowPoint, highPoint]. It walks T0M and trees lazily in depth-first order.
+//It holds a snapshot until Close, so it doesn't see writes done after it's created. Writes don't wait for it, and the
+//goroutine iterating it is able to write the tree.
+/**
+ * usage:
+ * it, err := bkd.NewIterator(lowPoint, highPoint)
+ * defer it.Close()
+ * for it.Next() {
+ *     point := it.Point()
+ * }
+ * err = it.Err()
+ */
+type BkdIterator struct {
+	bkd        *BkdTree //the view of snap
+	snap       *Snapshot
+	lowPoint   Point
+	highPoint  Point
+	compare    func(lowVals, highVals []uint64) Relation
+	t0mIdx     int //the next T0M point to visit
+	treeIdx    int //the next tree to visit
+	stack      []iterFrame
+	leaf       PointArrayExt
+	leafMeta   *KdTreeExtMeta
+	leafBuf    []byte
+	leafIdx    int //the next leaf point to visit
+	seen       erasedSeen
+	leafInside bool
+	point      Point
+	err        error
+	closed     bool
+}
+
+//NewIterator creates a cursor of points inside [lowPoint, highPoint]. The caller shall Close it.
+func (bkd *BkdTree) NewIterator(lowPoint, highPoint Point) (it *BkdIterator, err error) {
+	snap, err := bkd.snapshot("(*BkdTree).NewIterator")
+	if err != nil {
+		return
+	}
+	it, err = newIterator(snap, lowPoint, highPoint)
+	return
+}
+
+//newIterator creates a cursor over the given snapshot, which is released by the cursor, or at once on failure.
+func newIterator(snap *Snapshot, lowPoint, highPoint Point) (it *BkdIterator, err error) {
+	bkd := snap.view.tree
+	if lowPoint, highPoint, err = snap.bkd.checkQuery(lowPoint, highPoint); err != nil {
+		snap.Release()
+		return
+	}
+	it = &BkdIterator{
+		bkd:       bkd,
+		snap:      snap,
+		lowPoint:  lowPoint,
+		highPoint: highPoint,
+		compare: func(lowVals, highVals []uint64) Relation {
+			return CompareBox(lowVals, highVals, lowPoint, highPoint)
+		},
+		leafBuf: bkd.newLeafBuf(),
+		seen:    make(erasedSeen),
+	}
+	return
+}
+
+//Next advances the cursor to the next point. It returns false when the iteration is done or failed.
+func (it *BkdIterator) Next() bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+	bkd := it.bkd
+	for it.t0mIdx < int(bkd.t0m.meta.NumPoints) {
+		pae := PointArrayExt{
+			data:        bkd.t0m.data,
+			numPoints:   int(bkd.t0m.meta.NumPoints),
+			byDim:       0, //not used
+			bytesPerDim: bkd.BytesPerDim,
+			dimBytes:    bkd.dimBytes,
+			numDims:     bkd.NumDims,
+			pointSize:   bkd.pointSize,
+		}
+		point := pae.GetPoint(it.t0mIdx)
+		it.t0mIdx++
+		if point.Inside(it.lowPoint, it.highPoint) {
+			it.point = point
+			return true
+		}
+	}
+	for {
+		for it.leafIdx < it.leaf.numPoints {
+			if bkd.isErased(it.leafMeta, &it.leaf, it.leafIdx, it.seen) {
+				it.leafIdx++
+				continue
+			}
+			point := it.leaf.GetPoint(it.leafIdx)
+			it.leafIdx++
+			if it.leafInside || point.Inside(it.lowPoint, it.highPoint) {
+				it.point = point
+				return true
+			}
+		}
+		if len(it.stack) == 0 {
+			//move to the next non-empty tree
+			if it.treeIdx >= len(bkd.trees) {
+				return false
+			}
+			idx := it.treeIdx
+			it.treeIdx++
+			if bkd.trees[idx].meta.NumPoints <= 0 {
+				continue
+			}
+			meta := &bkd.trees[idx].meta
+			if it.err = it.push(bkd.trees[idx].store, meta, int(meta.RootOff), false); it.err != nil {
+				return false
+			}
+			continue
+		}
+		top := &it.stack[len(it.stack)-1]
+		if top.childIdx >= len(top.node.Children) {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		i := top.childIdx
+		top.childIdx++
+		child := top.node.Children[i]
+		if child.NumPoints <= 0 {
+			continue
+		}
+		inside := top.inside
+		if !inside {
+			rel := relateChild(&top.node, i, bkd.NumDims, it.compare, it.lowPoint, it.highPoint)
+			if rel == CellOutsideQuery {
+				continue
+			}
+			inside = rel == CellInsideQuery
+		}
+		if child.Offset < top.meta.PointsOffEnd {
+			//leaf node
+			if it.leaf, it.err = bkd.readLeaf(top.store, top.meta, it.leafBuf, child, bkd.leafSize(&top.node, i)); it.err != nil {
+				return false
+			}
+			it.leafMeta = top.meta
+			it.leafIdx = 0
+			it.leafInside = inside
+		} else if it.err = it.push(top.store, top.meta, int(child.Offset), inside); it.err != nil {
+			//intra node
+			return false
+		}
+	}
+}
+
+func (it *BkdIterator) push(store storage, meta *KdTreeExtMeta, nodeOffset int, inside bool) (err error) {
+	node, err := readIntraNode(store, meta, nodeOffset)
+	if err != nil {
+		return
+	}
+	it.stack = append(it.stack, iterFrame{
+		store:  store,
+		meta:   meta,
+		node:   node,
+		inside: inside,
+	})
+	return
+}
+
+//Point returns the current point. It's valid only after Next returns true.
+func (it *BkdIterator) Point() Point {
+	return it.point
+}
+
+//Err returns the error, if any, that was encountered during iteration.
+func (it *BkdIterator) Err() error {
+	return it.err
+}
+
+//Close releases the snapshot. It's safe to call Close multiple times.
+func (it *BkdIterator) Close() (err error) {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	it.stack = nil
+	it.leaf = PointArrayExt{}
+	err = it.snap.Release()
+	return
+}
@@ -0,0 +1,287 @@
+package bkdtree
+
+import (
+	"container/heap"
+	"math"
+)
+
+//Metric measures the distance between points. Values of points and cells are encoded. Built-in metrics measure native
+//values of each dimension, while other metrics shall decode values of dimensions which aren't DimUint by themselves.
+//Refers to DecodeValue.
+type Metric interface {
+	//Distance returns the distance between two points.
+	Distance(lhs, rhs Point) float64
+	//MinDistance returns the lower bound of distance between the given point and any point inside the cell [lowVals, highVals].
+	MinDistance(point Point, lowVals, highVals []uint64) float64
+}
+
+type euclideanMetric struct {
+	bkd *BkdTree //decodes values of dimensions. nil means all dimensions are DimUint.
+}
+
+type manhattanMetric struct {
+	bkd *BkdTree //decodes values of dimensions. nil means all dimensions are DimUint.
+}
+
+var (
+	//Euclidean is the L2 distance.
+	Euclidean Metric = euclideanMetric{}
+	//Manhattan is the L1 distance.
+	Manhattan Metric = manhattanMetric{}
+)
+
+//Neighbor is an item of the Nearest result.
+type Neighbor struct {
+	Point    Point
+	Distance float64
+}
+
+func (m euclideanMetric) Distance(lhs, rhs Point) (dist float64) {
+	for dim := 0; dim < len(lhs.Vals); dim++ {
+		delta := m.bkd.dimDist(dim, lhs.Vals[dim], rhs.Vals[dim], rhs.Vals[dim])
+		dist += delta * delta
+	}
+	dist = math.Sqrt(dist)
+	return
+}
+
+func (m euclideanMetric) MinDistance(point Point, lowVals, highVals []uint64) (dist float64) {
+	for dim := 0; dim < len(point.Vals); dim++ {
+		delta := m.bkd.dimDist(dim, point.Vals[dim], lowVals[dim], highVals[dim])
+		dist += delta * delta
+	}
+	dist = math.Sqrt(dist)
+	return
+}
+
+func (m manhattanMetric) Distance(lhs, rhs Point) (dist float64) {
+	for dim := 0; dim < len(lhs.Vals); dim++ {
+		dist += m.bkd.dimDist(dim, lhs.Vals[dim], rhs.Vals[dim], rhs.Vals[dim])
+	}
+	return
+}
+
+func (m manhattanMetric) MinDistance(point Point, lowVals, highVals []uint64) (dist float64) {
+	for dim := 0; dim < len(point.Vals); dim++ {
+		dist += m.bkd.dimDist(dim, point.Vals[dim], lowVals[dim], highVals[dim])
+	}
+	return
+}
+
+//bindMetric binds built-in metrics to the tree, so that they measure native values of dimensions which aren't DimUint.
+func (bkd *BkdTree) bindMetric(metric Metric) Metric {
+	native := true
+	for _, t := range bkd.dimTypes {
+		native = native && t == DimUint
+	}
+	if native {
+		return metric
+	}
+	switch metric.(type) {
+	case euclideanMetric:
+		metric = euclideanMetric{bkd}
+	case manhattanMetric:
+		metric = manhattanMetric{bkd}
+	}
+	return metric
+}
+
+//dimDist returns the distance between native values of val and range [low, high] of the given dimension.
+//A nil tree treats the dimension as DimUint.
+func (bkd *BkdTree) dimDist(dim int, val, low, high uint64) float64 {
+	if bkd == nil || bkd.dimTypes[dim] == DimUint {
+		return float64(distToRange(val, low, high))
+	}
+	v, l, h := bkd.nativeValue(dim, val), bkd.nativeValue(dim, low), bkd.nativeValue(dim, high)
+	if v < l {
+		return l - v
+	} else if v > h {
+		return v - h
+	}
+	return 0
+}
+
+//nativeValue decodes the value of the given dimension as float64. Encoded values beyond infinities, which are bounds
+//of cells only, are decoded as infinities.
+func (bkd *BkdTree) nativeValue(dim int, u uint64) (f float64) {
+	switch bkd.dimTypes[dim] {
+	case DimInt:
+		f = float64(DecodeInt(u, bkd.dimWidth(dim)))
+	case DimFloat32:
+		if f = float64(DecodeFloat32(u)); math.IsNaN(f) {
+			f = math.Inf(int(u>>31&1)*2 - 1)
+		}
+	case DimFloat64:
+		if f = DecodeFloat64(u); math.IsNaN(f) {
+			f = math.Inf(int(u>>63)*2 - 1)
+		}
+	default:
+		f = float64(u)
+	}
+	return
+}
+
+//distToRange returns the distance between val and range [low, high].
+func distToRange(val, low, high uint64) uint64 {
+	if val < low {
+		return low - val
+	} else if val > high {
+		return val - high
+	}
+	return 0
+}
+
+//nearestItem is either a point, a leaf or an intra node. A leaf or an intra node is located by (store, nodeOffset).
+type nearestItem struct {
+	dist       float64
+	isPoint    bool
+	point      Point
+	isLeaf     bool
+	numPoints  int
+	leafSize   int //the stored size of the leaf
+	store      storage
+	meta       *KdTreeExtMeta
+	nodeOffset int
+	lowVals    []uint64 //the cell of the leaf or the intra node
+	highVals   []uint64
+}
+
+type nearestQueue []*nearestItem
+
+func (q nearestQueue) Len() int            { return len(q) }
+func (q nearestQueue) Less(i, j int) bool  { return q[i].dist < q[j].dist }
+func (q nearestQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *nearestQueue) Push(x interface{}) { *q = append(*q, x.(*nearestItem)) }
+func (q *nearestQueue) Pop() (x interface{}) {
+	old := *q
+	n := len(old)
+	x = old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return
+}
+
+//Nearest returns the k points closest to query, ordered by distance. It does best-first search over T0M and all subtrees.
+func (bkd *BkdTree) Nearest(query Point, k int, metric Metric) (neighbors []Neighbor, err error) {
+	snap, err := bkd.snapshot("(*BkdTree).Nearest")
+	if err != nil {
+		return
+	}
+	defer snap.Release()
+	neighbors, err = snap.Nearest(query, k, metric)
+	return
+}
+
+//nearest does best-first search without locking. It's invoked on the view of a snapshot.
+func (bkd *BkdTree) nearest(query Point, k int, metric Metric) (neighbors []Neighbor, err error) {
+	if k <= 0 {
+		err = newInvalidArgument("k", k)
+		return
+	} else if metric == nil {
+		err = newInvalidArgument("metric", metric)
+		return
+	} else if len(query.Vals) != bkd.NumDims {
+		err = newDimensionMismatch("query", len(query.Vals), bkd.NumDims)
+		return
+	}
+	metric = bkd.bindMetric(metric)
+
+	q := &nearestQueue{}
+	pae := PointArrayExt{
+		data:        bkd.t0m.data,
+		numPoints:   int(bkd.t0m.meta.NumPoints),
+		byDim:       0, //not used
+		bytesPerDim: bkd.BytesPerDim,
+		dimBytes:    bkd.dimBytes,
+		numDims:     bkd.NumDims,
+		pointSize:   bkd.pointSize,
+	}
+	for i := 0; i < pae.numPoints; i++ {
+		point := pae.GetPoint(i)
+		heap.Push(q, &nearestItem{dist: metric.Distance(query, point), isPoint: true, point: point})
+	}
+	for i := 0; i < len(bkd.trees); i++ {
+		if bkd.trees[i].meta.NumPoints <= 0 {
+			continue
+		}
+		item := &nearestItem{
+			store:      bkd.trees[i].store,
+			meta:       &bkd.trees[i].meta,
+			nodeOffset: int(bkd.trees[i].meta.RootOff),
+			lowVals:    make([]uint64, bkd.NumDims),
+			highVals:   make([]uint64, bkd.NumDims),
+		}
+		for dim := 0; dim < bkd.NumDims; dim++ {
+			item.highVals[dim] = bkd.maxValue(dim)
+		}
+		heap.Push(q, item)
+	}
+
+	buf := bkd.newLeafBuf()
+	seen := make(erasedSeen)
+	for q.Len() > 0 && len(neighbors) < k {
+		item := heap.Pop(q).(*nearestItem)
+		if item.isPoint {
+			neighbors = append(neighbors, Neighbor{Point: item.point, Distance: item.dist})
+		} else if item.isLeaf {
+			leaf := KdTreeExtNodeInfo{Offset: uint64(item.nodeOffset), NumPoints: uint64(item.numPoints)}
+			if pae, err = bkd.readLeaf(item.store, item.meta, buf, leaf, item.leafSize); err != nil {
+				return
+			}
+			for i := 0; i < pae.numPoints; i++ {
+				if bkd.isErased(item.meta, &pae, i, seen) {
+					continue
+				}
+				point := pae.GetPoint(i)
+				heap.Push(q, &nearestItem{dist: metric.Distance(query, point), isPoint: true, point: point})
+			}
+		} else if err = bkd.nearestNode(query, metric, q, item); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//nearestNode pushes children of the given intra node into the queue.
+func (bkd *BkdTree) nearestNode(query Point, metric Metric, q *nearestQueue, item *nearestItem) (err error) {
+	node, err := readIntraNode(item.store, item.meta, item.nodeOffset)
+	if err != nil {
+		return
+	}
+	numDims := bkd.NumDims
+	for i, child := range node.Children {
+		if child.NumPoints <= 0 {
+			continue
+		}
+		var lowVals, highVals []uint64
+		if len(node.LowVals) != 0 {
+			//the bounding box is tighter than the cell derived from split values
+			lowVals = node.LowVals[i*numDims : (i+1)*numDims]
+			highVals = node.HighVals[i*numDims : (i+1)*numDims]
+		} else {
+			lowVals = make([]uint64, numDims)
+			highVals = make([]uint64, numDims)
+			copy(lowVals, item.lowVals)
+			copy(highVals, item.highVals)
+			if i != 0 {
+				lowVals[node.SplitDim] = node.SplitValues[i-1]
+			}
+			if i < int(node.NumStrips)-1 {
+				highVals[node.SplitDim] = node.SplitValues[i]
+			}
+		}
+		childItem := &nearestItem{
+			dist:       metric.MinDistance(query, lowVals, highVals),
+			isLeaf:     child.Offset < item.meta.PointsOffEnd,
+			numPoints:  int(child.NumPoints),
+			leafSize:   bkd.leafSize(&node, i),
+			store:      item.store,
+			meta:       item.meta,
+			nodeOffset: int(child.Offset),
+			lowVals:    lowVals,
+			highVals:   highVals,
+		}
+		heap.Push(q, childItem)
+	}
+	return
+}
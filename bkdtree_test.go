@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
+	"sort"
 	"testing"
 	"time"
 
@@ -106,7 +108,7 @@ func TestBkdInsert(t *testing.T) {
 	}
 }
 
-func prepareBkdTree(maxVal uint64) (bkd *BkdTree, points []Point, err error) {
+func prepareBkdTree(maxVal uint64, opts ...Option) (bkd *BkdTree, points []Point, err error) {
 	t0mCap := 1000
 	treesCap := 5
 	bkdCap := t0mCap<<uint(treesCap) - 1
@@ -116,7 +118,7 @@ func prepareBkdTree(maxVal uint64) (bkd *BkdTree, points []Point, err error) {
 	bytesPerDim := 4
 	dir := "/tmp"
 	prefix := "bkd"
-	bkd, err = NewBkdTree(t0mCap, leafCap, intraCap, numDims, bytesPerDim, dir, prefix)
+	bkd, err = NewBkdTree(t0mCap, leafCap, intraCap, numDims, bytesPerDim, dir, prefix, opts...)
 	if err != nil {
 		return
 	}
@@ -168,8 +170,8 @@ func TestBkdIntersect(t *testing.T) {
 	}
 
 	//all intersect
-	lowPoint = Point{[]uint64{0, 0, 0}, 0}
-	highPoint = Point{[]uint64{maxVal, maxVal, maxVal}, 0}
+	lowPoint = Point{[]uint64{0, 0}, 0}
+	highPoint = Point{[]uint64{maxVal, maxVal}, 0}
 	visitor = &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
 	err = bkd.Intersect(visitor)
 	if err != nil {
@@ -325,8 +327,9 @@ func TestBkdOpenClose(t *testing.T) {
 	//Compare two structs recursively and record the difference.
 	//TODO: How to ignore specific fields effciently?
 	bkd2.t0m.data, bkd.t0m.data = make([]byte, 0), make([]byte, 0)
+	bkd2.t0m.store, bkd.t0m.store = nil, nil
 	for i := 0; i < len(bkd.trees); i++ {
-		bkd2.trees[i].data, bkd.trees[i].data = make([]byte, 0), make([]byte, 0)
+		bkd2.trees[i].store, bkd.trees[i].store = nil, nil
 	}
 	isEqual, err := checkers.DeepEqual(bkd, bkd2)
 	if !isEqual {
@@ -429,9 +432,12 @@ FOR_LOOP:
 		default:
 		}
 		idx := rand.Intn(len(points))
-		//TODO: custom error type
-		_, _ = bkd.Erase(points[idx])
-		_ = bkd.Insert(points[idx])
+		if _, err := bkd.Erase(points[idx]); err != nil && !errors.Is(err, ErrClosed) {
+			panic(err)
+		}
+		if err := bkd.Insert(points[idx]); err != nil && !errors.Is(err, ErrClosed) {
+			panic(err)
+		}
 	}
 }
 
@@ -447,8 +453,9 @@ FOR_LOOP:
 		idx1 := rand.Intn(len(points))
 		idx2 := rand.Intn(len(points))
 		visitor := &IntersectCollector{points[idx1], points[idx2], make([]Point, 0)}
-		//TODO: custom error type
-		_ = bkd.Intersect(visitor)
+		if err := bkd.Intersect(visitor); err != nil && !errors.Is(err, ErrClosed) {
+			panic(err)
+		}
 	}
 }
 
@@ -477,3 +484,2445 @@ func TestBkdConcurrentOps(t *testing.T) {
 	time.Sleep(1 * time.Second)
 	fmt.Println("children shall all have quited")
 }
+
+func TestBkdNearest(t *testing.T) {
+	var maxVal uint64 = 1000
+	bkd, points, err := prepareBkdTree(maxVal)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	k := 20
+	for _, metric := range []Metric{Euclidean, Manhattan} {
+		query := NewRandPoints(bkd.NumDims, maxVal, 1)[0]
+		neighbors, err := bkd.Nearest(query, k, metric)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		} else if len(neighbors) != k {
+			t.Fatalf("found %d neighbors, want %d", len(neighbors), k)
+		}
+		//verify against brute force
+		dists := make([]float64, 0, len(points))
+		for _, point := range points {
+			dists = append(dists, metric.Distance(query, point))
+		}
+		sort.Float64s(dists)
+		for i, neighbor := range neighbors {
+			if neighbor.Distance != dists[i] {
+				t.Fatalf("neighbor %d distance is %v, want %v", i, neighbor.Distance, dists[i])
+			} else if metric.Distance(query, neighbor.Point) != neighbor.Distance {
+				t.Fatalf("neighbor %d distance is incorrect", i)
+			}
+		}
+	}
+}
+
+func TestBkdNearestNative(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	bkd, err := NewBkdTree(100, 50, 4, 2, 8, dir, prefix, WithDimTypes(DimInt, DimFloat64))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	newPoint := func(i int64, f float64) Point {
+		point, err := bkd.NewPoint(uint64(i), i, f)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		return point
+	}
+	//distances are measured on native values, into subtrees as well
+	var points []Point
+	for i := int64(0); i < 300; i++ {
+		point := newPoint(i-150, float64(i)*0.1-15)
+		points = append(points, point)
+		if err = bkd.Insert(point); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	query := newPoint(-3, 0.44)
+	for _, metric := range []Metric{Euclidean, Manhattan} {
+		neighbors, err := bkd.Nearest(query, 3, metric)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		dists := make([]float64, 0, len(points))
+		for _, point := range points {
+			var dist float64
+			for dim, u := range point.Vals {
+				delta := bkd.nativeValue(dim, u) - bkd.nativeValue(dim, query.Vals[dim])
+				if metric == Euclidean {
+					dist += delta * delta
+				} else {
+					dist += math.Abs(delta)
+				}
+			}
+			if metric == Euclidean {
+				dist = math.Sqrt(dist)
+			}
+			dists = append(dists, dist)
+		}
+		sort.Float64s(dists)
+		for i, neighbor := range neighbors {
+			if math.Abs(neighbor.Distance-dists[i]) > 1e-9 {
+				t.Fatalf("neighbor %d distance is %v, want %v", i, neighbor.Distance, dists[i])
+			}
+		}
+	}
+	if err = bkd.Destroy(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if bkd, err = NewBkdTree(100, 50, 4, 1, 8, dir, prefix, WithDimTypes(DimFloat64)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, f := range []float64{1.0, 15.0} {
+		point, _ := bkd.NewPoint(0, f)
+		if err = bkd.Insert(point); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	point, _ := bkd.NewPoint(0, 4.0)
+	neighbors, err := bkd.Nearest(point, 1, Euclidean)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	} else if len(neighbors) != 1 || DecodeFloat64(neighbors[0].Point.Vals[0]) != 1.0 || neighbors[0].Distance != 3.0 {
+		t.Fatalf("got neighbors %+v, want 1.0 at distance 3", neighbors)
+	}
+}
+
+type abortVisitor struct {
+	IntersectCollector
+	err error
+}
+
+func (v *abortVisitor) VisitPointExt(point Point) error {
+	v.VisitPoint(point)
+	return v.err
+}
+
+func TestBkdIntersectExt(t *testing.T) {
+	var maxVal uint64 = 1000
+	bkd, points, err := prepareBkdTree(maxVal)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	lowPoint := Point{[]uint64{0, 0}, 0}
+	highPoint := Point{[]uint64{maxVal, maxVal}, 0}
+
+	//stop after limit matches
+	limit := 100
+	collector := &IntersectLimitCollector{LowPoint: lowPoint, HighPoint: highPoint, Limit: limit}
+	if err = bkd.IntersectExt(collector); err != nil {
+		t.Fatalf("%+v", err)
+	} else if len(collector.Points) != limit {
+		t.Fatalf("found %d matchs, want %d", len(collector.Points), limit)
+	}
+	limit = len(points) + 1
+	collector = &IntersectLimitCollector{LowPoint: lowPoint, HighPoint: highPoint, Limit: limit}
+	if err = bkd.IntersectExt(collector); err != nil {
+		t.Fatalf("%+v", err)
+	} else if len(collector.Points) != len(points) {
+		t.Fatalf("found %d matchs, want %d", len(collector.Points), len(points))
+	}
+
+	//abort at the first match
+	errAbort := errors.New("abort")
+	visitor := &abortVisitor{IntersectCollector{lowPoint, highPoint, make([]Point, 0)}, errAbort}
+	if err = bkd.IntersectExt(visitor); errors.Cause(err) != errAbort {
+		t.Fatalf("got error %v, want %v", err, errAbort)
+	} else if len(visitor.Points) != 1 {
+		t.Fatalf("visited %d points, want 1", len(visitor.Points))
+	}
+}
+
+type cellVisitor struct {
+	IntersectCollector
+	rel Relation
+}
+
+func (v *cellVisitor) Compare(lowVals, highVals []uint64) Relation {
+	return v.rel
+}
+
+func TestBkdIntersectCell(t *testing.T) {
+	var maxVal uint64 = 1000
+	bkd, points, err := prepareBkdTree(maxVal)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	//bounding boxes of children are persisted
+	for i := 0; i < len(bkd.trees); i++ {
+		meta := &bkd.trees[i].meta
+		node, err := readIntraNode(bkd.trees[i].store, meta, int(meta.RootOff))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		} else if len(node.LowVals) != int(node.NumStrips)*bkd.NumDims || len(node.HighVals) != len(node.LowVals) {
+			t.Fatalf("bkd.trees[%d] root node has %d bounds, want %d", i, len(node.LowVals), int(node.NumStrips)*bkd.NumDims)
+		}
+	}
+
+	//the default relation is computed against the query box
+	lowPoint := Point{[]uint64{100, 200}, 0}
+	highPoint := Point{[]uint64{700, 900}, 0}
+	visitor := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = bkd.Intersect(visitor); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var want int
+	for _, point := range points {
+		if point.Inside(lowPoint, highPoint) {
+			want++
+		}
+	}
+	if len(visitor.Points) != want {
+		t.Fatalf("found %d matchs, want %d", len(visitor.Points), want)
+	}
+
+	//cells inside the query are accepted without checking points, cells outside the query are skipped
+	numT0M := int(bkd.t0m.meta.NumPoints)
+	lowPoint = Point{[]uint64{0, 0}, 0}
+	highPoint = Point{[]uint64{maxVal, maxVal}, 0}
+	cv := &cellVisitor{IntersectCollector{lowPoint, highPoint, make([]Point, 0)}, CellOutsideQuery}
+	if err = bkd.Intersect(cv); err != nil {
+		t.Fatalf("%+v", err)
+	} else if len(cv.Points) != numT0M {
+		t.Fatalf("found %d matchs, want %d", len(cv.Points), numT0M)
+	}
+	highPoint = lowPoint
+	cv = &cellVisitor{IntersectCollector{lowPoint, highPoint, make([]Point, 0)}, CellInsideQuery}
+	if err = bkd.Intersect(cv); err != nil {
+		t.Fatalf("%+v", err)
+	} else if len(cv.Points) < len(points)-numT0M {
+		t.Fatalf("found %d matchs, want at least %d", len(cv.Points), len(points)-numT0M)
+	}
+}
+
+func TestBkdCount(t *testing.T) {
+	var maxVal uint64 = 1000
+	bkd, points, err := prepareBkdTree(maxVal)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 10; i++ {
+		lowPoint := NewRandPoints(bkd.NumDims, maxVal/2, 1)[0]
+		highPoint := NewRandPoints(bkd.NumDims, maxVal/2, 1)[0]
+		for dim := 0; dim < bkd.NumDims; dim++ {
+			highPoint.Vals[dim] += lowPoint.Vals[dim]
+		}
+		var want int
+		for _, point := range points {
+			if point.Inside(lowPoint, highPoint) {
+				want++
+			}
+		}
+		cnt, err := bkd.Count(lowPoint, highPoint)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		} else if cnt != want {
+			t.Fatalf("count of [%v, %v] is %d, want %d", lowPoint, highPoint, cnt, want)
+		}
+	}
+}
+
+func TestBkdIterator(t *testing.T) {
+	var maxVal uint64 = 1000
+	bkd, points, err := prepareBkdTree(maxVal)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	lowPoint := Point{[]uint64{100, 200}, 0}
+	highPoint := Point{[]uint64{700, 900}, 0}
+	visitor := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = bkd.Intersect(visitor); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	it, err := bkd.NewIterator(lowPoint, highPoint)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var iterated []Point
+	for it.Next() {
+		iterated = append(iterated, it.Point())
+	}
+	if err = it.Err(); err != nil {
+		t.Fatalf("%+v", err)
+	} else if err = it.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	} else if !areSmaePoints(iterated, visitor.Points, bkd.NumDims) {
+		t.Fatalf("iterated %d points, want %d", len(iterated), len(visitor.Points))
+	}
+
+	//stop iteration at middle way, the tree is writable after Close
+	it, err = bkd.NewIterator(Point{[]uint64{0, 0}, 0}, Point{[]uint64{maxVal, maxVal}, 0})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if !it.Next() {
+			t.Fatalf("iterator ends unexpectedly, err: %+v", it.Err())
+		}
+	}
+	if err = it.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	} else if it.Next() {
+		t.Fatalf("iterator is still valid after Close")
+	}
+	if _, err = bkd.Erase(points[0]); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestBkdInsertBatch(t *testing.T) {
+	t0mCap := 1000
+	leafCap := 50
+	intraCap := 4
+	numDims := 2
+	bytesPerDim := 4
+	dir := "/tmp"
+	prefix := "bkd"
+	bkd, err := NewBkdTree(t0mCap, leafCap, intraCap, numDims, bytesPerDim, dir, prefix)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	maxVal := uint64(1000)
+	points := NewRandPoints(numDims, maxVal, 40000)
+	batchSizes := []int{10, 500, 489, 1, 3000, 7, 20000, 999, 15000 - 7}
+	var begin int
+	for _, size := range batchSizes {
+		if err = bkd.InsertBatch(points[begin : begin+size]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		begin += size
+		if bkd.NumPoints != begin {
+			t.Fatalf("incorrect numPoints. numPoints=%v, want %v", bkd.NumPoints, begin)
+		} else if int(bkd.t0m.meta.NumPoints) >= bkd.t0mCap {
+			t.Fatalf("bkd.t0m %d is full", bkd.t0m.meta.NumPoints)
+		}
+		for i := 0; i < len(bkd.trees); i++ {
+			if int(bkd.trees[i].meta.NumPoints) > bkd.t0mCap<<uint(i) {
+				t.Fatalf("bkd.trees[%d].numPoints %d exceeds capacity", i, bkd.trees[i].meta.NumPoints)
+			}
+		}
+		if err = verifyBkdMeta(bkd); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	visitor := &IntersectCollector{Point{[]uint64{0, 0}, 0}, Point{[]uint64{maxVal, maxVal}, 0}, make([]Point, 0)}
+	if err = bkd.Intersect(visitor); err != nil {
+		t.Fatalf("%+v", err)
+	} else if !areSmaePoints(visitor.Points, points[:begin], numDims) {
+		t.Fatalf("found %d points, want %d", len(visitor.Points), begin)
+	}
+}
+
+type sliceIterator struct {
+	points []Point
+	idx    int
+}
+
+func (it *sliceIterator) Next() bool   { it.idx++; return it.idx <= len(it.points) }
+func (it *sliceIterator) Point() Point { return it.points[it.idx-1] }
+func (it *sliceIterator) Err() error   { return nil }
+
+func TestBuildBkdTree(t *testing.T) {
+	params := BkdParams{T0mCap: 1000, LeafCap: 50, IntraCap: 4, NumDims: 2, BytesPerDim: 4}
+	maxVal := uint64(1000)
+	size := 5500
+	points := NewRandPoints(params.NumDims, maxVal, size)
+	bkd, err := BuildBkdTree("/tmp", "bkd", params, &sliceIterator{points: points})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	} else if bkd.NumPoints != size {
+		t.Fatalf("incorrect numPoints. numPoints=%v, want %v", bkd.NumPoints, size)
+	} else if len(bkd.trees) != 4 || int(bkd.trees[3].meta.NumPoints) != size {
+		t.Fatalf("points shall be bulk-loaded into trees[3]")
+	} else if err = verifyBkdMeta(bkd); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	lowPoint := Point{[]uint64{0, 0}, 0}
+	highPoint := Point{[]uint64{maxVal, maxVal}, 0}
+	visitor := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = bkd.Intersect(visitor); err != nil {
+		t.Fatalf("%+v", err)
+	} else if !areSmaePoints(visitor.Points, points, params.NumDims) {
+		t.Fatalf("found %d points, want %d", len(visitor.Points), size)
+	}
+
+	//build from another tree
+	it, err := bkd.NewIterator(lowPoint, highPoint)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bkd2, err := BuildBkdTree("/tmp", "bkd2", params, it)
+	it.Close()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	} else if bkd2.NumPoints != size {
+		t.Fatalf("incorrect numPoints. numPoints=%v, want %v", bkd2.NumPoints, size)
+	} else if err = bkd2.Destroy(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestBkdStoragePread(t *testing.T) {
+	var maxVal uint64 = 1000
+	bkd, points, err := prepareBkdTree(maxVal, WithStorage(StoragePread))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; i < len(bkd.trees); i++ {
+		if _, ok := bkd.trees[i].store.(*preadStorage); !ok {
+			t.Fatalf("bkd.trees[%d] is not accessed via pread", i)
+		}
+	}
+	lowPoint := Point{[]uint64{100, 200}, 0}
+	highPoint := Point{[]uint64{700, 900}, 0}
+	var want []Point
+	for _, point := range points {
+		if point.Inside(lowPoint, highPoint) {
+			want = append(want, point)
+		}
+	}
+	visitor := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = bkd.Intersect(visitor); err != nil {
+		t.Fatalf("%+v", err)
+	} else if !areSmaePoints(visitor.Points, want, bkd.NumDims) {
+		t.Fatalf("found %d matchs, want %d", len(visitor.Points), len(want))
+	}
+	if cnt, err := bkd.Count(lowPoint, highPoint); err != nil {
+		t.Fatalf("%+v", err)
+	} else if cnt != len(want) {
+		t.Fatalf("count is %d, want %d", cnt, len(want))
+	}
+
+	//erase points of T0M and trees, then reopen
+	for _, i := range []int{0, len(points) - 1} {
+		if found, err := bkd.Erase(points[i]); err != nil {
+			t.Fatalf("%+v", err)
+		} else if !found {
+			t.Fatalf("point %v not found", points[i])
+		}
+	}
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bkd2, err := NewBkdTreeExt(bkd.dir, bkd.prefix, WithStorage(StoragePread))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	} else if err = verifyBkdMeta(bkd2); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, i := range []int{0, len(points) - 1} {
+		if cnt, err := countPoint(bkd2, points[i]); err != nil {
+			t.Fatalf("%+v", err)
+		} else if cnt != 0 {
+			t.Fatalf("point %v still exists", points[i])
+		}
+	}
+	//trigger a compaction
+	for i := 0; i < bkd2.t0mCap; i++ {
+		if err = bkd2.Insert(points[0]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if bkd2.NumPoints != len(points)-2+bkd2.t0mCap {
+		t.Fatalf("incorrect numPoints. numPoints=%v, want %v", bkd2.NumPoints, len(points)-2+bkd2.t0mCap)
+	} else if err = verifyBkdMeta(bkd2); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if cnt, err := countPoint(bkd2, points[0]); err != nil {
+		t.Fatalf("%+v", err)
+	} else if cnt != bkd2.t0mCap {
+		t.Fatalf("point %v found %d times, want %d", points[0], cnt, bkd2.t0mCap)
+	}
+}
+
+func TestBkdErrors(t *testing.T) {
+	var err error
+	var argErr *InvalidArgumentError
+	_, err = NewBkdTree(1000, 50, 4, 2, 3, "/tmp", "bkd")
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	} else if !errors.As(err, &argErr) || argErr.Field != "bytesPerDim" || argErr.Value != 3 {
+		t.Fatalf("got error %v, want offending bytesPerDim", err)
+	}
+
+	var maxVal uint64 = 1000
+	bkd, points, err := prepareBkdTree(maxVal)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.Open(); !errors.Is(err, ErrAlreadyOpen) {
+		t.Fatalf("got error %v, want %v", err, ErrAlreadyOpen)
+	}
+	if _, err = bkd.Nearest(Point{[]uint64{1, 2, 3}, 0}, 1, Euclidean); !errors.Is(err, ErrDimensionMismatch) {
+		t.Fatalf("got error %v, want %v", err, ErrDimensionMismatch)
+	}
+	if _, err = bkd.Nearest(points[0], 0, Euclidean); !errors.As(err, &argErr) || argErr.Field != "k" {
+		t.Fatalf("got error %v, want offending k", err)
+	}
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.Insert(points[0]); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got error %v, want %v", err, ErrClosed)
+	}
+	visitor := &IntersectCollector{points[0], points[0], make([]Point, 0)}
+	if err = bkd.Intersect(visitor); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got error %v, want %v", err, ErrClosed)
+	}
+
+	//truncate a file
+	if err = os.Truncate(bkd.TiPath(len(bkd.trees)-1), 0); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.Open(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("got error %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestBkdValidate(t *testing.T) {
+	t0mCap := 1000
+	leafCap := 50
+	intraCap := 4
+	numDims := 2
+	bytesPerDim := 2
+	dir := "/tmp"
+	prefix := "bkd"
+	bkd, err := NewBkdTree(t0mCap, leafCap, intraCap, numDims, bytesPerDim, dir, prefix)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	var maxVal uint64 = math.MaxUint16
+	points := NewRandPoints(numDims, maxVal, 3*t0mCap)
+	if err = bkd.InsertBatch(points); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var argErr *InvalidArgumentError
+	if err = bkd.Insert(Point{[]uint64{1}, 0}); !errors.Is(err, ErrDimensionMismatch) {
+		t.Fatalf("got error %v, want %v", err, ErrDimensionMismatch)
+	}
+	if err = bkd.Insert(Point{[]uint64{1, maxVal + 1}, 0}); !errors.As(err, &argErr) || argErr.Field != "point.Vals[1]" {
+		t.Fatalf("got error %v, want offending point.Vals[1]", err)
+	}
+	if err = bkd.InsertBatch([]Point{points[0], {[]uint64{1, 2, 3}, 0}}); !errors.Is(err, ErrDimensionMismatch) {
+		t.Fatalf("got error %v, want %v", err, ErrDimensionMismatch)
+	}
+	if _, err = bkd.Erase(Point{[]uint64{maxVal + 1, 1}, 0}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+	if bkd.NumPoints != len(points) {
+		t.Fatalf("bkd.NumPoints %d, want %d", bkd.NumPoints, len(points))
+	}
+
+	lowPoint := Point{[]uint64{0, 0}, 0}
+	highPoint := Point{[]uint64{math.MaxUint64, math.MaxUint64}, 0}
+	visitor := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = bkd.Intersect(visitor); !errors.As(err, &argErr) || argErr.Field != "highPoint.Vals[0]" {
+		t.Fatalf("got error %v, want offending highPoint.Vals[0]", err)
+	}
+	visitor.HighPoint = Point{[]uint64{maxVal}, 0}
+	if err = bkd.Intersect(visitor); !errors.Is(err, ErrDimensionMismatch) {
+		t.Fatalf("got error %v, want %v", err, ErrDimensionMismatch)
+	}
+
+	//clamping
+	WithQueryClamp()(bkd)
+	visitor = &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = bkd.Intersect(visitor); err != nil {
+		t.Fatalf("%+v", err)
+	} else if len(visitor.Points) != len(points) {
+		t.Fatalf("found %d matchs, want %d", len(visitor.Points), len(points))
+	}
+	cnt, err := bkd.Count(lowPoint, highPoint)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	} else if cnt != len(points) {
+		t.Fatalf("count %d, want %d", cnt, len(points))
+	}
+	lowPoint = Point{[]uint64{maxVal + 1, 0}, 0}
+	if cnt, err = bkd.Count(lowPoint, highPoint); err != nil {
+		t.Fatalf("%+v", err)
+	} else if cnt != 0 {
+		t.Fatalf("count %d, want 0", cnt)
+	}
+	visitor.Points = nil
+	visitor.HighPoint = Point{[]uint64{maxVal}, 0}
+	if err = bkd.Intersect(visitor); !errors.Is(err, ErrDimensionMismatch) {
+		t.Fatalf("got error %v, want %v", err, ErrDimensionMismatch)
+	}
+}
+
+func TestBkdDurabilitySync(t *testing.T) {
+	for _, kind := range []StorageKind{StorageMmap, StoragePread} {
+		var maxVal uint64 = 1000
+		bkd, points, err := prepareBkdTree(maxVal, WithDurability(DurabilitySync), WithStorage(kind))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, err = bkd.Erase(points[0]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, err = bkd.Erase(points[len(points)-1]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Close(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Open(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if bkd.NumPoints != len(points)-2 {
+			t.Fatalf("bkd.NumPoints %d, want %d", bkd.NumPoints, len(points)-2)
+		}
+		matches, err := FilepathGlob(bkd.dir, "^bkd_t[0-9]+\\.tmp$")
+		if err != nil {
+			t.Fatalf("%+v", err)
+		} else if len(matches) != 0 {
+			t.Fatalf("stale files %v", matches)
+		}
+		if err = bkd.Destroy(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+}
+
+func copyFile(src, dst string) (err error) {
+	var data []byte
+	if data, err = os.ReadFile(src); err != nil {
+		return
+	}
+	err = os.WriteFile(dst, data, 0600)
+	return
+}
+
+func TestBkdRecover(t *testing.T) {
+	t0mCap := 1000
+	leafCap := 50
+	intraCap := 4
+	numDims := 2
+	bytesPerDim := 4
+	dir := "/tmp"
+	prefix := "bkd"
+	bkd, err := NewBkdTree(t0mCap, leafCap, intraCap, numDims, bytesPerDim, dir, prefix)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	var maxVal uint64 = 1000
+	points := NewRandPoints(numDims, maxVal, 2*t0mCap)
+	//T0 holds t0mCap points, T0M holds t0mCap-1 points
+	for _, point := range points[:len(points)-1] {
+		if err = bkd.Insert(point); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, fp := range []string{bkd.T0mPath(), bkd.TiPath(0)} {
+		if err = copyFile(fp, fp+".bak"); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	//compact T0M and T0 into T1
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.Insert(points[len(points)-1]); err != nil {
+		t.Fatalf("%+v", err)
+	} else if bkd.trees[1].meta.NumPoints != uint64(len(points)) {
+		t.Fatalf("T1 has %d points, want %d", bkd.trees[1].meta.NumPoints, len(points))
+	}
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	//simulate a crash after renaming T1 and before clearing T0M and removing T0
+	for _, fp := range []string{bkd.T0mPath(), bkd.TiPath(0)} {
+		if err = os.Rename(fp+".bak", fp); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	//simulate a crash before renaming the temp file
+	if err = os.WriteFile(bkd.TiPath(2)+".tmp", []byte("partial"), 0600); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	//stale files are detected by generation even if the manifest is absent
+	if err = os.Remove(bkd.ManifestPath()); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if bkd.NumPoints != len(points) {
+		t.Fatalf("bkd.NumPoints %d, want %d", bkd.NumPoints, len(points))
+	} else if bkd.t0m.meta.NumPoints != 0 {
+		t.Fatalf("T0M has %d points, want 0", bkd.t0m.meta.NumPoints)
+	}
+	for _, fp := range []string{bkd.TiPath(0), bkd.TiPath(2) + ".tmp"} {
+		if _, err = os.Stat(fp); !os.IsNotExist(err) {
+			t.Fatalf("stale file %s is not removed, %v", fp, err)
+		}
+	}
+	lowPoint := Point{[]uint64{0, 0}, 0}
+	highPoint := Point{[]uint64{maxVal, maxVal}, 0}
+	visitor := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = bkd.Intersect(visitor); err != nil {
+		t.Fatalf("%+v", err)
+	} else if !areSmaePoints(visitor.Points, points, numDims) {
+		t.Fatalf("point set mismatch")
+	}
+}
+
+func TestBkdManifest(t *testing.T) {
+	var maxVal uint64 = 1000
+	bkd, points, err := prepareBkdTree(maxVal)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkManifest := func() {
+		var manifest Manifest
+		if err = FileUnmarshal(bkd.ManifestPath(), &manifest); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if manifest.Version != ManifestVersion {
+			t.Fatalf("manifest version %d, want %d", manifest.Version, ManifestVersion)
+		} else if manifest.Params.NumDims != bkd.NumDims || manifest.Params.T0mCap != bkd.t0mCap {
+			t.Fatalf("manifest params %+v mismatch", manifest.Params)
+		}
+		var numPoints uint64
+		for _, s := range manifest.Subtrees {
+			f, err := os.Open(bkd.TiPath(s.Level))
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			checksum, err := fileChecksum(f)
+			f.Close()
+			if err != nil {
+				t.Fatalf("%+v", err)
+			} else if checksum != s.Checksum {
+				t.Fatalf("subtree %+v checksum mismatch, got %d", s, checksum)
+			}
+			numPoints += s.NumPoints
+		}
+		if int(numPoints) != len(points)-int(bkd.t0m.meta.NumPoints) {
+			t.Fatalf("manifest has %d points, want %d", numPoints, len(points)-int(bkd.t0m.meta.NumPoints))
+		}
+	}
+	checkManifest()
+
+	//a stray file is ignored
+	stray := bkd.TiPath(len(bkd.trees) + 3)
+	if err = copyFile(bkd.TiPath(len(bkd.trees)-1), stray); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.Remove(stray)
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	} else if bkd.NumPoints != len(points) {
+		t.Fatalf("bkd.NumPoints %d, want %d", bkd.NumPoints, len(points))
+	}
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	//the manifest is rebuilt for files created without a manifest
+	if err = os.Remove(stray); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = os.Remove(bkd.ManifestPath()); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkManifest()
+}
+
+func TestBkdVerify(t *testing.T) {
+	for _, kind := range []StorageKind{StorageMmap, StoragePread} {
+		var maxVal uint64 = 1000
+		bkd, points, err := prepareBkdTree(maxVal, WithStorage(kind))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Verify(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		//erasing keeps checksums up to date
+		for i := 0; i < len(points); i += 97 {
+			if _, err = bkd.Erase(points[i]); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		if err = bkd.Verify(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Close(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		//flip a byte of the first leaf
+		fp := bkd.TiPath(len(bkd.trees) - 1)
+		data, err := os.ReadFile(fp)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		data[0] ^= 0xff
+		if err = os.WriteFile(fp, data, 0600); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Open(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Verify(); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("got error %v, want %v", err, ErrCorrupt)
+		}
+		if err = bkd.Close(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		//flip a byte of the root node
+		data[0] ^= 0xff
+		var meta KdTreeExtMeta
+		if err = binary.Read(bytes.NewReader(data[len(data)-KdTreeExtMetaSize:]), binary.BigEndian, &meta); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		data[meta.RootOff+8] ^= 0xff
+		if err = os.WriteFile(fp, data, 0600); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Open(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		visitor := &IntersectCollector{points[0], points[0], make([]Point, 0)}
+		if err = bkd.Intersect(visitor); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("got error %v, want %v", err, ErrCorrupt)
+		}
+		if err = bkd.Close(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		//flip a byte of the meta
+		data[meta.RootOff+8] ^= 0xff
+		data[len(data)-KdTreeExtMetaSize] ^= 0xff
+		if err = os.WriteFile(fp, data, 0600); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Open(); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("got error %v, want %v", err, ErrCorrupt)
+		}
+		data[len(data)-KdTreeExtMetaSize] ^= 0xff
+		if err = os.WriteFile(fp, data, 0600); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Open(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Verify(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Destroy(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+}
+
+func TestBkdDimTypes(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	_, err := NewBkdTree(1000, 50, 4, 2, 4, dir, prefix, WithDimTypes(DimInt, DimFloat64))
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+	bkd, err := NewBkdTree(100, 50, 4, 3, 8, dir, prefix, WithDimTypes(DimInt, DimFloat64, DimFloat32))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+
+	var points []Point
+	for i := 0; i < 1000; i++ {
+		point, err := bkd.NewPoint(uint64(i), int64(i-500), float64(i)/10-50, float32(i%10)-5)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		points = append(points, point)
+	}
+	if err = bkd.InsertBatch(points); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = bkd.NewPoint(0, 1, 1.0, float32(1)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+	if _, err = bkd.NewPoint(0, int64(1), math.NaN(), float32(1)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+
+	//types survive reopening
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bkd.dimTypes = nil
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	types := bkd.DimTypes()
+	if len(types) != 3 || types[0] != DimInt || types[1] != DimFloat64 || types[2] != DimFloat32 {
+		t.Fatalf("got dim types %v", types)
+	}
+
+	//-100 <= x <= -50, -45.5 <= y <= 0, -1 <= z <= 1
+	lowPoint, err := bkd.NewPoint(0, int64(-100), -45.5, float32(-1))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	highPoint, err := bkd.NewPoint(0, int64(-50), 0.0, float32(1))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	visitor := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = bkd.Intersect(visitor); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var want int
+	for i := 0; i < 1000; i++ {
+		x, y, z := int64(i-500), float64(i)/10-50, float32(i%10)-5
+		if x >= -100 && x <= -50 && y >= -45.5 && y <= 0 && z >= -1 && z <= 1 {
+			want++
+		}
+	}
+	if len(visitor.Points) != want {
+		t.Fatalf("found %d matchs, want %d", len(visitor.Points), want)
+	}
+	for _, point := range visitor.Points {
+		vals := bkd.PointValues(point)
+		x, y, z := vals[0].(int64), vals[1].(float64), vals[2].(float32)
+		if x != int64(point.UserData)-500 || y != float64(point.UserData)/10-50 || z != float32(point.UserData%10)-5 {
+			t.Fatalf("point %d has values %v", point.UserData, vals)
+		}
+	}
+}
+
+func TestBkdDimBytes(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	_, err := NewBkdTree(1000, 50, 4, 3, 8, dir, prefix, WithDimBytes(8, 1))
+	if !errors.Is(err, ErrDimensionMismatch) {
+		t.Fatalf("got error %v, want %v", err, ErrDimensionMismatch)
+	}
+	_, err = NewBkdTree(1000, 50, 4, 3, 8, dir, prefix, WithDimBytes(8, 0, 1))
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+	//a timestamp, a 1 byte category and a 3 bytes signed value
+	bkd, err := NewBkdTree(100, 50, 4, 3, 8, dir, prefix, WithDimBytes(8, 1, 3), WithDimTypes(DimUint, DimUint, DimInt))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	if bkd.pointSize != 8+1+3+8 {
+		t.Fatalf("got point size %d", bkd.pointSize)
+	}
+	if err = bkd.Insert(Point{[]uint64{0, 256, 0}, 0}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+
+	var points []Point
+	for i := 0; i < 1000; i++ {
+		point, err := bkd.NewPoint(uint64(i), uint64(1500000000000+i), uint64(i%7), int64(i-500))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		points = append(points, point)
+	}
+	if err = bkd.InsertBatch(points); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = bkd.NewPoint(0, uint64(0), uint64(0), int64(1)<<23); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+
+	//widths survive reopening
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bkd.dimBytes = nil
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(bkd.dimBytes) != 3 || bkd.dimBytes[0] != 8 || bkd.dimBytes[1] != 1 || bkd.dimBytes[2] != 3 {
+		t.Fatalf("got dim widths %v", bkd.dimBytes)
+	}
+	if err = bkd.Verify(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	//category 3, -100 <= z <= 100
+	lowPoint, err := bkd.NewPoint(0, uint64(0), uint64(3), int64(-100))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	highPoint, err := bkd.NewPoint(0, ^uint64(0), uint64(3), int64(100))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	visitor := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = bkd.Intersect(visitor); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var want int
+	for i := 0; i < 1000; i++ {
+		if i%7 == 3 && i-500 >= -100 && i-500 <= 100 {
+			want++
+		}
+	}
+	if len(visitor.Points) != want {
+		t.Fatalf("found %d matchs, want %d", len(visitor.Points), want)
+	}
+	for _, point := range visitor.Points {
+		if !point.Equal(points[point.UserData]) {
+			t.Fatalf("got point %v, want %v", point, points[point.UserData])
+		}
+	}
+}
+
+func TestBkdPayload(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	bkd, err := NewBkdTree(100, 50, 4, 2, 4, dir, prefix)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.InsertWithPayload(Point{[]uint64{1, 1}, 1}, []byte("x")); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+	if err = bkd.Destroy(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for _, kind := range []StorageKind{StorageMmap, StoragePread} {
+		bkd, err = NewBkdTree(100, 50, 4, 2, 4, dir, prefix, WithVarPayload(16), WithStorage(kind))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.InsertWithPayload(Point{[]uint64{1, 1}, 1}, make([]byte, 17)); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+		}
+		//points of odd UserData carry no payload
+		payloadOf := func(userData uint64) []byte {
+			if userData%2 == 1 {
+				return nil
+			}
+			return []byte(fmt.Sprintf("payload-%d", userData))
+		}
+		for i := 0; i < 1000; i++ {
+			point := Point{[]uint64{uint64(i), uint64(i % 10)}, uint64(i)}
+			if err = bkd.InsertWithPayload(point, payloadOf(uint64(i))); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		//erase points from both T0M and trees, which moves payloads of T0M
+		for i := 0; i < 1000; i += 3 {
+			if _, err = bkd.Erase(Point{[]uint64{uint64(i), uint64(i % 10)}, uint64(i)}); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		for round := 0; round < 2; round++ {
+			visitor := &PayloadCollector{LowPoint: Point{[]uint64{0, 0}, 0}, HighPoint: Point{[]uint64{1000, 9}, 0}}
+			if err = bkd.Intersect(visitor); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if len(visitor.Points) != 1000-334 {
+				t.Fatalf("found %d matchs, want %d", len(visitor.Points), 1000-334)
+			}
+			for i, point := range visitor.Points {
+				if want := payloadOf(point.UserData); !bytes.Equal(visitor.Payloads[i], want) {
+					t.Fatalf("point %v has payload %q, want %q", point, visitor.Payloads[i], want)
+				}
+			}
+			if err = bkd.Verify(); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			//payloads survive reopening
+			if err = bkd.Close(); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			bkd.payloadMaxLen = 0
+			if err = bkd.Open(); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		if err = bkd.Destroy(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	bkd, err = NewBkdTree(100, 50, 4, 2, 4, dir, prefix, WithFixedPayload(8))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	if err = bkd.InsertWithPayload(Point{[]uint64{1, 1}, 1}, []byte("short")); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+	var points []Point
+	for i := 0; i < 150; i++ {
+		points = append(points, Point{[]uint64{uint64(i), uint64(i)}, uint64(i)})
+	}
+	//points inserted without payload carry zero payloads
+	if err = bkd.InsertBatch(points); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	payload := []byte("12345678")
+	if err = bkd.InsertWithPayload(Point{[]uint64{7, 7}, 1000}, payload); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	visitor := &PayloadCollector{LowPoint: Point{[]uint64{7, 7}, 0}, HighPoint: Point{[]uint64{7, 7}, 0}}
+	if err = bkd.Intersect(visitor); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(visitor.Points) != 2 {
+		t.Fatalf("found %d matchs, want 2", len(visitor.Points))
+	}
+	for i, point := range visitor.Points {
+		want := make([]byte, 8)
+		if point.UserData == 1000 {
+			want = payload
+		}
+		if !bytes.Equal(visitor.Payloads[i], want) {
+			t.Fatalf("point %v has payload %q, want %q", point, visitor.Payloads[i], want)
+		}
+	}
+	//visitors unaware of payloads work as before
+	collector := &IntersectCollector{Point{[]uint64{7, 7}, 0}, Point{[]uint64{7, 7}, 0}, make([]Point, 0)}
+	if err = bkd.Intersect(collector); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(collector.Points) != 2 {
+		t.Fatalf("found %d matchs, want 2", len(collector.Points))
+	}
+}
+
+func TestBkdLeafCodec(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	_, err := NewBkdTree(100, 50, 4, 2, 4, dir, prefix, WithLeafCodec(LeafCodecPrefix+1))
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+
+	//leaves round trip, including tiny ones which are stored as raw points
+	bkd, err := NewBkdTree(100, 50, 4, 3, 8, dir, prefix, WithDimBytes(8, 1, 3), WithVarPayload(8), WithLeafCodec(LeafCodecPrefix))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for _, numPoints := range []int{0, 1, 2, 50} {
+		leaf := PointArrayExt{
+			data:        make([]byte, numPoints*bkd.pointSize),
+			bytesPerDim: bkd.BytesPerDim,
+			dimBytes:    bkd.dimBytes,
+			numDims:     bkd.NumDims,
+			pointSize:   bkd.pointSize,
+		}
+		for i := 0; i < numPoints; i++ {
+			leaf.Append(Point{[]uint64{1500000000000 + uint64(rnd.Intn(1000)), uint64(rnd.Intn(256)), uint64(rnd.Intn(1 << 24))}, uint64(rnd.Int63())})
+			ref := uint64(0)
+			if i%2 == 0 {
+				ref = uint64(4096 + 12*i)
+			}
+			bkd.setPayloadRef(&leaf, i, ref)
+			leaf.numPoints++
+		}
+		data := bkd.encodeLeaf(&leaf, 4096)
+		if len(data) > len(leaf.data) {
+			t.Fatalf("leaf of %d points is encoded into %d bytes, exceeds %d", numPoints, len(data), len(leaf.data))
+		}
+		pae, err := bkd.decodeLeaf(data, numPoints, 4096, nil)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if !bytes.Equal(pae.data, leaf.data) {
+			t.Fatalf("leaf of %d points is decoded as %v, want %v", numPoints, pae.data, leaf.data)
+		}
+	}
+	if err = bkd.Destroy(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for _, kind := range []StorageKind{StorageMmap, StoragePread} {
+		var sizes []int64
+		var trees []*BkdTree
+		for _, codec := range []LeafCodec{LeafCodecNone, LeafCodecPrefix} {
+			bkd, err := NewBkdTree(100, 50, 4, 2, 8, dir, fmt.Sprintf("%s%d", prefix, codec), WithVarPayload(16), WithStorage(kind), WithLeafCodec(codec))
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			defer bkd.Destroy()
+			for i := 0; i < 1600; i++ {
+				point := Point{[]uint64{uint64(1000000 + i), uint64(i % 100)}, uint64(i)}
+				if err = bkd.InsertWithPayload(point, []byte(fmt.Sprintf("p%d", i))); err != nil {
+					t.Fatalf("%+v", err)
+				}
+			}
+			for i := 0; i < 1600; i += 7 {
+				var found bool
+				if found, err = bkd.Erase(Point{[]uint64{uint64(1000000 + i), uint64(i % 100)}, uint64(i)}); err != nil {
+					t.Fatalf("%+v", err)
+				} else if !found {
+					t.Fatalf("point %d is not found", i)
+				}
+			}
+			if err = bkd.Verify(); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			info, err := os.Stat(bkd.TiPath(4))
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			sizes = append(sizes, info.Size())
+			trees = append(trees, bkd)
+		}
+		if sizes[1] >= sizes[0]/2 {
+			t.Fatalf("encoded tree is of %d bytes, raw one is of %d bytes", sizes[1], sizes[0])
+		}
+
+		//both trees answer the same
+		lowPoint := Point{[]uint64{1000100, 10}, 0}
+		highPoint := Point{[]uint64{1001200, 60}, 0}
+		var results [][]Point
+		for _, bkd := range trees {
+			visitor := &PayloadCollector{LowPoint: lowPoint, HighPoint: highPoint}
+			if err = bkd.Intersect(visitor); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			for i, point := range visitor.Points {
+				if want := fmt.Sprintf("p%d", point.UserData); string(visitor.Payloads[i]) != want {
+					t.Fatalf("point %v has payload %q, want %q", point, visitor.Payloads[i], want)
+				}
+			}
+			cnt, err := bkd.Count(lowPoint, highPoint)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			} else if cnt != len(visitor.Points) {
+				t.Fatalf("counted %d points, want %d", cnt, len(visitor.Points))
+			}
+			it, err := bkd.NewIterator(lowPoint, highPoint)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			var iterated []Point
+			for it.Next() {
+				iterated = append(iterated, it.Point())
+			}
+			if err = it.Err(); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			it.Close()
+			if !areSmaePoints(iterated, visitor.Points, bkd.NumDims) {
+				t.Fatalf("iterated %d points, want %d", len(iterated), len(visitor.Points))
+			}
+			neighbors, err := bkd.Nearest(Point{[]uint64{1000500, 0}, 0}, 3, Manhattan)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			} else if len(neighbors) != 3 || neighbors[0].Point.UserData != 500 {
+				t.Fatalf("got neighbors %v", neighbors)
+			}
+			results = append(results, visitor.Points)
+		}
+		if len(results[0]) == 0 || !areSmaePoints(results[0], results[1], 2) {
+			t.Fatalf("found %d and %d points", len(results[0]), len(results[1]))
+		}
+
+		//the codec survives reopening
+		bkd := trees[1]
+		if err = bkd.Close(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		bkd.leafCodec = LeafCodecNone
+		if err = bkd.Open(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if bkd.leafCodec != LeafCodecPrefix {
+			t.Fatalf("got leaf codec %v", bkd.leafCodec)
+		}
+		if err = bkd.Verify(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+}
+
+func TestBkdTombstone(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	bkd, err := NewBkdTree(100, 50, 4, 2, 4, dir, prefix, WithVarPayload(16), WithTombstones())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	pointOf := func(i int) Point {
+		return Point{[]uint64{uint64(i), uint64(i % 10)}, uint64(i)}
+	}
+	for i := 0; i < 1050; i++ {
+		if err = bkd.InsertWithPayload(pointOf(i), []byte(fmt.Sprintf("payload-%d", i))); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	checksums := make(map[string]uint32)
+	for _, tree := range bkd.trees {
+		if tree.store == nil {
+			continue
+		}
+		var checksum uint32
+		if checksum, err = fileChecksum(tree.f); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		checksums[tree.f.Name()] = checksum
+	}
+	if len(checksums) == 0 {
+		t.Fatalf("no subtree has been created")
+	}
+
+	//erase points from both T0M and trees
+	var found bool
+	numErased := 0
+	for i := 0; i < 1050; i += 3 {
+		if found, err = bkd.Erase(pointOf(i)); err != nil {
+			t.Fatalf("%+v", err)
+		} else if !found {
+			t.Fatalf("point %v not found", pointOf(i))
+		}
+		numErased++
+	}
+	if found, err = bkd.Erase(pointOf(3)); err != nil {
+		t.Fatalf("%+v", err)
+	} else if found {
+		t.Fatalf("point %v is erased twice", pointOf(3))
+	}
+	for fp, want := range checksums {
+		var f *os.File
+		if f, err = os.Open(fp); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		checksum, err := fileChecksum(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%+v", err)
+		} else if checksum != want {
+			t.Fatalf("%s checksum %d, want %d", fp, checksum, want)
+		}
+	}
+
+	lowPoint, highPoint := Point{[]uint64{0, 0}, 0}, Point{[]uint64{1050, 9}, 0}
+	numOutside := 0 //points outside the query
+	check := func(want int) {
+		if bkd.NumPoints != want+numOutside {
+			t.Fatalf("NumPoints %d, want %d", bkd.NumPoints, want+numOutside)
+		}
+		visitor := &PayloadCollector{LowPoint: lowPoint, HighPoint: highPoint}
+		if err = bkd.Intersect(visitor); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if len(visitor.Points) != want {
+			t.Fatalf("found %d matchs, want %d", len(visitor.Points), want)
+		}
+		for i, point := range visitor.Points {
+			if point.UserData%3 == 0 && point.UserData != 3 {
+				t.Fatalf("erased point %v is visited", point)
+			}
+			if want := fmt.Sprintf("payload-%d", point.UserData); string(visitor.Payloads[i]) != want {
+				t.Fatalf("point %v has payload %q, want %q", point, visitor.Payloads[i], want)
+			}
+		}
+		var cnt int
+		if cnt, err = bkd.Count(lowPoint, highPoint); err != nil {
+			t.Fatalf("%+v", err)
+		} else if cnt != want {
+			t.Fatalf("counted %d, want %d", cnt, want)
+		}
+		it, err := bkd.NewIterator(lowPoint, highPoint)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		cnt = 0
+		for it.Next() {
+			cnt++
+		}
+		if err = it.Err(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		it.Close()
+		if cnt != want {
+			t.Fatalf("iterated %d, want %d", cnt, want)
+		}
+		if err = bkd.Verify(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	check(1050 - numErased)
+
+	//tombstones survive reopening, and are honored without WithTombstones
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bkd.tombstoneErase = false
+	bkd.payloadMaxLen = 0
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check(1050 - numErased)
+	if found, err = bkd.Erase(pointOf(6)); err != nil {
+		t.Fatalf("%+v", err)
+	} else if found {
+		t.Fatalf("point %v is erased twice", pointOf(6))
+	}
+	//a re-inserted point isn't hidden by its tombstone
+	if err = bkd.InsertWithPayload(pointOf(3), []byte("payload-3")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check(1050 - numErased + 1)
+
+	//a compaction absorbing all trees applies all tombstones
+	var points []Point
+	for i := 2000; i < 3500; i++ {
+		points = append(points, Point{[]uint64{uint64(i), uint64(i % 10)}, uint64(i)})
+	}
+	if err = bkd.InsertBatch(points); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	numOutside = len(points)
+	if len(bkd.tombstones) != 0 {
+		t.Fatalf("%d tombstones are left", len(bkd.tombstones))
+	}
+	if _, err = os.Stat(bkd.TombstonesPath()); !os.IsNotExist(err) {
+		t.Fatalf("got error %v, want not exist", err)
+	}
+	check(1050 - numErased + 1)
+
+	//a tombstone erases one copy of a duplicated point
+	if err = bkd.Destroy(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if bkd, err = NewBkdTree(100, 50, 4, 2, 4, dir, prefix, WithTombstones()); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	dup := Point{[]uint64{5, 5}, 7}
+	points = []Point{dup, dup}
+	for i := 10; i < 108; i++ {
+		points = append(points, Point{[]uint64{uint64(i), uint64(i)}, uint64(i)})
+	}
+	points = append(points, dup)
+	for _, point := range points {
+		if err = bkd.Insert(point); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	checkDup := func(want int) {
+		visitor := &IntersectCollector{dup, dup, make([]Point, 0)}
+		if err = bkd.Intersect(visitor); err != nil {
+			t.Fatalf("%+v", err)
+		} else if len(visitor.Points) != want {
+			t.Fatalf("found %d copies, want %d", len(visitor.Points), want)
+		}
+		var cnt int
+		if cnt, err = bkd.Count(dup, dup); err != nil {
+			t.Fatalf("%+v", err)
+		} else if cnt != want {
+			t.Fatalf("counted %d copies, want %d", cnt, want)
+		}
+		it, err := bkd.NewIterator(Point{[]uint64{0, 0}, 0}, Point{[]uint64{1000, 1000}, 0})
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		cnt = 0
+		var cntDup int
+		for it.Next() {
+			if point := it.Point(); point.Equal(dup) {
+				cntDup++
+			}
+			cnt++
+		}
+		if err = it.Err(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		it.Close()
+		if cntDup != want || cnt != bkd.NumPoints {
+			t.Fatalf("iterated %d copies of %d points, want %d of %d", cntDup, cnt, want, bkd.NumPoints)
+		}
+		if err = bkd.Verify(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	checkDup(3)
+	//the copy in T0M goes first, then copies in T0
+	for i := 0; i < 2; i++ {
+		if found, err = bkd.Erase(dup); err != nil {
+			t.Fatalf("%+v", err)
+		} else if !found {
+			t.Fatalf("point %v not found", dup)
+		}
+	}
+	if len(bkd.trees) != 1 || bkd.numTombstones(bkd.trees[0].meta.Generation) != 1 {
+		t.Fatalf("a tombstone of T0 shall have been recorded")
+	}
+	checkDup(1)
+	//the compaction absorbing T0 keeps the copy left
+	for i := 200; i < 300; i++ {
+		if err = bkd.Insert(Point{[]uint64{uint64(i), uint64(i)}, uint64(i)}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if len(bkd.tombstones) != 0 || bkd.NumPoints != 199 {
+		t.Fatalf("%d tombstones are left, NumPoints %d, want %d", len(bkd.tombstones), bkd.NumPoints, 199)
+	}
+	checkDup(1)
+	if found, err = bkd.Erase(dup); err != nil || !found {
+		t.Fatalf("point %v not found, got error %v", dup, err)
+	}
+	if found, err = bkd.Erase(dup); err != nil || found {
+		t.Fatalf("point %v is erased more than its copies, got error %v", dup, err)
+	}
+	checkDup(0)
+	if err = bkd.Destroy(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestBkdEraseRange(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	for _, opts := range [][]Option{
+		nil,
+		{WithLeafCodec(LeafCodecPrefix), WithVarPayload(16)},
+		{WithTombstones()},
+		{WithLeafCodec(LeafCodecPrefix), WithTombstones()},
+	} {
+		bkd, err := NewBkdTree(100, 50, 4, 2, 4, dir, prefix, opts...)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		var points []Point
+		for i := 0; i < 2050; i++ {
+			points = append(points, Point{[]uint64{uint64(i), uint64(i % 10)}, uint64(i)})
+		}
+		if err = bkd.InsertBatch(points[:2000]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		//the rest stay in T0M
+		if err = bkd.InsertBatch(points[2000:]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		//the last erasure erases nothing, and the others erase points from both T0M and trees
+		erasures := []struct {
+			lowPoint, highPoint Point
+			want                int
+		}{
+			{Point{[]uint64{500, 0}, 0}, Point{[]uint64{1499, 9}, 0}, 1000},
+			{Point{[]uint64{0, 0}, 0}, Point{[]uint64{3000, 0}, 0}, 105},
+			{Point{[]uint64{2040, 5}, 0}, Point{[]uint64{2049, 9}, 0}, 5},
+			{Point{[]uint64{500, 0}, 0}, Point{[]uint64{1499, 9}, 0}, 0},
+		}
+		numPoints := len(points)
+		for _, e := range erasures {
+			var n int
+			if n, err = bkd.EraseRange(e.lowPoint, e.highPoint); err != nil {
+				t.Fatalf("%+v", err)
+			} else if n != e.want {
+				t.Fatalf("erased %d points inside [%v, %v], want %d", n, e.lowPoint, e.highPoint, e.want)
+			}
+			numPoints -= n
+		}
+		check := func() {
+			if bkd.NumPoints != numPoints {
+				t.Fatalf("NumPoints %d, want %d", bkd.NumPoints, numPoints)
+			}
+			lowPoint, highPoint := Point{[]uint64{0, 0}, 0}, Point{[]uint64{3000, 9}, 0}
+			visitor := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+			if err = bkd.Intersect(visitor); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if len(visitor.Points) != numPoints {
+				t.Fatalf("found %d matchs, want %d", len(visitor.Points), numPoints)
+			}
+			for _, point := range visitor.Points {
+				for _, e := range erasures {
+					if point.Inside(e.lowPoint, e.highPoint) {
+						t.Fatalf("erased point %v is visited", point)
+					}
+				}
+			}
+			var cnt int
+			if cnt, err = bkd.Count(lowPoint, highPoint); err != nil {
+				t.Fatalf("%+v", err)
+			} else if cnt != numPoints {
+				t.Fatalf("counted %d, want %d", cnt, numPoints)
+			}
+			if err = bkd.Verify(); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		check()
+		//the next compaction drops erased points
+		if err = bkd.InsertBatch(points[2000:]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		numPoints += len(points[2000:])
+		if err = bkd.Compact(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		//40 points of them have survived erasures, and are duplicated
+		var n int
+		if n, err = bkd.EraseRange(Point{[]uint64{2000, 0}, 0}, Point{[]uint64{2049, 9}, 0}); err != nil {
+			t.Fatalf("%+v", err)
+		} else if n != 90 {
+			t.Fatalf("erased %d points, want 90", n)
+		}
+		numPoints -= n
+		check()
+		if err = bkd.Destroy(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	//points erased by tombstones aren't counted again when erased in place
+	bkd, err := NewBkdTree(100, 50, 4, 2, 4, dir, prefix, WithTombstones())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	for i := 0; i < 1000; i++ {
+		if err = bkd.Insert(Point{[]uint64{uint64(i), uint64(i % 10)}, uint64(i)}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if _, err = bkd.Erase(Point{[]uint64{100, 0}, 100}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bkd.tombstoneErase = false
+	var n int
+	if n, err = bkd.EraseRange(Point{[]uint64{0, 0}, 0}, Point{[]uint64{199, 9}, 0}); err != nil {
+		t.Fatalf("%+v", err)
+	} else if n != 199 {
+		t.Fatalf("erased %d points, want 199", n)
+	}
+	if bkd.NumPoints != 800 {
+		t.Fatalf("NumPoints %d, want 800", bkd.NumPoints)
+	}
+	if len(bkd.tombstones) != 0 {
+		t.Fatalf("%d tombstones are left", len(bkd.tombstones))
+	}
+	if err = bkd.Verify(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestBkdUserDataIndex(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	bkd, err := NewBkdTree(100, 50, 4, 2, 4, dir, prefix)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, _, err = bkd.GetByUserData(1); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+	if err = bkd.Destroy(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	pointOf := func(i int) Point {
+		return Point{[]uint64{uint64(i * 7 % 1050), uint64(i % 10)}, uint64(i)}
+	}
+	for _, opts := range [][]Option{
+		{WithUserDataIndex()},
+		{WithUserDataIndex(), WithTombstones(), WithVarPayload(16)},
+	} {
+		bkd, err = NewBkdTree(100, 50, 4, 2, 4, dir, prefix, opts...)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		for i := 0; i < 1050; i++ {
+			if err = bkd.Insert(pointOf(i)); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		check := func(erased func(i int) bool) {
+			for i := 0; i < 1050; i++ {
+				point, found, err := bkd.GetByUserData(uint64(i))
+				if err != nil {
+					t.Fatalf("%+v", err)
+				} else if found == erased(i) {
+					t.Fatalf("point of UserData %d found %v, want %v", i, found, !erased(i))
+				} else if found && !point.Equal(pointOf(i)) {
+					t.Fatalf("got point %v, want %v", point, pointOf(i))
+				}
+			}
+			if err = bkd.Verify(); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		check(func(i int) bool { return false })
+		//indexes of merged trees are built along with them, and renamed on installing
+		for k := range bkd.trees {
+			if _, err = os.Stat(bkd.UserDataIndexPath(k) + ".tmp"); !os.IsNotExist(err) {
+				t.Fatalf("got error %v, want not exist", err)
+			}
+		}
+
+		//erase points from both T0M and trees, by UserData and by coordinates
+		var found bool
+		for i := 0; i < 1050; i += 3 {
+			if found, err = bkd.EraseByUserData(uint64(i)); err != nil {
+				t.Fatalf("%+v", err)
+			} else if !found {
+				t.Fatalf("point of UserData %d not found", i)
+			}
+		}
+		if _, err = bkd.Erase(pointOf(1)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if found, err = bkd.EraseByUserData(3); err != nil {
+			t.Fatalf("%+v", err)
+		} else if found {
+			t.Fatalf("point of UserData 3 is erased twice")
+		}
+		erased := func(i int) bool { return i%3 == 0 || i == 1 }
+		if bkd.NumPoints != 1050-351 {
+			t.Fatalf("NumPoints %d, want %d", bkd.NumPoints, 1050-351)
+		}
+		check(erased)
+
+		//a missing index is rebuilt at Open
+		if err = bkd.Close(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = os.Remove(bkd.UserDataIndexPath(len(bkd.trees) - 1)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		bkd.payloadMaxLen = 0
+		if err = bkd.Open(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		check(erased)
+
+		//indexes follow compactions
+		for i := 1050; i < 1250; i++ {
+			if err = bkd.Insert(pointOf(i)); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		for i := 0; i < 1250; i++ {
+			point, found, err := bkd.GetByUserData(uint64(i))
+			if err != nil {
+				t.Fatalf("%+v", err)
+			} else if found == (i < 1050 && erased(i)) {
+				t.Fatalf("point of UserData %d found %v", i, found)
+			} else if found && !point.Equal(pointOf(i)) {
+				t.Fatalf("got point %v, want %v", point, pointOf(i))
+			}
+		}
+		if err = bkd.Verify(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = bkd.Destroy(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if matches, err := FilepathGlob(dir, fmt.Sprintf("^%s_t[0-9]+\\.uidx$", prefix)); err != nil {
+			t.Fatalf("%+v", err)
+		} else if len(matches) != 0 {
+			t.Fatalf("indexes %v are left", matches)
+		}
+	}
+}
+
+func TestBkdUpdate(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	bkd, err := NewBkdTree(100, 50, 4, 2, 4, dir, prefix, WithVarPayload(16), WithUserDataIndex())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	for i := 0; i < 1050; i++ {
+		point := Point{[]uint64{uint64(i), uint64(i % 10)}, uint64(i)}
+		if err = bkd.InsertWithPayload(point, []byte(fmt.Sprintf("payload-%d", i))); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	//lookup returns payloads of points of the given UserData
+	lookup := func(userData uint64) (points []Point, payloads [][]byte) {
+		visitor := &PayloadCollector{LowPoint: Point{[]uint64{0, 0}, 0}, HighPoint: Point{[]uint64{5000, 9}, 0}}
+		if err = bkd.Intersect(visitor); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		for i, point := range visitor.Points {
+			if point.UserData == userData {
+				points = append(points, point)
+				payloads = append(payloads, visitor.Payloads[i])
+			}
+		}
+		return
+	}
+	check := func(oldPoint, newPoint Point) {
+		points, payloads := lookup(newPoint.UserData)
+		if len(points) != 1 || !points[0].Equal(newPoint) {
+			t.Fatalf("got points %v, want %v", points, newPoint)
+		} else if want := fmt.Sprintf("payload-%d", oldPoint.UserData); string(payloads[0]) != want {
+			t.Fatalf("got payload %q, want %q", payloads[0], want)
+		}
+		if oldPoint.UserData != newPoint.UserData {
+			if points, _ = lookup(oldPoint.UserData); len(points) != 0 {
+				t.Fatalf("old points %v are left", points)
+			}
+		}
+		if point, found, err := bkd.GetByUserData(newPoint.UserData); err != nil {
+			t.Fatalf("%+v", err)
+		} else if !found || !point.Equal(newPoint) {
+			t.Fatalf("got point %v, want %v", point, newPoint)
+		}
+		if bkd.NumPoints != 1050 {
+			t.Fatalf("NumPoints %d, want 1050", bkd.NumPoints)
+		}
+		if err = bkd.Verify(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	//points of T0M and trees
+	for _, i := range []int{1040, 5} {
+		oldPoint := Point{[]uint64{uint64(i), uint64(i % 10)}, uint64(i)}
+		newPoint := Point{[]uint64{uint64(i + 3000), 9}, uint64(i)}
+		var found bool
+		if found, err = bkd.Update(oldPoint, newPoint); err != nil {
+			t.Fatalf("%+v", err)
+		} else if !found {
+			t.Fatalf("point %v not found", oldPoint)
+		}
+		check(oldPoint, newPoint)
+		if found, err = bkd.Update(oldPoint, newPoint); err != nil {
+			t.Fatalf("%+v", err)
+		} else if found {
+			t.Fatalf("point %v is updated twice", oldPoint)
+		}
+	}
+	if _, err = bkd.Update(Point{[]uint64{1, 1}, 1}, Point{[]uint64{1, 1 << 40}, 1}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+
+	//a crash after the journal has been written, and after the old point has been erased
+	for _, i := range []int{10, 20} {
+		oldPoint := Point{[]uint64{uint64(i), uint64(i % 10)}, uint64(i)}
+		newPoint := Point{[]uint64{uint64(i + 3000), 9}, uint64(i + 10000)}
+		f, err := bkd.writeJournal([]batchOp{{erase: true, point: oldPoint}, {point: newPoint, payload: []byte(fmt.Sprintf("payload-%d", i))}})
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if i == 20 {
+			if err = bkd.writeProgress(f, 0, false); err != nil {
+				t.Fatalf("%+v", err)
+			} else if _, err = bkd.erase(oldPoint); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		f.Close()
+		if err = bkd.Close(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		bkd.payloadMaxLen = 0
+		if err = bkd.Open(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, err = os.Stat(bkd.JournalPath()); !os.IsNotExist(err) {
+			t.Fatalf("got error %v, want not exist", err)
+		}
+		check(oldPoint, newPoint)
+	}
+
+	//a torn journal is dropped
+	oldPoint := Point{[]uint64{30, 0}, 30}
+	f, err := bkd.writeJournal([]batchOp{{erase: true, point: oldPoint}, {point: Point{[]uint64{3030, 9}, 30}}})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.Close()
+	if err = os.Truncate(bkd.JournalPath(), 10); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bkd.payloadMaxLen = 0
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check(oldPoint, oldPoint)
+}
+
+func TestBkdWriteBatch(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	bkd, err := NewBkdTree(100, 50, 4, 2, 4, dir, prefix, WithVarPayload(16))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	pointOf := func(i int) Point {
+		return Point{[]uint64{uint64(i), uint64(i % 10)}, uint64(i)}
+	}
+	payloadOf := func(i int) []byte {
+		return []byte(fmt.Sprintf("payload-%d", i))
+	}
+	//T0M is almost full, so the batch triggers a compaction
+	for i := 0; i < 195; i++ {
+		if err = bkd.InsertWithPayload(pointOf(i), payloadOf(i)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	live := make(map[int]bool)
+	for i := 0; i < 195; i++ {
+		live[i] = true
+	}
+	check := func() {
+		visitor := &PayloadCollector{LowPoint: Point{[]uint64{0, 0}, 0}, HighPoint: Point{[]uint64{5000, 9}, 0}}
+		if err = bkd.Intersect(visitor); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if len(visitor.Points) != len(live) || bkd.NumPoints != len(live) {
+			t.Fatalf("found %d matchs, NumPoints %d, want %d", len(visitor.Points), bkd.NumPoints, len(live))
+		}
+		for j, point := range visitor.Points {
+			i := int(point.UserData)
+			if !live[i] || !point.Equal(pointOf(i)) {
+				t.Fatalf("point %v shall not be there", point)
+			} else if !bytes.Equal(visitor.Payloads[j], payloadOf(i)) {
+				t.Fatalf("point %v has payload %q, want %q", point, visitor.Payloads[j], payloadOf(i))
+			}
+		}
+		if err = bkd.Verify(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	var batch WriteBatch
+	for i := 1000; i < 1020; i++ {
+		batch.InsertWithPayload(pointOf(i), payloadOf(i))
+		live[i] = true
+	}
+	//erase points from both T0M and trees
+	for i := 0; i < 195; i += 20 {
+		batch.Erase(pointOf(i))
+		delete(live, i)
+	}
+	batch.Erase(pointOf(3000)) //not there
+	batch.InsertWithPayload(pointOf(2000), payloadOf(2000))
+	batch.Erase(pointOf(2000))
+	if err = bkd.Apply(&batch); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check()
+
+	//invalid batches change nothing
+	batch.Reset()
+	batch.Erase(pointOf(1))
+	batch.InsertWithPayload(pointOf(1), make([]byte, 17))
+	if err = bkd.Apply(&batch); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+	check()
+
+	//an insert of a point which is there adds another copy, the same as Insert
+	batch.Reset()
+	batch.InsertWithPayload(pointOf(2), payloadOf(2))
+	batch.InsertWithPayload(pointOf(2), payloadOf(2))
+	batch.Erase(pointOf(2))
+	if err = bkd.Apply(&batch); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var cnt int
+	if cnt, err = bkd.Count(pointOf(2), pointOf(2)); err != nil {
+		t.Fatalf("%+v", err)
+	} else if cnt != 2 {
+		t.Fatalf("count %d, want %d", cnt, 2)
+	}
+	batch.Reset()
+	batch.Erase(pointOf(2))
+	if err = bkd.Apply(&batch); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check()
+
+	//a crash after some operations have been applied
+	batch.Reset()
+	for i := 1; i < 195; i += 20 {
+		batch.Erase(pointOf(i))
+		delete(live, i)
+	}
+	for i := 3000; i < 3150; i++ {
+		batch.InsertWithPayload(pointOf(i), payloadOf(i))
+		live[i] = true
+	}
+	ops := bkd.resolveBatch(&batch)
+	f, err := bkd.writeJournal(ops)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = bkd.applyOps(f, ops[:len(ops)/2], 0, false); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	//the operation after the last recorded one has taken effect as well
+	if err = bkd.writeProgress(f, len(ops)/2, false); err != nil {
+		t.Fatalf("%+v", err)
+	} else if err = bkd.insert(ops[len(ops)/2].point, ops[len(ops)/2].payload); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.Close()
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bkd.payloadMaxLen = 0
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check()
+
+	//a crash while undoing completes the batch from the operation undone
+	ops = []batchOp{{erase: true, point: pointOf(5)}, {point: pointOf(3500), payload: payloadOf(3500)}}
+	if f, err = bkd.writeJournal(ops); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	done, err := bkd.applyOps(f, ops, 0, true)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	} else if len(done) != 2 || !bytes.Equal(done[0].payload, payloadOf(5)) {
+		t.Fatalf("got done operations %v", done)
+	}
+	if err = bkd.writeProgress(f, 1, true); err != nil {
+		t.Fatalf("%+v", err)
+	} else if _, err = bkd.erase(pointOf(3500)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.Close()
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bkd.payloadMaxLen = 0
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	delete(live, 5)
+	live[3500] = true
+	check()
+
+	//a batch failing halfway is undone, including erases from T0M and trees
+	var tmpPaths []string
+	for k := 0; k <= len(bkd.trees); k++ {
+		tmpPath := bkd.TiPath(k) + ".tmp"
+		if err = os.Mkdir(tmpPath, 0700); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		defer os.RemoveAll(tmpPath)
+		tmpPaths = append(tmpPaths, tmpPath)
+	}
+	batch.Reset()
+	batch.Erase(pointOf(4))
+	batch.Erase(pointOf(3149))
+	for i := 4000; i < 4100; i++ {
+		batch.InsertWithPayload(pointOf(i), payloadOf(i))
+	}
+	if err = bkd.Apply(&batch); err == nil {
+		t.Fatalf("the compaction shall have failed")
+	}
+	if _, err = os.Stat(bkd.JournalPath()); !os.IsNotExist(err) {
+		t.Fatalf("got error %v, want not exist", err)
+	}
+	check()
+	for _, tmpPath := range tmpPaths {
+		if err = os.Remove(tmpPath); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = bkd.Apply(&batch); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	delete(live, 4)
+	delete(live, 3149)
+	for i := 4000; i < 4100; i++ {
+		live[i] = true
+	}
+	check()
+}
+
+func TestBkdSnapshot(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	bkd, err := NewBkdTree(100, 50, 4, 2, 4, dir, prefix)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	lowPoint := Point{[]uint64{0, 0}, 0}
+	highPoint := Point{[]uint64{1000, 1000}, 0}
+	for i := 0; i < 150; i++ {
+		if err = bkd.Insert(Point{[]uint64{uint64(i), uint64(i)}, uint64(i)}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	snap, err := bkd.Snapshot()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	//only points in use are copied
+	if size := len(snap.view.tree.t0m.data); size != 50*bkd.pointSize {
+		t.Fatalf("T0M of the view takes %d bytes, want %d", size, 50*bkd.pointSize)
+	}
+	it, err := snap.NewIterator(lowPoint, highPoint)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer it.Close()
+
+	//compact T0M and T0 into T1, and erase from T0M
+	for i := 150; i < 200; i++ {
+		if err = bkd.Insert(Point{[]uint64{uint64(i), uint64(i)}, uint64(i)}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	for i := 200; i < 210; i++ {
+		if err = bkd.Insert(Point{[]uint64{uint64(i), uint64(i)}, uint64(i)}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if _, err = bkd.Erase(Point{[]uint64{205, 205}, 205}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(bkd.trees) != 2 || bkd.trees[0].meta.NumPoints != 0 {
+		t.Fatalf("T0 shall have been absorbed into T1")
+	}
+	//the absorbed file is kept for the snapshot
+	if _, err = os.Stat(bkd.TiPath(0)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if snap.NumPoints() != 150 {
+		t.Fatalf("snapshot NumPoints %d, want %d", snap.NumPoints(), 150)
+	}
+	visitor := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = snap.Intersect(visitor); err != nil {
+		t.Fatalf("%+v", err)
+	} else if len(visitor.Points) != 150 {
+		t.Fatalf("found %d matchs, want %d", len(visitor.Points), 150)
+	}
+	var cnt int
+	if cnt, err = snap.Count(lowPoint, highPoint); err != nil {
+		t.Fatalf("%+v", err)
+	} else if cnt != 150 {
+		t.Fatalf("snapshot count %d, want %d", cnt, 150)
+	}
+	if cnt, err = bkd.Count(lowPoint, highPoint); err != nil {
+		t.Fatalf("%+v", err)
+	} else if cnt != 209 {
+		t.Fatalf("tree count %d, want %d", cnt, 209)
+	}
+
+	//the cursor holds the snapshot by itself
+	if err = snap.Release(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = snap.Count(lowPoint, highPoint); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got error %v, want %v", err, ErrClosed)
+	}
+	cnt = 0
+	for it.Next() {
+		cnt++
+	}
+	if err = it.Err(); err != nil {
+		t.Fatalf("%+v", err)
+	} else if cnt != 150 {
+		t.Fatalf("iterated %d points, want %d", cnt, 150)
+	}
+	if err = it.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = os.Stat(bkd.TiPath(0)); !os.IsNotExist(err) {
+		t.Fatalf("%s shall have been removed, got error %v", bkd.TiPath(0), err)
+	}
+
+	//readers don't wait for a write which could compact
+	bkd.rwlock.Lock()
+	bkd.pinSnapshot(bkd.t0mCap)
+	done := make(chan error, 1)
+	go func() {
+		_, err := bkd.Count(lowPoint, highPoint)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reader is blocked by the writer")
+	}
+	bkd.unlock()
+
+	//erasing from Ti referred by a snapshot records a tombstone instead of waiting, while readers go on
+	if snap, err = bkd.Snapshot(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	gen := bkd.trees[1].meta.Generation
+	readers := make(chan error, 4)
+	for r := 0; r < cap(readers); r++ {
+		go func() {
+			for j := 0; j < 20; j++ {
+				if _, err := snap.Count(lowPoint, highPoint); err != nil {
+					readers <- err
+					return
+				}
+				if _, err := bkd.Count(lowPoint, highPoint); err != nil {
+					readers <- err
+					return
+				}
+			}
+			readers <- nil
+		}()
+	}
+	go func() {
+		_, err := bkd.Erase(Point{[]uint64{10, 10}, 10})
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("erasing is blocked by the snapshot")
+	}
+	for r := 0; r < cap(readers); r++ {
+		if err = <-readers; err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if cnt = bkd.numTombstones(gen); cnt != 1 {
+		t.Fatalf("%d tombstones, want %d", cnt, 1)
+	}
+	if cnt, err = snap.Count(lowPoint, highPoint); err != nil {
+		t.Fatalf("%+v", err)
+	} else if cnt != 209 {
+		t.Fatalf("snapshot count %d, want %d", cnt, 209)
+	}
+	if cnt, err = bkd.Count(lowPoint, highPoint); err != nil {
+		t.Fatalf("%+v", err)
+	} else if cnt != 208 {
+		t.Fatalf("tree count %d, want %d", cnt, 208)
+	}
+	if err = snap.Release(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	//no snapshot refers to Ti, so it's erased in place
+	if _, err = bkd.Erase(Point{[]uint64{11, 11}, 11}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if cnt = bkd.numTombstones(gen); cnt != 1 {
+		t.Fatalf("%d tombstones, want %d", cnt, 1)
+	} else if bkd.trees[1].meta.NumPoints != 199 {
+		t.Fatalf("T1 NumPoints %d, want %d", bkd.trees[1].meta.NumPoints, 199)
+	}
+
+	//a snapshot survives Close
+	if snap, err = bkd.Snapshot(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer snap.Release()
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if cnt, err = snap.Count(lowPoint, highPoint); err != nil {
+		t.Fatalf("%+v", err)
+	} else if cnt != 207 {
+		t.Fatalf("snapshot count %d, want %d", cnt, 207)
+	}
+	if _, err = bkd.Snapshot(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got error %v, want %v", err, ErrClosed)
+	}
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.Verify(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestBkdBackgroundCompaction(t *testing.T) {
+	dir := "/tmp"
+	prefix := "bkd"
+	if _, err := NewBkdTree(100, 50, 4, 2, 4, dir, prefix, WithBackgroundCompaction(0, 0)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidArgument)
+	}
+	opts := []Option{WithFixedPayload(4), WithBackgroundCompaction(2, 20000)}
+	bkd, err := NewBkdTree(100, 50, 4, 2, 4, dir, prefix, opts...)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer bkd.Destroy()
+	lowPoint := Point{[]uint64{0, 0}, 0}
+	highPoint := Point{[]uint64{1000, 1000}, 0}
+	insert := func(begin, end int) {
+		for i := begin; i < end; i++ {
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, uint32(i))
+			if err := bkd.InsertWithPayload(Point{[]uint64{uint64(i), uint64(i)}, uint64(i)}, payload); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+	}
+	count := func(want int) {
+		if cnt, err := bkd.Count(lowPoint, highPoint); err != nil {
+			t.Fatalf("%+v", err)
+		} else if cnt != want {
+			t.Fatalf("count %d, want %d", cnt, want)
+		}
+	}
+
+	//filling T0M freezes it, and inserts continue meanwhile
+	insert(0, 100)
+	bkd.rwlock.RLock()
+	frozen := bkd.frozen != nil
+	bkd.rwlock.RUnlock()
+	if !frozen {
+		t.Fatalf("T0M shall have been frozen")
+	}
+	insert(100, 150)
+	count(150)
+	visitor := &PayloadCollector{LowPoint: Point{[]uint64{10, 10}, 0}, HighPoint: Point{[]uint64{10, 10}, 0}}
+	if err = bkd.IntersectExt(visitorAdapter{visitor}); err != nil {
+		t.Fatalf("%+v", err)
+	} else if len(visitor.Payloads) != 1 || binary.BigEndian.Uint32(visitor.Payloads[0]) != 10 {
+		t.Fatalf("got payloads %v, want 10", visitor.Payloads)
+	}
+
+	bkd.rwlock.Lock()
+	bkd.waitMerge()
+	if bkd.frozen != nil || len(bkd.trees) != 1 || bkd.trees[0].meta.NumPoints != 100 {
+		t.Fatalf("the frozen buffer shall have been merged into T0")
+	}
+	bkd.rwlock.Unlock()
+	if _, err = os.Stat(bkd.FrozenPath()); !os.IsNotExist(err) {
+		t.Fatalf("got error %v, want not exist", err)
+	}
+	count(150)
+
+	//inserts filling T0M during a merge wait for it
+	insert(150, 350)
+	count(350)
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if bkd, err = NewBkdTreeExt(dir, prefix, opts...); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	count(350)
+	if err = bkd.Verify(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.Destroy(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	//a crash during a merge leaves the frozen buffer, which is merged at Open
+	if bkd, err = NewBkdTree(100, 50, 4, 2, 4, dir, prefix, WithFixedPayload(4)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	insert(0, 99)
+	bkd.rwlock.Lock()
+	if err = bkd.freezeT0M(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	bkd.close()
+	bkd.rwlock.Unlock()
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if bkd.NumPoints != 99 || bkd.frozen != nil {
+		t.Fatalf("NumPoints %d, want %d", bkd.NumPoints, 99)
+	}
+	if _, err = os.Stat(bkd.FrozenPath()); !os.IsNotExist(err) {
+		t.Fatalf("got error %v, want not exist", err)
+	}
+	count(99)
+
+	//a crash during freezing leaves the frozen buffer linked to T0M, which is removed at Open
+	insert(99, 109)
+	if err = bkd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = os.Link(bkd.T0mPath(), bkd.FrozenPath()); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = os.Stat(bkd.FrozenPath()); !os.IsNotExist(err) {
+		t.Fatalf("got error %v, want not exist", err)
+	}
+	count(109)
+	if err = bkd.Verify(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	//a failed merge keeps the frozen buffer, and the next insert filling T0M compacts synchronously
+	if err = bkd.Destroy(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if bkd, err = NewBkdTree(100, 50, 4, 2, 4, dir, prefix, opts...); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	tmpPath := bkd.TiPath(0) + ".tmp"
+	if err = os.Mkdir(tmpPath, 0700); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(tmpPath)
+	insert(0, 100)
+	bkd.rwlock.Lock()
+	bkd.waitMerge()
+	if !bkd.open || bkd.frozen == nil || bkd.mergeErr == nil {
+		t.Fatalf("the frozen buffer shall have been kept")
+	}
+	bkd.rwlock.Unlock()
+	count(100)
+	if err = os.Remove(tmpPath); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	insert(100, 201)
+	if bkd.frozen != nil || bkd.NumPoints != 201 {
+		t.Fatalf("the frozen buffer shall have been compacted")
+	}
+	count(201)
+	if err = bkd.Close(); err == nil {
+		t.Fatalf("Close shall return the error of the failed merge")
+	}
+	if err = bkd.Open(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	count(201)
+	if err = bkd.Verify(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = bkd.Destroy(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
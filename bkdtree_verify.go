@@ -0,0 +1,257 @@
+package bkdtree
+
+import (
+	"hash/crc32"
+
+	"github.com/pkg/errors"
+)
+
+//Verify walks T0M and all subtrees and checks checksums of meta, intra nodes and leaves, offset bounds, point counts,
+//invariants of KdTreeExtIntraNode, payload references, that every point lies inside the bounding box and split values of its ancestors,
+//and that every tombstone refers to a point of a live subtree.
+//Checksums are available since format version 3. The checksum of a whole subtree file recorded in the manifest is
+//checked as well if the subtree hasn't been erased from since creation. The first violation is returned as ErrCorrupt.
+func (bkd *BkdTree) Verify() (err error) {
+	bkd.rwlock.RLock()
+	defer bkd.rwlock.RUnlock()
+	if !bkd.open {
+		err = errors.Wrap(ErrClosed, "(*BkdTree).Verify")
+		return
+	}
+
+	if err = bkd.verifyMeta(&bkd.t0m); err != nil {
+		return
+	}
+	if bkd.frozen != nil {
+		if err = bkd.verifyMeta(bkd.frozen); err != nil {
+			return
+		}
+	}
+	if int(bkd.t0m.meta.NumPoints) > bkd.t0mCap {
+		err = errors.Wrapf(ErrCorrupt, "%s has %d points, exceeds capacity %d", bkd.t0m.f.Name(), bkd.t0m.meta.NumPoints, bkd.t0mCap)
+		return
+	}
+	for i := 0; i < len(bkd.trees); i++ {
+		if bkd.trees[i].store == nil {
+			continue
+		}
+		if err = bkd.verifyTi(i); err != nil {
+			err = errors.WithMessage(err, bkd.trees[i].f.Name())
+			return
+		}
+	}
+	err = bkd.verifyTombstones()
+	return
+}
+
+//verifyTombstones checks that tombstones of each point and generation refer to as many copies of the point in the tree.
+func (bkd *BkdTree) verifyTombstones() (err error) {
+	trees := make(map[uint64]*BkdSubTree)
+	for i := range bkd.trees {
+		if bkd.trees[i].store != nil && bkd.trees[i].meta.NumPoints > 0 {
+			trees[bkd.trees[i].meta.Generation] = &bkd.trees[i]
+		}
+	}
+	buf := bkd.newLeafBuf()
+	for _, ts := range bkd.tombstones {
+		erased := make(map[uint64]int)
+		for _, gen := range ts.gens {
+			erased[gen]++
+		}
+		for gen, n := range erased {
+			tree, ok := trees[gen]
+			var cnt int
+			if ok {
+				if cnt, err = bkd.countCopies(ts.point, tree.store, &tree.meta, int(tree.meta.RootOff), buf); err != nil {
+					return
+				}
+			}
+			if cnt < n {
+				err = errors.Wrapf(ErrCorrupt, "%s %d tombstones %v of generation %d refer to %d points", bkd.TombstonesPath(), n, ts.point, gen, cnt)
+				return
+			}
+		}
+	}
+	return
+}
+
+//verifyMeta re-reads the meta of the given subtree and compares it with the one in memory.
+func (bkd *BkdTree) verifyMeta(bst *BkdSubTree) (err error) {
+	size := bst.store.Size()
+	mSize := metaSize(bst.meta.FormatVer)
+	var data []byte
+	if data, err = bst.store.ReadAt(nil, size-mSize, mSize); err != nil {
+		return
+	}
+	var meta KdTreeExtMeta
+	if err = decodeMeta(data, &meta); err != nil {
+		err = errors.WithMessage(err, bst.f.Name())
+		return
+	}
+	if meta != bst.meta {
+		err = errors.Wrapf(ErrCorrupt, "%s meta %+v doesn't match %+v", bst.f.Name(), meta, bst.meta)
+		return
+	}
+	if int(meta.NumDims) != bkd.NumDims || int(meta.BytesPerDim) != bkd.BytesPerDim || int(meta.PointSize) != bkd.pointSize ||
+		(meta.FormatVer >= 5 && meta.DimDescs != bkd.metaDimDescs()) ||
+		int(meta.PayloadWidth) != bkd.payloadWidth || int(meta.PayloadMaxLen) != bkd.payloadMaxLen ||
+		(meta.FormatVer >= 7 && LeafCodec(meta.LeafCodec) != bkd.leafCodec) {
+		err = errors.Wrapf(ErrCorrupt, "%s meta %+v doesn't match the tree", bst.f.Name(), meta)
+		return
+	}
+	return
+}
+
+func (bkd *BkdTree) verifyTi(idx int) (err error) {
+	bst := &bkd.trees[idx]
+	meta := &bst.meta
+	if err = bkd.verifyMeta(bst); err != nil {
+		return
+	}
+	nodesEnd := uint64(bst.store.Size() - metaSize(meta.FormatVer))
+	aligned := meta.LeafCodec != uint32(LeafCodecNone) || meta.PointsOffEnd%uint64(bkd.pointSize) == 0
+	if !aligned || meta.PayloadOffEnd < meta.PointsOffEnd ||
+		meta.RootOff < meta.PayloadOffEnd || meta.RootOff >= nodesEnd {
+		err = errors.Wrapf(ErrCorrupt, "meta %+v is out of range, nodes end %d", *meta, nodesEnd)
+		return
+	}
+	lows := make([]uint64, bkd.NumDims)
+	highs := make([]uint64, bkd.NumDims)
+	for dim := range highs {
+		highs[dim] = ^uint64(0)
+	}
+	numPoints, err := bkd.verifyNode(bst.store, meta, int(meta.RootOff), lows, highs, bkd.newLeafBuf())
+	if err != nil {
+		return
+	}
+	if bst.index != nil {
+		if err = bkd.verifyUserDataIndex(idx); err != nil {
+			return
+		}
+	}
+	if numPoints != meta.NumPoints {
+		err = errors.Wrapf(ErrCorrupt, "root node has %d points, want %d", numPoints, meta.NumPoints)
+		return
+	}
+
+	for _, s := range bkd.manifest.Subtrees {
+		if s.Level != idx || s.Generation != meta.Generation || s.NumPoints != meta.NumPoints {
+			continue
+		}
+		var checksum uint32
+		if checksum, err = fileChecksum(bst.f); err != nil {
+			return
+		}
+		if checksum != s.Checksum {
+			err = errors.Wrapf(ErrCorrupt, "file checksum %d, want %d", checksum, s.Checksum)
+			return
+		}
+	}
+	return
+}
+
+//verifyNode checks the subtree rooted at the given intra node, all points of which shall be inside [lows, highs].
+//It returns the number of points of the subtree.
+func (bkd *BkdTree) verifyNode(store storage, meta *KdTreeExtMeta, nodeOffset int, lows, highs []uint64, buf []byte) (numPoints uint64, err error) {
+	node, err := readIntraNode(store, meta, nodeOffset)
+	if err != nil {
+		return
+	}
+	if int(node.SplitDim) >= bkd.NumDims {
+		err = errors.Wrapf(ErrCorrupt, "intra node at %d split dim %d is out of range", nodeOffset, node.SplitDim)
+		return
+	} else if int(node.NumStrips) > int(meta.IntraCap) {
+		err = errors.Wrapf(ErrCorrupt, "intra node at %d has %d strips, exceeds capacity %d", nodeOffset, node.NumStrips, meta.IntraCap)
+		return
+	}
+	for i := 1; i < len(node.SplitValues); i++ {
+		if node.SplitValues[i-1] > node.SplitValues[i] {
+			err = errors.Wrapf(ErrCorrupt, "intra node at %d split values %v are not in order", nodeOffset, node.SplitValues)
+			return
+		}
+	}
+	//leaves and intra nodes are placed in different regions, so offsets are in increasing order within each kind.
+	var prevLeafEnd, prevIntraOff uint64
+	splitDim := int(node.SplitDim)
+	for i, child := range node.Children {
+		childLows := append([]uint64{}, lows...)
+		childHighs := append([]uint64{}, highs...)
+		if i != 0 && node.SplitValues[i-1] > childLows[splitDim] {
+			childLows[splitDim] = node.SplitValues[i-1]
+		}
+		if i != len(node.SplitValues) && node.SplitValues[i] < childHighs[splitDim] {
+			childHighs[splitDim] = node.SplitValues[i]
+		}
+		if len(node.LowVals) != 0 {
+			for dim := 0; dim < bkd.NumDims; dim++ {
+				if node.LowVals[i*bkd.NumDims+dim] > childLows[dim] {
+					childLows[dim] = node.LowVals[i*bkd.NumDims+dim]
+				}
+				if node.HighVals[i*bkd.NumDims+dim] < childHighs[dim] {
+					childHighs[dim] = node.HighVals[i*bkd.NumDims+dim]
+				}
+			}
+		}
+		if child.Offset < meta.PointsOffEnd {
+			//leaf node
+			size := bkd.leafSize(&node, i)
+			end := child.Offset + uint64(size)
+			aligned := meta.LeafCodec != uint32(LeafCodecNone) || child.Offset%uint64(bkd.pointSize) == 0
+			if !aligned || child.Offset < prevLeafEnd || end > meta.PointsOffEnd {
+				err = errors.Wrapf(ErrCorrupt, "intra node at %d child %d %+v is out of range", nodeOffset, i, child)
+				return
+			} else if child.NumPoints > uint64(meta.LeafCap) {
+				err = errors.Wrapf(ErrCorrupt, "intra node at %d child %d %+v exceeds leaf capacity %d", nodeOffset, i, child, meta.LeafCap)
+				return
+			}
+			prevLeafEnd = end
+			var stored []byte
+			if stored, err = store.ReadAt(nil, int(child.Offset), size); err != nil {
+				return
+			}
+			if len(node.LeafChecksums) != 0 {
+				if checksum := crc32.ChecksumIEEE(stored); checksum != node.LeafChecksums[i] {
+					err = errors.Wrapf(ErrCorrupt, "leaf at %d checksum %d, want %d", child.Offset, checksum, node.LeafChecksums[i])
+					return
+				}
+			}
+			var pae PointArrayExt
+			if pae, err = bkd.readLeaf(store, meta, buf, child, size); err != nil {
+				return
+			}
+			for j := 0; j < pae.numPoints; j++ {
+				point := pae.GetPoint(j)
+				if !point.Inside(Point{Vals: childLows}, Point{Vals: childHighs}) {
+					err = errors.Wrapf(ErrCorrupt, "leaf at %d point %v is out of [%v, %v]", child.Offset, point, childLows, childHighs)
+					return
+				}
+				if bkd.hasPayload() {
+					if _, err = bkd.readPayload(store, meta, bkd.getPayloadRef(&pae, j)); err != nil {
+						return
+					}
+				}
+			}
+		} else {
+			//intra node
+			if child.Offset <= prevIntraOff || child.Offset >= uint64(nodeOffset) {
+				err = errors.Wrapf(ErrCorrupt, "intra node at %d child %d %+v is out of range", nodeOffset, i, child)
+				return
+			}
+			prevIntraOff = child.Offset
+			if child.NumPoints == 0 {
+				//dropped by EraseRange, so the subtree is stale
+				continue
+			}
+			var cnt uint64
+			if cnt, err = bkd.verifyNode(store, meta, int(child.Offset), childLows, childHighs, buf); err != nil {
+				return
+			}
+			if cnt != child.NumPoints {
+				err = errors.Wrapf(ErrCorrupt, "intra node at %d child %d has %d points, want %d", nodeOffset, i, cnt, child.NumPoints)
+				return
+			}
+		}
+		numPoints += child.NumPoints
+	}
+	return
+}
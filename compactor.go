@@ -0,0 +1,301 @@
+package bkdtree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/**
+ * Background compaction:
+ * With WithBackgroundCompaction, an insert filling T0M freezes it instead of compacting, and a compactor goroutine
+ * merges the frozen buffer and trees[0:k+1] into trees[k] while inserts continue in a fresh T0M.
+ * 1. Freezing links the T0M file to the frozen file, and atomically replaces T0M with an empty one, whose generation
+ *    is reserved for the merged tree. So the merged tree absorbs the frozen buffer but not T0M. Refers to KdTreeExtMeta.
+ * 2. The merge is bulk-loaded without holding the lock. Only installing the merged tree holds the write lock. The frozen
+ *    buffer is queried as a part of T0M of snapshots.
+ * 3. There's at most one frozen buffer. Inserts filling T0M again wait for the merge in progress, and the compactor
+ *    freezes the full T0M on finishing it. Other writes wait for the merge in progress, since it reads the trees, and
+ *    erasing doesn't look up the frozen buffer.
+ * 4. At Open, a frozen buffer older than T0M is merged synchronously unless a tree has absorbed it. A frozen buffer
+ *    not older than T0M is left by a crash before T0M is replaced, and is removed.
+ * 5. If a merge fails, the frozen buffer is kept and the error is returned by the next Close. The next write which
+ *    would wait for the merge compacts the frozen buffer and T0M synchronously instead, as Open does.
+ */
+
+//rateLimiter paces writes to rate bytes per second on average.
+type rateLimiter struct {
+	rate    int
+	start   time.Time
+	written int
+}
+
+//wait accounts n bytes written, and sleeps until the average rate is no more than the limit. A nil limiter never waits.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.written += n
+	due := l.start.Add(time.Duration(float64(l.written) / float64(l.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+//FrozenPath returns the path of the frozen buffer
+func (bkd *BkdTree) FrozenPath() string {
+	return filepath.Join(bkd.dir, fmt.Sprintf("%s_frozen", bkd.prefix))
+}
+
+//checkCompactorOpts validates options of the background compactor.
+func (bkd *BkdTree) checkCompactorOpts() (err error) {
+	if !bkd.bgCompaction {
+		return
+	} else if bkd.bgConcurrency <= 0 {
+		err = newInvalidArgument("concurrency", bkd.bgConcurrency)
+	} else if bkd.bgRateLimit < 0 {
+		err = newInvalidArgument("rateLimit", bkd.bgRateLimit)
+	}
+	return
+}
+
+//startCompactor starts the background compactor if it's enabled. Assumes write lock has been acquired.
+func (bkd *BkdTree) startCompactor() {
+	if !bkd.bgCompaction {
+		return
+	}
+	bkd.wake = make(chan struct{}, 1)
+	bkd.quit = make(chan struct{})
+	go bkd.runCompactor(bkd.wake, bkd.quit)
+}
+
+//stopCompactor stops the background compactor, if any. It doesn't wait for the goroutine to exit, which never touches
+//the tree after it's stopped. Assumes write lock has been acquired.
+func (bkd *BkdTree) stopCompactor() {
+	if bkd.quit != nil {
+		close(bkd.quit)
+		bkd.wake, bkd.quit = nil, nil
+	}
+	bkd.merging = false
+	if bkd.mergeCond != nil {
+		bkd.mergeCond.Broadcast()
+	}
+}
+
+func (bkd *BkdTree) runCompactor(wake, quit chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-wake:
+			bkd.merge(quit)
+		}
+	}
+}
+
+//merge merges the frozen buffer and trees[0:k+1] into trees[k]. Refers to Background compaction.
+func (bkd *BkdTree) merge(quit chan struct{}) {
+	bkd.rwlock.Lock()
+	if bkd.quit != quit || bkd.frozen == nil {
+		//stopped, or a former compactor of a reopened tree
+		bkd.rwlock.Unlock()
+		return
+	}
+	k := bkd.getMergePos()
+	bkd.appendTrees(k)
+	gen := bkd.t0m.meta.Generation //reserved on freezing
+	if bkd.bgRateLimit > 0 {
+		bkd.limiter = &rateLimiter{rate: bkd.bgRateLimit, start: time.Now()}
+	}
+	bkd.unlock()
+
+	//sources of the merge are written by no one else meanwhile
+	tmpFK, meta, sub, err := bkd.buildMerged(k, gen, false, nil)
+
+	bkd.rwlock.Lock()
+	defer bkd.unlock()
+	bkd.limiter = nil
+	bkd.merging = false
+	if err == nil {
+		err = bkd.installMerged(k, tmpFK, meta, sub, false)
+		tmpFK.Close()
+	}
+	if err == nil && int(bkd.t0m.meta.NumPoints) >= bkd.t0mCap {
+		//inserts are waiting for T0M
+		err = bkd.freezeT0M()
+	}
+	if err != nil {
+		//the frozen buffer is left to the next write waiting for the merge
+		bkd.mergeErr = err
+	}
+	if bkd.mergeCond != nil {
+		bkd.mergeCond.Broadcast()
+	}
+}
+
+//getMergePos returns the smallest index k at which the capacity of trees[k] is no less than the sum of size of the
+//frozen buffer + trees[0:k+1].
+func (bkd *BkdTree) getMergePos() (k int) {
+	sum := int(bkd.frozen.meta.NumPoints)
+	for k = 0; ; k++ {
+		if k < len(bkd.trees) {
+			sum += int(bkd.trees[k].meta.NumPoints)
+		}
+		capK := bkd.t0mCap << uint(k)
+		if capK >= sum {
+			return
+		}
+	}
+}
+
+//insertBackground inserts given point into T0M, and freezes T0M once it fills. If T0M is still full since the merge
+//of the previous frozen buffer is in progress, it waits for the merge. If the merge has failed, it compacts
+//synchronously. Assumes write lock has been acquired.
+func (bkd *BkdTree) insertBackground(point Point, payload []byte) (err error) {
+	for int(bkd.t0m.meta.NumPoints) >= bkd.t0mCap && bkd.merging && bkd.open {
+		bkd.mergeWait()
+	}
+	if !bkd.open {
+		err = errors.Wrap(ErrClosed, "(*BkdTree).Insert")
+		return
+	}
+	if int(bkd.t0m.meta.NumPoints) >= bkd.t0mCap {
+		//the merge has failed
+		if err = bkd.compactTo(bkd.getMinCompactPos(0), nil); err != nil {
+			return
+		}
+	}
+	if err = bkd.insertT0M([]Point{point}, [][]byte{payload}); err != nil {
+		return
+	}
+	bkd.NumPoints++
+	if int(bkd.t0m.meta.NumPoints) >= bkd.t0mCap && bkd.frozen == nil {
+		err = bkd.freezeT0M()
+	}
+	return
+}
+
+//freezeT0M turns the full T0M into the frozen buffer, swaps in an empty T0M, and wakes the compactor up.
+//Assumes write lock has been acquired, and there's no frozen buffer.
+func (bkd *BkdTree) freezeT0M() (err error) {
+	//the new T0M carries the generation reserved for the merged tree, which doesn't absorb it
+	gen := bkd.generation + 1
+	if err = os.Link(bkd.T0mPath(), bkd.FrozenPath()); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = bkd.syncDir(); err != nil {
+		return
+	}
+	meta := bkd.t0m.meta
+	meta.NumPoints = 0
+	meta.Generation = gen
+	if err = bkd.writeT0M(nil, &meta); err != nil {
+		return
+	}
+	frozen := bkd.t0m
+	bkd.frozen = &frozen
+	bkd.t0m = BkdSubTree{}
+	if err = bkd.t0m.open(bkd.T0mPath(), bkd.storageKind); err != nil {
+		return
+	}
+	if err = bkd.t0m.loadT0M(); err != nil {
+		return
+	}
+	bkd.generation = gen
+	if bkd.t0mIndex != nil {
+		bkd.t0mIndex = make(map[uint64][]int)
+	}
+	bkd.merging = true
+	select {
+	case bkd.wake <- struct{}{}:
+	default:
+	}
+	return
+}
+
+//openFrozen loads the frozen buffer left by an interrupted merge, if any. Refers to Background compaction.
+func (bkd *BkdTree) openFrozen() (err error) {
+	fp := bkd.FrozenPath()
+	if _, err = os.Stat(fp); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = errors.Wrap(err, "")
+		}
+		return
+	}
+	frozen := BkdSubTree{}
+	if err = frozen.open(fp, bkd.storageKind); err != nil {
+		return
+	}
+	bkd.frozen = &frozen
+	if err = frozen.loadT0M(); err != nil {
+		return
+	}
+	if frozen.meta.Generation >= bkd.t0m.meta.Generation {
+		//left by a crash before T0M is replaced, so T0M holds the same points
+		err = bkd.dropFrozen()
+	}
+	return
+}
+
+//dropFrozen closes and removes the frozen buffer, if any.
+func (bkd *BkdTree) dropFrozen() (err error) {
+	if bkd.frozen == nil {
+		return
+	}
+	if err = bkd.frozen.store.Close(); err != nil {
+		return
+	}
+	bkd.frozen = nil
+	if err = os.Remove(bkd.FrozenPath()); err != nil && !os.IsNotExist(err) {
+		err = errors.Wrap(err, "")
+		return
+	}
+	err = bkd.syncDir()
+	return
+}
+
+//buffers returns the frozen buffer, if any, followed by T0M if withT0M is true.
+func (bkd *BkdTree) buffers(withT0M bool) (bufs []*BkdSubTree) {
+	if bkd.frozen != nil {
+		bufs = append(bufs, bkd.frozen)
+	}
+	if withT0M {
+		bufs = append(bufs, &bkd.t0m)
+	}
+	return
+}
+
+//waitMerge waits until no background merge is in progress, or the tree is closed. The write lock is released while
+//waiting. Assumes write lock has been acquired.
+func (bkd *BkdTree) waitMerge() {
+	for bkd.merging && bkd.open {
+		bkd.mergeWait()
+	}
+}
+
+//finishMerge waits for the background merge in progress, and compacts the frozen buffer left by a failed merge and
+//T0M synchronously. Assumes write lock has been acquired.
+func (bkd *BkdTree) finishMerge() (err error) {
+	bkd.waitMerge()
+	if bkd.frozen == nil || !bkd.open {
+		return
+	}
+	bkd.pinSnapshot(bkd.t0mCap)
+	err = bkd.compactTo(bkd.getMinCompactPos(0), nil)
+	return
+}
+
+//mergeWait waits for the broadcast of a background merge being done or the tree being closed.
+func (bkd *BkdTree) mergeWait() {
+	if bkd.mergeCond == nil {
+		bkd.mergeCond = sync.NewCond(&bkd.rwlock)
+	}
+	bkd.mergeCond.Wait()
+}
@@ -0,0 +1,284 @@
+package bkdtree
+
+import (
+	"fmt"
+	"math"
+)
+
+//DimType is the type of values of a dimension. Values of any type are stored as unsigned integers of the width of the dimension
+//with an order-preserving encoding, so that comparing encoded values is the same as comparing native values.
+type DimType uint8
+
+const (
+	//DimUint is unsigned integer, which is stored as is. This is the default.
+	DimUint DimType = iota
+	//DimInt is signed integer of the width of the dimension.
+	DimInt
+	//DimFloat32 is float32. The width shall be no less than 4.
+	DimFloat32
+	//DimFloat64 is float64. The width shall be 8.
+	DimFloat64
+)
+
+func (t DimType) String() string {
+	switch t {
+	case DimUint:
+		return "uint"
+	case DimInt:
+		return "int"
+	case DimFloat32:
+		return "float32"
+	case DimFloat64:
+		return "float64"
+	}
+	return "unknown"
+}
+
+//EncodeInt encodes a signed integer of bytesPerDim bytes. The sign bit is flipped so that negative values go first.
+func EncodeInt(v int64, bytesPerDim int) uint64 {
+	bits := uint(8 * bytesPerDim)
+	u := uint64(v) ^ (uint64(1) << (bits - 1))
+	if bits < 64 {
+		u &= uint64(1)<<bits - 1
+	}
+	return u
+}
+
+//DecodeInt is the reverse of EncodeInt.
+func DecodeInt(u uint64, bytesPerDim int) int64 {
+	bits := uint(8 * bytesPerDim)
+	u ^= uint64(1) << (bits - 1)
+	//sign extend
+	return int64(u<<(64-bits)) >> (64 - bits)
+}
+
+//EncodeFloat64 encodes a float64. The sign bit is flipped for positive values, and all bits are flipped for negative
+//values. -0 is encoded as 0. NaN has no order, and shall not be encoded.
+func EncodeFloat64(f float64) uint64 {
+	if f == 0 {
+		f = 0 //normalize -0
+	}
+	b := math.Float64bits(f)
+	if b>>63 != 0 {
+		return ^b
+	}
+	return b | uint64(1)<<63
+}
+
+//DecodeFloat64 is the reverse of EncodeFloat64.
+func DecodeFloat64(u uint64) float64 {
+	if u>>63 != 0 {
+		return math.Float64frombits(u &^ (uint64(1) << 63))
+	}
+	return math.Float64frombits(^u)
+}
+
+//EncodeFloat32 encodes a float32 into 4 bytes in the same way as EncodeFloat64.
+func EncodeFloat32(f float32) uint64 {
+	if f == 0 {
+		f = 0 //normalize -0
+	}
+	b := math.Float32bits(f)
+	if b>>31 != 0 {
+		return uint64(^b)
+	}
+	return uint64(b | uint32(1)<<31)
+}
+
+//DecodeFloat32 is the reverse of EncodeFloat32.
+func DecodeFloat32(u uint64) float32 {
+	b := uint32(u)
+	if b>>31 != 0 {
+		return math.Float32frombits(b &^ (uint32(1) << 31))
+	}
+	return math.Float32frombits(^b)
+}
+
+//DimTypes returns the type of each dimension.
+func (bkd *BkdTree) DimTypes() []DimType {
+	return append([]DimType{}, bkd.dimTypes...)
+}
+
+//EncodeValue encodes the native value of the given dimension. The value shall be uint64, int64, float32 or float64
+//for DimUint, DimInt, DimFloat32 or DimFloat64 respectively.
+func (bkd *BkdTree) EncodeValue(dim int, v interface{}) (u uint64, err error) {
+	if dim < 0 || dim >= bkd.NumDims {
+		err = newInvalidArgument("dim", dim)
+		return
+	}
+	switch bkd.dimTypes[dim] {
+	case DimUint:
+		if val, ok := v.(uint64); ok && val <= bkd.maxValue(dim) {
+			u = val
+			return
+		}
+	case DimInt:
+		width := bkd.dimWidth(dim)
+		bits := uint(8 * width)
+		if val, ok := v.(int64); ok && (bits == 64 || (val >= -(int64(1)<<(bits-1)) && val < int64(1)<<(bits-1))) {
+			u = EncodeInt(val, width)
+			return
+		}
+	case DimFloat32:
+		if val, ok := v.(float32); ok && !math.IsNaN(float64(val)) {
+			u = EncodeFloat32(val)
+			return
+		}
+	case DimFloat64:
+		if val, ok := v.(float64); ok && !math.IsNaN(val) {
+			u = EncodeFloat64(val)
+			return
+		}
+	}
+	err = newInvalidArgument(fmt.Sprintf("value of %s dimension %d", bkd.dimTypes[dim], dim), v)
+	return
+}
+
+//DecodeValue is the reverse of EncodeValue.
+func (bkd *BkdTree) DecodeValue(dim int, u uint64) (v interface{}) {
+	switch bkd.dimTypes[dim] {
+	case DimInt:
+		v = DecodeInt(u, bkd.dimWidth(dim))
+	case DimFloat32:
+		v = DecodeFloat32(u)
+	case DimFloat64:
+		v = DecodeFloat64(u)
+	default:
+		v = u
+	}
+	return
+}
+
+//NewPoint creates a point from native values. Refers to EncodeValue.
+func (bkd *BkdTree) NewPoint(userData uint64, vals ...interface{}) (point Point, err error) {
+	if len(vals) != bkd.NumDims {
+		err = newDimensionMismatch("vals", len(vals), bkd.NumDims)
+		return
+	}
+	point = Point{Vals: make([]uint64, bkd.NumDims), UserData: userData}
+	for dim, v := range vals {
+		if point.Vals[dim], err = bkd.EncodeValue(dim, v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//PointValues returns native values of the point. Refers to DecodeValue.
+func (bkd *BkdTree) PointValues(point Point) (vals []interface{}) {
+	vals = make([]interface{}, len(point.Vals))
+	for dim, u := range point.Vals {
+		vals[dim] = bkd.DecodeValue(dim, u)
+	}
+	return
+}
+
+//checkDimTypes ensures each type is compatible with the width of its dimension.
+func (bkd *BkdTree) checkDimTypes() (err error) {
+	if len(bkd.dimTypes) != bkd.NumDims {
+		err = newDimensionMismatch("dimTypes", len(bkd.dimTypes), bkd.NumDims)
+		return
+	}
+	for dim, t := range bkd.dimTypes {
+		width := bkd.dimWidth(dim)
+		if t > DimFloat64 || (t == DimFloat32 && width < 4) || (t == DimFloat64 && width != 8) {
+			err = newInvalidArgument(fmt.Sprintf("dimTypes[%d]", dim), t)
+			return
+		}
+	}
+	return
+}
+
+//metaDimDescs returns dimension types and widths in the form of KdTreeExtMeta.
+func (bkd *BkdTree) metaDimDescs() (descs [256]uint8) {
+	for dim, t := range bkd.dimTypes {
+		descs[dim] = uint8(t) | uint8(bkd.dimWidth(dim)-1)<<4
+	}
+	return
+}
+
+//parseDimDescs is the reverse of metaDimDescs. dimBytes is nil if all dimensions are of BytesPerDim bytes.
+//Dimensions of files of format version < 5 are of BytesPerDim bytes, and of DimUint if format version < 4.
+func parseDimDescs(meta *KdTreeExtMeta) (types []DimType, dimBytes []int) {
+	numDims := int(meta.NumDims)
+	types = make([]DimType, numDims)
+	if meta.FormatVer < 5 {
+		for dim := range types {
+			types[dim] = DimType(meta.DimDescs[dim])
+		}
+		return
+	}
+	dimBytes = make([]int, numDims)
+	for dim := range types {
+		types[dim] = DimType(meta.DimDescs[dim] & 0x0f)
+		dimBytes[dim] = int(meta.DimDescs[dim]>>4) + 1
+	}
+	if _, uniform := uniformWidth(dimBytes); uniform {
+		dimBytes = nil
+	}
+	return
+}
+
+//uniformWidth returns the width if all dimensions are of the same width which Point.Encode supports.
+func uniformWidth(dimBytes []int) (width int, uniform bool) {
+	width = dimBytes[0]
+	if width != 1 && width != 2 && width != 4 && width != 8 {
+		return
+	}
+	for _, w := range dimBytes {
+		if w != width {
+			return
+		}
+	}
+	uniform = true
+	return
+}
+
+//dimWidth returns the byte width of the given dimension.
+func (bkd *BkdTree) dimWidth(dim int) int {
+	if bkd.dimBytes != nil {
+		return bkd.dimBytes[dim]
+	}
+	return bkd.BytesPerDim
+}
+
+//encodePoint encodes the point with the width of each dimension.
+func (bkd *BkdTree) encodePoint(b []byte, point Point) {
+	if bkd.dimBytes != nil {
+		point.EncodeExt(b, bkd.dimBytes)
+		return
+	}
+	point.Encode(b, bkd.BytesPerDim)
+}
+
+//checkDimBytes validates widths set by WithDimBytes, and derives BytesPerDim and pointSize from them.
+//BytesPerDim is the widest one if widths differ.
+func (bkd *BkdTree) checkDimBytes() (err error) {
+	if bkd.dimBytes != nil {
+		if len(bkd.dimBytes) != bkd.NumDims {
+			err = newDimensionMismatch("dimBytes", len(bkd.dimBytes), bkd.NumDims)
+			return
+		}
+		bkd.BytesPerDim = 0
+		for dim, width := range bkd.dimBytes {
+			if width < 1 || width > 8 {
+				err = newInvalidArgument(fmt.Sprintf("dimBytes[%d]", dim), width)
+				return
+			}
+			if width > bkd.BytesPerDim {
+				bkd.BytesPerDim = width
+			}
+		}
+		if _, uniform := uniformWidth(bkd.dimBytes); uniform {
+			bkd.dimBytes = nil
+		}
+	}
+	bkd.pointSize = 8
+	for dim := 0; dim < bkd.NumDims; dim++ {
+		bkd.pointSize += bkd.dimWidth(dim)
+	}
+	if bkd.pointSize > int(^uint8(0)) {
+		err = newInvalidArgument("pointSize", bkd.pointSize)
+	}
+	return
+}
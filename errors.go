@@ -0,0 +1,44 @@
+package bkdtree
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+//Errors returned by BkdTree. They could be wrapped with context, so use errors.Is to test them.
+var (
+	//ErrInvalidArgument indicates an argument is invalid. The offending argument is described by InvalidArgumentError.
+	ErrInvalidArgument = errors.New("invalid argument")
+	//ErrClosed indicates the operation is not allowed since the tree is closed.
+	ErrClosed = errors.New("operation is not allowed at closed state")
+	//ErrAlreadyOpen indicates the operation is not allowed since the tree is open.
+	ErrAlreadyOpen = errors.New("operation is not allowed at open state")
+	//ErrCorrupt indicates a file is corrupt.
+	ErrCorrupt = errors.New("file is corrupt")
+	//ErrDimensionMismatch indicates the number of dimensions of a point doesn't match the tree.
+	ErrDimensionMismatch = errors.New("dimension mismatch")
+)
+
+//InvalidArgumentError describes the offending argument. It matches ErrInvalidArgument with errors.Is.
+type InvalidArgumentError struct {
+	Field string      //name of the argument
+	Value interface{} //value of the argument
+}
+
+func (e *InvalidArgumentError) Error() string {
+	return fmt.Sprintf("%s: %s %v", ErrInvalidArgument.Error(), e.Field, e.Value)
+}
+
+//Is is used by errors.Is.
+func (e *InvalidArgumentError) Is(target error) bool {
+	return target == ErrInvalidArgument
+}
+
+func newInvalidArgument(field string, value interface{}) error {
+	return errors.WithStack(&InvalidArgumentError{Field: field, Value: value})
+}
+
+func newDimensionMismatch(field string, numDims, want int) error {
+	return errors.Wrapf(ErrDimensionMismatch, "%s has %d dimensions, want %d", field, numDims, want)
+}
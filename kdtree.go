@@ -3,6 +3,8 @@ package bkdtree
 import (
 	"math/rand"
 	"sort"
+
+	"github.com/pkg/errors"
 )
 
 type U64Slice []uint64
@@ -43,6 +45,70 @@ func (d *IntersectCollector) GetLowPoint() Point     { return d.LowPoint }
 func (d *IntersectCollector) GetHighPoint() Point    { return d.HighPoint }
 func (d *IntersectCollector) VisitPoint(point Point) { d.Points = append(d.Points, point) }
 
+//ErrStopVisit is used as a return value from IntersectVisitorExt.VisitPointExt to indicate that the traversal shall stop.
+//It is not returned as an error by any function.
+var ErrStopVisit = errors.New("stop visit")
+
+//IntersectVisitorExt is a variant of IntersectVisitor which is able to stop the traversal early or abort it with an error.
+type IntersectVisitorExt interface {
+	GetLowPoint() Point
+	GetHighPoint() Point
+	VisitPointExt(point Point) error
+}
+
+//Relation is the relation between a cell and the query.
+type Relation int
+
+const (
+	//CellOutsideQuery indicates no point of the cell matches the query.
+	CellOutsideQuery Relation = iota
+	//CellInsideQuery indicates all points of the cell match the query.
+	CellInsideQuery
+	//CellCrossesQuery indicates some points of the cell may match the query.
+	CellCrossesQuery
+)
+
+//IntersectCellVisitor is an optional interface of IntersectVisitor and IntersectVisitorExt.
+//Compare returns the relation between the cell [lowVals, highVals] and the query. Points of a cell inside the query
+//are visited without checking against [GetLowPoint(), GetHighPoint()], and a cell outside the query is skipped.
+//A visitor without this interface gets the relation of the cell and [GetLowPoint(), GetHighPoint()].
+type IntersectCellVisitor interface {
+	Compare(lowVals, highVals []uint64) Relation
+}
+
+//CompareBox returns the relation between the cell [lowVals, highVals] and the query box [lowPoint, highPoint].
+func CompareBox(lowVals, highVals []uint64, lowPoint, highPoint Point) (rel Relation) {
+	rel = CellInsideQuery
+	for dim := 0; dim < len(lowVals); dim++ {
+		if highVals[dim] < lowPoint.Vals[dim] || lowVals[dim] > highPoint.Vals[dim] {
+			rel = CellOutsideQuery
+			return
+		}
+		if lowVals[dim] < lowPoint.Vals[dim] || highVals[dim] > highPoint.Vals[dim] {
+			rel = CellCrossesQuery
+		}
+	}
+	return
+}
+
+//IntersectLimitCollector collects at most Limit points.
+type IntersectLimitCollector struct {
+	LowPoint  Point
+	HighPoint Point
+	Limit     int
+	Points    []Point
+}
+
+func (d *IntersectLimitCollector) GetLowPoint() Point  { return d.LowPoint }
+func (d *IntersectLimitCollector) GetHighPoint() Point { return d.HighPoint }
+func (d *IntersectLimitCollector) VisitPointExt(point Point) error {
+	d.Points = append(d.Points, point)
+	if len(d.Points) >= d.Limit {
+		return ErrStopVisit
+	}
+	return nil
+}
+
 type KdTree struct {
 	root     KdTreeNode
 	NumDims  int
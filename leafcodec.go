@@ -0,0 +1,348 @@
+package bkdtree
+
+import (
+	"hash/crc32"
+	"math/bits"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+//LeafCodec is the encoding of leaves in Ti files. T0M is never encoded.
+type LeafCodec int
+
+const (
+	//LeafCodecNone stores leaves as raw points, the same as T0M. This is the default.
+	LeafCodecNone LeafCodec = iota
+	//LeafCodecPrefix strips the common prefix of each dimension, encodes UserData and payload references as deltas
+	//to the minimum, and bit-packs the remaining bits.
+	LeafCodecPrefix
+)
+
+/**
+ * Leaves of files with a leaf codec:
+ * 1. Leaves are packed in [0, PointsOffEnd) in the order of points. KdTreeExtIntraNode.LeafSizes carries the size of each.
+ * 2. A leaf of NumPoints*PointSize bytes is stored as raw points, which happens if encoding doesn't save space.
+ *    Otherwise it's encoded in LeafCodecPrefix.
+ * 3. Payload references in leaves are relative, which are ref-PointsOffEnd+1, or 0 for the empty payload.
+ *    So payloads are able to move together with PointsOffEnd.
+ * LeafCodecPrefix layout:
+ * A column is a dimension, UserData or the payload reference. For each column, a header of 1 byte bit width W followed by
+ * the base value of the column width. Then for each point, for each column, the lowest W bits of value-base, in big
+ * endian bit order. The base of a dimension is the common prefix of values, and the base of others is the min value.
+ * Erasing a point from a leaf never increases the encoded size.
+ */
+
+//leafColumns returns the byte width of each column of a point.
+func (bkd *BkdTree) leafColumns() (widths []int) {
+	for dim := 0; dim < bkd.NumDims; dim++ {
+		widths = append(widths, bkd.dimWidth(dim))
+	}
+	widths = append(widths, 8) //UserData
+	if bkd.hasPayload() {
+		widths = append(widths, 8) //payload reference
+	}
+	return
+}
+
+//putBits writes the lowest width bits of v at the given bit offset of b. b shall be zeroed.
+func putBits(b []byte, off int, v uint64, width int) {
+	for width > 0 {
+		idx, used := off/8, off%8
+		n := 8 - used
+		if n > width {
+			n = width
+		}
+		chunk := byte(v>>uint(width-n)) & byte(uint64(1)<<uint(n)-1)
+		b[idx] |= chunk << uint(8-used-n)
+		off += n
+		width -= n
+	}
+}
+
+//getBits is the reverse of putBits.
+func getBits(b []byte, off int, width int) (v uint64) {
+	for width > 0 {
+		idx, used := off/8, off%8
+		n := 8 - used
+		if n > width {
+			n = width
+		}
+		chunk := (b[idx] >> uint(8-used-n)) & byte(uint64(1)<<uint(n)-1)
+		v = v<<uint(n) | uint64(chunk)
+		off += n
+		width -= n
+	}
+	return
+}
+
+//toRelativeRef and fromRelativeRef convert payload references of a leaf. Refers to the layout.
+func toRelativeRef(ref, pointsOffEnd uint64) uint64 {
+	if ref == 0 {
+		return 0
+	}
+	return ref - pointsOffEnd + 1
+}
+
+func fromRelativeRef(ref, pointsOffEnd uint64) uint64 {
+	if ref == 0 {
+		return 0
+	}
+	return ref + pointsOffEnd - 1
+}
+
+//encodeLeaf encodes raw points of a leaf, payload references of which are relative to pointsOffEnd.
+//The result is no larger than raw points.
+func (bkd *BkdTree) encodeLeaf(pae *PointArrayExt, pointsOffEnd uint64) (data []byte) {
+	widths := bkd.leafColumns()
+	numPoints := pae.numPoints
+	//column-major values
+	vals := make([][]uint64, len(widths))
+	for c := range vals {
+		vals[c] = make([]uint64, numPoints)
+	}
+	for i := 0; i < numPoints; i++ {
+		rec := pae.data[i*pae.pointSize:]
+		off := 0
+		for c, width := range widths {
+			vals[c][i] = uintN(rec[off:], width)
+			off += width
+		}
+		if bkd.hasPayload() {
+			vals[len(widths)-1][i] = toRelativeRef(vals[len(widths)-1][i], pointsOffEnd)
+		}
+	}
+
+	headerSize := 0
+	for _, width := range widths {
+		headerSize += 1 + width
+	}
+	bitWidths := make([]int, len(widths))
+	bases := make([]uint64, len(widths))
+	var numBits int
+	for c := range widths {
+		if numPoints == 0 {
+			break
+		}
+		minVal, maxVal := vals[c][0], vals[c][0]
+		for _, v := range vals[c] {
+			if v < minVal {
+				minVal = v
+			}
+			if v > maxVal {
+				maxVal = v
+			}
+		}
+		if c < bkd.NumDims {
+			bitWidths[c] = bits.Len64(minVal ^ maxVal)
+			bases[c] = minVal
+			if bitWidths[c] < 64 {
+				bases[c] = minVal &^ (uint64(1)<<uint(bitWidths[c]) - 1)
+			}
+		} else {
+			bitWidths[c] = bits.Len64(maxVal - minVal)
+			bases[c] = minVal
+		}
+		numBits += bitWidths[c] * numPoints
+	}
+	size := headerSize + (numBits+7)/8
+	if size >= numPoints*pae.pointSize {
+		//raw points with relative payload references
+		data = append([]byte{}, pae.data[:numPoints*pae.pointSize]...)
+		if bkd.hasPayload() {
+			raw := PointArrayExt{data: data, numPoints: numPoints, pointSize: pae.pointSize}
+			for i := 0; i < numPoints; i++ {
+				bkd.setPayloadRef(&raw, i, vals[len(widths)-1][i])
+			}
+		}
+		return
+	}
+	data = make([]byte, size)
+	off := 0
+	for c, width := range widths {
+		data[off] = byte(bitWidths[c])
+		putUintN(data[off+1:], bases[c], width)
+		off += 1 + width
+	}
+	bitOff := off * 8
+	for i := 0; i < numPoints; i++ {
+		for c := range widths {
+			putBits(data, bitOff, vals[c][i]-bases[c], bitWidths[c])
+			bitOff += bitWidths[c]
+		}
+	}
+	return
+}
+
+//decodeLeaf decodes the stored leaf of numPoints points into raw points with absolute payload references.
+//buf is used if it's large enough.
+func (bkd *BkdTree) decodeLeaf(data []byte, numPoints int, pointsOffEnd uint64, buf []byte) (pae PointArrayExt, err error) {
+	size := numPoints * bkd.pointSize
+	if len(buf) < size {
+		buf = make([]byte, size)
+	}
+	pae = PointArrayExt{
+		data:        buf[:size],
+		numPoints:   numPoints,
+		byDim:       0, //not used
+		bytesPerDim: bkd.BytesPerDim,
+		dimBytes:    bkd.dimBytes,
+		numDims:     bkd.NumDims,
+		pointSize:   bkd.pointSize,
+	}
+	widths := bkd.leafColumns()
+	if len(data) == size {
+		copy(pae.data, data)
+		if bkd.hasPayload() {
+			for i := 0; i < numPoints; i++ {
+				bkd.setPayloadRef(&pae, i, fromRelativeRef(bkd.getPayloadRef(&pae, i), pointsOffEnd))
+			}
+		}
+		return
+	}
+	bitWidths := make([]int, len(widths))
+	bases := make([]uint64, len(widths))
+	off := 0
+	numBits := 0
+	for c, width := range widths {
+		if off+1+width > len(data) {
+			err = errors.Wrapf(ErrCorrupt, "leaf of %d bytes is too short", len(data))
+			return
+		}
+		bitWidths[c] = int(data[off])
+		if bitWidths[c] > 8*width {
+			err = errors.Wrapf(ErrCorrupt, "leaf column %d bit width %d exceeds %d", c, bitWidths[c], 8*width)
+			return
+		}
+		bases[c] = uintN(data[off+1:], width)
+		off += 1 + width
+		numBits += bitWidths[c] * numPoints
+	}
+	if off+(numBits+7)/8 != len(data) {
+		err = errors.Wrapf(ErrCorrupt, "leaf of %d points is of %d bytes, want %d", numPoints, len(data), off+(numBits+7)/8)
+		return
+	}
+	bitOff := off * 8
+	for i := 0; i < numPoints; i++ {
+		rec := pae.data[i*bkd.pointSize:]
+		recOff := 0
+		for c, width := range widths {
+			v := bases[c] + getBits(data, bitOff, bitWidths[c])
+			bitOff += bitWidths[c]
+			if bkd.hasPayload() && c == len(widths)-1 {
+				v = fromRelativeRef(v, pointsOffEnd)
+			}
+			putUintN(rec[recOff:], v, width)
+			recOff += width
+		}
+	}
+	return
+}
+
+//packNode is an intra node loaded by packLeaves.
+type packNode struct {
+	node     KdTreeExtIntraNode
+	children []*packNode //nil for leaf children
+}
+
+//packLeaves encodes leaves of the tree just built in tmpF, and places encoded leaves, payloads and intra nodes in turn.
+//data is the mapping of [0, payloadOffEnd). Refers to the layout of leaves of files with a leaf codec.
+//The file is truncated to the end of intra nodes, where the meta shall be written.
+func (bkd *BkdTree) packLeaves(tmpF *os.File, data []byte, rootOff, pointsOffEnd, payloadOffEnd int64) (newRootOff, newPointsOffEnd, newPayloadOffEnd int64, err error) {
+	store, err := newStorage(tmpF, StoragePread)
+	if err != nil {
+		return
+	}
+	//intra nodes are built without leaf sizes
+	rawMeta := &KdTreeExtMeta{NumDims: uint8(bkd.NumDims), FormatVer: FormatVer}
+	var load func(nodeOffset int64) (pn *packNode, err error)
+	load = func(nodeOffset int64) (pn *packNode, err error) {
+		pn = &packNode{children: make([]*packNode, 0)}
+		if pn.node, err = readIntraNode(store, rawMeta, int(nodeOffset)); err != nil {
+			return
+		}
+		for _, child := range pn.node.Children {
+			var c *packNode
+			if child.Offset >= uint64(pointsOffEnd) {
+				if c, err = load(int64(child.Offset)); err != nil {
+					return
+				}
+			}
+			pn.children = append(pn.children, c)
+		}
+		return
+	}
+	root, err := load(rootOff)
+	if err != nil {
+		return
+	}
+
+	//leaves are visited in the order of points, and each encoded leaf is no larger than raw points.
+	//So an encoded leaf never overwrites raw points which haven't been encoded.
+	var cursor int64
+	var packLeaves func(pn *packNode)
+	packLeaves = func(pn *packNode) {
+		pn.node.LeafSizes = make([]uint32, pn.node.NumStrips)
+		for i, child := range pn.node.Children {
+			if pn.children[i] != nil {
+				packLeaves(pn.children[i])
+				continue
+			}
+			leaf := PointArrayExt{
+				data:      data[child.Offset:],
+				numPoints: int(child.NumPoints),
+				pointSize: bkd.pointSize,
+			}
+			enc := bkd.encodeLeaf(&leaf, uint64(pointsOffEnd))
+			copy(data[cursor:], enc)
+			pn.node.Children[i].Offset = uint64(cursor)
+			pn.node.LeafSizes[i] = uint32(len(enc))
+			pn.node.LeafChecksums[i] = crc32.ChecksumIEEE(enc)
+			cursor += int64(len(enc))
+		}
+	}
+	packLeaves(root)
+	newPointsOffEnd = cursor
+	newPayloadOffEnd = cursor + payloadOffEnd - pointsOffEnd
+	copy(data[newPointsOffEnd:newPayloadOffEnd], data[pointsOffEnd:payloadOffEnd])
+
+	//intra nodes are written in post order, the same as createKdTreeExt
+	nodeOff := newPayloadOffEnd
+	var writeNodes func(pn *packNode) (offset int64, err error)
+	writeNodes = func(pn *packNode) (offset int64, err error) {
+		for i, c := range pn.children {
+			if c == nil {
+				continue
+			}
+			var childOff int64
+			if childOff, err = writeNodes(c); err != nil {
+				return
+			}
+			pn.node.Children[i].Offset = uint64(childOff)
+		}
+		var nodeData []byte
+		if nodeData, err = encodeIntraNode(&pn.node); err != nil {
+			return
+		}
+		bkd.limiter.wait(len(nodeData))
+		if _, err = tmpF.WriteAt(nodeData, nodeOff); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+		offset = nodeOff
+		nodeOff += int64(len(nodeData))
+		return
+	}
+	if newRootOff, err = writeNodes(root); err != nil {
+		return
+	}
+	if err = tmpF.Truncate(nodeOff); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if _, err = tmpF.Seek(nodeOff, 0); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	return
+}
@@ -0,0 +1,220 @@
+package bkdtree
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//ManifestVersion is the current manifest version.
+const ManifestVersion = 1
+
+//Manifest describes the live files of a BkdTree. It's persisted as JSON and replaced atomically whenever the set of
+//subtrees changes. Open uses it to decide which subtree files are live, so stray files in the directory are ignored.
+/**
+ * A compaction renames the new Ti into place before committing the manifest. If a crash happens in between,
+ * the renamed Ti is either unlisted, in which case its sources are still live, or listed with a lower generation,
+ * in which case its sources are detected as stale by generation. Refers to KdTreeExtMeta.
+ */
+type Manifest struct {
+	Version    int               `json:"version"`
+	Params     BkdParams         `json:"params"`
+	Generation uint64            `json:"generation"` //the latest generation of files
+	Subtrees   []ManifestSubtree `json:"subtrees"`   //ordered by level
+}
+
+//ManifestSubtree describes a subtree file. NumPoints and Checksum are taken at creation. Erasing decreases NumPoints in
+//the file meta in place unless WithTombstones is set, so Checksum is applicable only if NumPoints still equals the one in the file meta.
+type ManifestSubtree struct {
+	Level      int       `json:"level"`
+	File       string    `json:"file"` //base name of the file
+	Generation uint64    `json:"generation"`
+	NumPoints  uint64    `json:"numPoints"`
+	Checksum   uint32    `json:"checksum"` //CRC-32 (IEEE) of the whole file
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+//ManifestPath returns the manifest path
+func (bkd *BkdTree) ManifestPath() string {
+	return filepath.Join(bkd.dir, fmt.Sprintf("%s_manifest", bkd.prefix))
+}
+
+func fileChecksum(f *os.File) (checksum uint32, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	h := crc32.NewIEEE()
+	if _, err = io.Copy(h, io.NewSectionReader(f, 0, info.Size())); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	checksum = h.Sum32()
+	return
+}
+
+//newManifestSubtree describes trees[level] whose content is f. f could be a temp file to be renamed.
+func (bkd *BkdTree) newManifestSubtree(level int, f *os.File, meta *KdTreeExtMeta, createdAt time.Time) (sub ManifestSubtree, err error) {
+	sub = ManifestSubtree{
+		Level:      level,
+		File:       filepath.Base(bkd.TiPath(level)),
+		Generation: meta.Generation,
+		NumPoints:  meta.NumPoints,
+		CreatedAt:  createdAt.UTC(),
+	}
+	sub.Checksum, err = fileChecksum(f)
+	return
+}
+
+//writeManifest atomically replaces the manifest file.
+func (bkd *BkdTree) writeManifest(manifest *Manifest) (err error) {
+	fp := bkd.ManifestPath()
+	tmpFp := fp + ".tmp"
+	if err = FileMarshal(tmpFp, manifest); err != nil {
+		return
+	}
+	if bkd.durability == DurabilitySync {
+		var f *os.File
+		if f, err = os.OpenFile(tmpFp, os.O_RDWR, 0600); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+	}
+	if err = os.Rename(tmpFp, fp); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = bkd.syncDir(); err != nil {
+		return
+	}
+	bkd.manifest = *manifest
+	return
+}
+
+//initManifest writes a manifest without any subtree.
+func (bkd *BkdTree) initManifest() (err error) {
+	manifest := Manifest{
+		Version: ManifestVersion,
+		Params: BkdParams{
+			T0mCap:      bkd.t0mCap,
+			LeafCap:     bkd.leafCap,
+			IntraCap:    bkd.intraCap,
+			NumDims:     bkd.NumDims,
+			BytesPerDim: bkd.BytesPerDim,
+		},
+		Generation: bkd.generation,
+		Subtrees:   []ManifestSubtree{},
+	}
+	err = bkd.writeManifest(&manifest)
+	return
+}
+
+//commitSubtree records that the file described by sub has become trees[k], which absorbs trees[0:k+1]. sub is taken
+//by newManifestSubtree once the file is built, so reading the file for its checksum doesn't hold the lock of a merge.
+func (bkd *BkdTree) commitSubtree(k int, sub ManifestSubtree) (err error) {
+	manifest := bkd.manifest
+	manifest.Generation = sub.Generation
+	manifest.Subtrees = []ManifestSubtree{sub}
+	for _, s := range bkd.manifest.Subtrees {
+		if s.Level > k {
+			manifest.Subtrees = append(manifest.Subtrees, s)
+		}
+	}
+	err = bkd.writeManifest(&manifest)
+	return
+}
+
+//readManifest loads the manifest. found is false if the manifest doesn't exist, which is the case of files
+//created before the manifest is introduced.
+func (bkd *BkdTree) readManifest() (found bool, err error) {
+	var manifest Manifest
+	if err = FileUnmarshal(bkd.ManifestPath(), &manifest); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = errors.Wrapf(ErrCorrupt, "%s: %v", bkd.ManifestPath(), err)
+		}
+		return
+	}
+	if manifest.Version > ManifestVersion {
+		err = errors.Wrapf(ErrCorrupt, "%s version %d is not supported", bkd.ManifestPath(), manifest.Version)
+		return
+	}
+	params := BkdParams{
+		T0mCap:      bkd.t0mCap,
+		LeafCap:     bkd.leafCap,
+		IntraCap:    bkd.intraCap,
+		NumDims:     bkd.NumDims,
+		BytesPerDim: bkd.BytesPerDim,
+	}
+	if manifest.Params != params {
+		err = errors.Wrapf(ErrCorrupt, "%s params %+v doesn't match T0M %+v", bkd.ManifestPath(), manifest.Params, params)
+		return
+	}
+	for _, s := range manifest.Subtrees {
+		if s.Level < 0 || s.File != filepath.Base(bkd.TiPath(s.Level)) {
+			err = errors.Wrapf(ErrCorrupt, "%s subtree %+v is invalid", bkd.ManifestPath(), s)
+			return
+		}
+	}
+	bkd.manifest = manifest
+	found = true
+	return
+}
+
+//reconcileManifest makes the manifest describe the live trees after recovery, and persists it if it changed.
+func (bkd *BkdTree) reconcileManifest() (err error) {
+	manifest := bkd.manifest
+	manifest.Version = ManifestVersion
+	manifest.Params = BkdParams{
+		T0mCap:      bkd.t0mCap,
+		LeafCap:     bkd.leafCap,
+		IntraCap:    bkd.intraCap,
+		NumDims:     bkd.NumDims,
+		BytesPerDim: bkd.BytesPerDim,
+	}
+	manifest.Generation = bkd.generation
+	manifest.Subtrees = []ManifestSubtree{}
+	old := make(map[int]ManifestSubtree)
+	for _, s := range bkd.manifest.Subtrees {
+		old[s.Level] = s
+	}
+	for i, tree := range bkd.trees {
+		if tree.store == nil {
+			continue
+		}
+		if s, ok := old[i]; ok && s.Generation == tree.meta.Generation {
+			manifest.Subtrees = append(manifest.Subtrees, s)
+			continue
+		}
+		//the file was renamed into place by a compaction which didn't commit the manifest, or it's a legacy one
+		var info os.FileInfo
+		if info, err = tree.f.Stat(); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+		var s ManifestSubtree
+		if s, err = bkd.newManifestSubtree(i, tree.f, &tree.meta, info.ModTime()); err != nil {
+			return
+		}
+		manifest.Subtrees = append(manifest.Subtrees, s)
+	}
+	if reflect.DeepEqual(manifest, bkd.manifest) {
+		return
+	}
+	err = bkd.writeManifest(&manifest)
+	return
+}
@@ -0,0 +1,102 @@
+package bkdtree
+
+//Option configures a BkdTree. Options are accepted by NewBkdTree, NewBkdTreeExt and BuildBkdTree.
+type Option func(bkd *BkdTree)
+
+//WithStorage selects the way to access files. Refers to StorageKind.
+func WithStorage(kind StorageKind) Option {
+	return func(bkd *BkdTree) {
+		bkd.storageKind = kind
+	}
+}
+
+//WithDimTypes sets the type of each dimension. All dimensions are DimUint by default.
+//It's used on creating a tree only, since types are persisted in files.
+func WithDimTypes(types ...DimType) Option {
+	return func(bkd *BkdTree) {
+		bkd.dimTypes = append([]DimType{}, types...)
+	}
+}
+
+//WithDimBytes sets the byte width of each dimension, in [1, 8], which overrides bytesPerDim.
+//For example, widths 8, 1, 1 suit a timestamp and two small categories. BytesPerDim becomes the widest one.
+//It's used on creating a tree only, since widths are persisted in files.
+func WithDimBytes(widths ...int) Option {
+	return func(bkd *BkdTree) {
+		bkd.dimBytes = append([]int{}, widths...)
+	}
+}
+
+//WithFixedPayload attaches a payload of exactly width bytes to each point. Refers to WithVarPayload.
+//It's used on creating a tree only, since the payload layout is persisted in files.
+func WithFixedPayload(width int) Option {
+	return func(bkd *BkdTree) {
+		bkd.payloadWidth = width
+	}
+}
+
+//WithVarPayload attaches a payload of up to maxLen bytes to each point. Payloads are stored in a separate payload
+//section of each Ti file, referenced from leaves, and passed to visitors implementing IntersectPayloadVisitor.
+//T0M reserves maxLen bytes for each point. It's used on creating a tree only, since the payload layout is persisted in files.
+func WithVarPayload(maxLen int) Option {
+	return func(bkd *BkdTree) {
+		bkd.payloadMaxLen = maxLen
+	}
+}
+
+//WithLeafCodec selects the encoding of leaves of Ti. Refers to LeafCodec.
+//It's used on creating a tree only, since the codec is persisted in files.
+func WithLeafCodec(codec LeafCodec) Option {
+	return func(bkd *BkdTree) {
+		bkd.leafCodec = codec
+	}
+}
+
+//WithTombstones makes Erase record erased points of Ti in a tombstone file instead of rewriting Ti in place, so Ti
+//files are write-once. Erased points are filtered from queries and dropped by the next compaction absorbing Ti.
+//It's used on opening a tree, since tombstones left by a previous open are honored regardless.
+func WithTombstones() Option {
+	return func(bkd *BkdTree) {
+		bkd.tombstoneErase = true
+	}
+}
+
+//WithUserDataIndex maintains an index from UserData to points for T0M and each Ti, which is required by GetByUserData
+//and EraseByUserData. It's used on opening a tree. Indexes missing or left stale by opening without it are rebuilt at Open.
+func WithUserDataIndex() Option {
+	return func(bkd *BkdTree) {
+		bkd.userDataIndex = true
+	}
+}
+
+//WithQueryClamp makes query bounds saturate to the value range of each dimension instead of being rejected.
+//For example, a box with math.MaxUint64 corners is accepted by a tree of 2 bytes per dimension.
+func WithQueryClamp() Option {
+	return func(bkd *BkdTree) {
+		bkd.clampQuery = true
+	}
+}
+
+//WithDurability selects the level of crash safety. Refers to Durability.
+func WithDurability(durability Durability) Option {
+	return func(bkd *BkdTree) {
+		bkd.durability = durability
+	}
+}
+
+//WithBackgroundCompaction makes inserts filling T0M freeze it instead of compacting, and starts a compactor goroutine
+//merging the frozen T0M while inserts continue in a fresh T0M. concurrency, which shall be positive, is the number of
+//goroutines partitioning points on bulk-loading. rateLimit is the max bytes per second written by a background merge,
+//0 means unlimited. It's used on opening a tree. Refers to Background compaction.
+//Limitation: only Insert, InsertWithPayload, InsertBatch fitting into T0M and reads proceed during a merge, and
+//inserts as well wait for it once the fresh T0M is full. Erase, EraseRange, EraseByUserData, Update, Apply, Compact,
+//InsertBatch not fitting into T0M, Close and Destroy block until the merge in progress is done. concurrency only
+//parallelizes partitioning points; extracting points and writing the merged tree are done by the compactor goroutine
+//alone.
+func WithBackgroundCompaction(concurrency, rateLimit int) Option {
+	return func(bkd *BkdTree) {
+		bkd.bgCompaction = true
+		bkd.bgConcurrency = concurrency
+		bkd.bgRateLimit = rateLimit
+	}
+}
@@ -0,0 +1,210 @@
+package bkdtree
+
+import (
+	"encoding/binary"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+//IntersectPayloadVisitor is an optional interface of IntersectVisitor and IntersectVisitorExt. If the tree carries
+//payloads, VisitPayload is invoked instead of VisitPoint or VisitPointExt with the payload of each matching point.
+//The payload is owned by the visitor. Refers to IntersectVisitorExt for the meaning of the returned error.
+type IntersectPayloadVisitor interface {
+	VisitPayload(point Point, payload []byte) error
+}
+
+//PayloadCollector collects matching points and their payloads.
+type PayloadCollector struct {
+	LowPoint  Point
+	HighPoint Point
+	Points    []Point
+	Payloads  [][]byte
+}
+
+func (d *PayloadCollector) GetLowPoint() Point  { return d.LowPoint }
+func (d *PayloadCollector) GetHighPoint() Point { return d.HighPoint }
+func (d *PayloadCollector) VisitPoint(point Point) {
+	d.Points = append(d.Points, point)
+	d.Payloads = append(d.Payloads, nil)
+}
+func (d *PayloadCollector) VisitPayload(point Point, payload []byte) error {
+	d.Points = append(d.Points, point)
+	d.Payloads = append(d.Payloads, payload)
+	return nil
+}
+
+/**
+ * Payloads:
+ * If payloads are enabled, each point is followed by an 8 bytes payload reference, which is the offset of the payload
+ * in the same file. Reference 0 means the empty payload, which is of PayloadWidth zero bytes if payloads are of fixed
+ * width. A fixed width payload is stored as is, and a variable length payload is prefixed with its uint32 length.
+ * Payloads of Ti are placed in [PointsOffEnd, PayloadOffEnd). T0M reserves one slot of payloadSlotSize bytes for each
+ * point there, and the i-th point refers to the i-th slot.
+ * Erasing a point from Ti leaves its payload unreferenced until the next compaction.
+ */
+
+//hasPayload returns whether points carry payload references.
+func (bkd *BkdTree) hasPayload() bool {
+	return bkd.payloadWidth != 0 || bkd.payloadMaxLen != 0
+}
+
+//payloadSlotSize returns the max encoded size of a payload.
+func (bkd *BkdTree) payloadSlotSize() int {
+	if bkd.payloadWidth != 0 {
+		return bkd.payloadWidth
+	}
+	return 4 + bkd.payloadMaxLen
+}
+
+//checkPayloadOpts validates options of payloads and reserves the payload reference in each point.
+//It shall be invoked after pointSize has been derived.
+func (bkd *BkdTree) checkPayloadOpts() (err error) {
+	if bkd.payloadWidth < 0 || bkd.payloadWidth > int(^uint32(0)) {
+		err = newInvalidArgument("payloadWidth", bkd.payloadWidth)
+		return
+	} else if bkd.payloadMaxLen < 0 || bkd.payloadMaxLen > int(^uint32(0))-4 {
+		err = newInvalidArgument("payloadMaxLen", bkd.payloadMaxLen)
+		return
+	} else if bkd.payloadWidth != 0 && bkd.payloadMaxLen != 0 {
+		err = newInvalidArgument("payloadMaxLen", bkd.payloadMaxLen)
+		return
+	}
+	if !bkd.hasPayload() {
+		return
+	}
+	bkd.pointSize += 8
+	if bkd.pointSize > int(^uint8(0)) {
+		err = newInvalidArgument("pointSize", bkd.pointSize)
+	}
+	return
+}
+
+//checkPayload ensures the payload fits into the tree. nil is the empty payload.
+func (bkd *BkdTree) checkPayload(field string, payload []byte) (err error) {
+	if payload == nil {
+		return
+	}
+	if !bkd.hasPayload() || (bkd.payloadWidth != 0 && len(payload) != bkd.payloadWidth) ||
+		(bkd.payloadMaxLen != 0 && len(payload) > bkd.payloadMaxLen) {
+		err = newInvalidArgument(field, len(payload))
+	}
+	return
+}
+
+//encodePayload appends the encoded payload to b.
+func (bkd *BkdTree) encodePayload(b, payload []byte) []byte {
+	if bkd.payloadWidth != 0 {
+		return append(b, payload...)
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(payload)))
+	b = append(b, lenBuf[:]...)
+	return append(b, payload...)
+}
+
+//getPayloadRef returns the payload reference of the i-th point.
+func (bkd *BkdTree) getPayloadRef(pae *PointArrayExt, i int) uint64 {
+	return binary.BigEndian.Uint64(pae.data[(i+1)*pae.pointSize-8:])
+}
+
+//setPayloadRef sets the payload reference of the i-th point.
+func (bkd *BkdTree) setPayloadRef(pae *PointArrayExt, i int, ref uint64) {
+	binary.BigEndian.PutUint64(pae.data[(i+1)*pae.pointSize-8:], ref)
+}
+
+//readPayload returns a copy of the payload referred by ref. The payload shall be inside [PointsOffEnd, PayloadOffEnd).
+func (bkd *BkdTree) readPayload(store storage, meta *KdTreeExtMeta, ref uint64) (payload []byte, err error) {
+	if ref == 0 {
+		if bkd.payloadWidth != 0 {
+			payload = make([]byte, bkd.payloadWidth)
+		}
+		return
+	}
+	off := int(ref)
+	size := bkd.payloadWidth
+	var data []byte
+	if size == 0 {
+		if ref < meta.PointsOffEnd || ref+4 > meta.PayloadOffEnd {
+			err = errors.Wrapf(ErrCorrupt, "payload reference %d is out of range [%d, %d)", ref, meta.PointsOffEnd, meta.PayloadOffEnd)
+			return
+		}
+		if data, err = store.ReadAt(nil, off, 4); err != nil {
+			return
+		}
+		size = int(binary.BigEndian.Uint32(data))
+		off += 4
+		if size > bkd.payloadMaxLen {
+			err = errors.Wrapf(ErrCorrupt, "payload at %d length %d exceeds %d", ref, size, bkd.payloadMaxLen)
+			return
+		}
+	}
+	if ref < meta.PointsOffEnd || uint64(off+size) > meta.PayloadOffEnd {
+		err = errors.Wrapf(ErrCorrupt, "payload at %d is out of range [%d, %d)", ref, meta.PointsOffEnd, meta.PayloadOffEnd)
+		return
+	}
+	if data, err = store.ReadAt(nil, off, size); err != nil {
+		return
+	}
+	payload = append([]byte{}, data...)
+	return
+}
+
+//extractPayloads copies payloads referred by the given points from store to the payload section of dstF starting at
+//*payloadOff, and updates references of the points and *payloadOff. points are modified in place.
+func (bkd *BkdTree) extractPayloads(dstF *os.File, store storage, meta *KdTreeExtMeta, points PointArrayExt, payloadOff *int64) (err error) {
+	var buf []byte
+	for i := 0; i < points.numPoints; i++ {
+		ref := bkd.getPayloadRef(&points, i)
+		if ref == 0 {
+			continue
+		}
+		var payload []byte
+		if payload, err = bkd.readPayload(store, meta, ref); err != nil {
+			return
+		}
+		bkd.setPayloadRef(&points, i, uint64(*payloadOff)+uint64(len(buf)))
+		buf = bkd.encodePayload(buf, payload)
+	}
+	if len(buf) == 0 {
+		return
+	}
+	bkd.limiter.wait(len(buf))
+	if _, err = dstF.WriteAt(buf, *payloadOff); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	*payloadOff += int64(len(buf))
+	return
+}
+
+//getPayloadVisitor returns the IntersectPayloadVisitor implemented by the given visitor, if any, and if the tree carries payloads.
+func (bkd *BkdTree) getPayloadVisitor(visitor IntersectVisitorExt) (pv IntersectPayloadVisitor) {
+	if !bkd.hasPayload() {
+		return
+	}
+	var v interface{} = visitor
+	if bounded, ok := v.(boundedVisitor); ok {
+		v = bounded.IntersectVisitorExt
+	}
+	if adapter, ok := v.(visitorAdapter); ok {
+		v = adapter.IntersectVisitor
+	}
+	pv, _ = v.(IntersectPayloadVisitor)
+	return
+}
+
+//visitPoint passes the i-th point, and its payload if pv isn't nil, to the visitor.
+func (bkd *BkdTree) visitPoint(visitor IntersectVisitorExt, pv IntersectPayloadVisitor, store storage, meta *KdTreeExtMeta,
+	pae *PointArrayExt, i int, point Point) (err error) {
+	if pv == nil {
+		err = visitor.VisitPointExt(point)
+		return
+	}
+	var payload []byte
+	if payload, err = bkd.readPayload(store, meta, bkd.getPayloadRef(pae, i)); err != nil {
+		return
+	}
+	err = pv.VisitPayload(point, payload)
+	return
+}
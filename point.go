@@ -32,6 +32,7 @@ type PointArrayExt struct {
 	numPoints   int
 	byDim       int
 	bytesPerDim int
+	dimBytes    []int //byte width of each dimension. nil means all dimensions are of bytesPerDim bytes.
 	numDims     int
 	pointSize   int
 }
@@ -117,6 +118,68 @@ func (p *Point) Decode(b []byte, numDims int, bytesPerDim int) {
 	return
 }
 
+//EncodeExt encodes in place with the byte width of each dimension.
+//len(b) shall be no less than sum(dimBytes)+8
+func (p *Point) EncodeExt(b []byte, dimBytes []int) {
+	off := 0
+	for i, width := range dimBytes {
+		putUintN(b[off:], p.Vals[i], width)
+		off += width
+	}
+	binary.BigEndian.PutUint64(b[off:], p.UserData)
+	return
+}
+
+//DecodeExt is the reverse of EncodeExt.
+func (p *Point) DecodeExt(b []byte, dimBytes []int) {
+	p.Vals = make([]uint64, len(dimBytes))
+	off := 0
+	for i, width := range dimBytes {
+		p.Vals[i] = uintN(b[off:], width)
+		off += width
+	}
+	p.UserData = binary.BigEndian.Uint64(b[off:])
+	return
+}
+
+//putUintN puts the lowest width bytes of v in big endian. width shall be in [1, 8].
+func putUintN(b []byte, v uint64, width int) {
+	switch width {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		binary.BigEndian.PutUint16(b, uint16(v))
+	case 4:
+		binary.BigEndian.PutUint32(b, uint32(v))
+	case 8:
+		binary.BigEndian.PutUint64(b, v)
+	default:
+		for i := width - 1; i >= 0; i-- {
+			b[i] = byte(v)
+			v >>= 8
+		}
+	}
+}
+
+//uintN is the reverse of putUintN.
+func uintN(b []byte, width int) (v uint64) {
+	switch width {
+	case 1:
+		v = uint64(b[0])
+	case 2:
+		v = uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		v = uint64(binary.BigEndian.Uint32(b))
+	case 8:
+		v = binary.BigEndian.Uint64(b)
+	default:
+		for i := 0; i < width; i++ {
+			v = v<<8 | uint64(b[i])
+		}
+	}
+	return
+}
+
 // Len is part of sort.Interface.
 func (s *PointArrayMem) Len() int {
 	return len(s.points)
@@ -211,12 +274,23 @@ func (s *PointArrayExt) Less(i, j int) bool {
 }
 
 func (s *PointArrayExt) GetPoint(i int) (point Point) {
+	if s.dimBytes != nil {
+		point.DecodeExt(s.data[i*s.pointSize:], s.dimBytes)
+		return
+	}
 	point.Decode(s.data[i*s.pointSize:], s.numDims, s.bytesPerDim)
 	return
 }
 
 func (s *PointArrayExt) GetValue(i int) (val uint64) {
 	offI := i * s.pointSize
+	if s.dimBytes != nil {
+		for dim := 0; dim < s.byDim; dim++ {
+			offI += s.dimBytes[dim]
+		}
+		val = uintN(s.data[offI:], s.dimBytes[s.byDim])
+		return
+	}
 	switch s.bytesPerDim {
 	case 1:
 		val = uint64(s.data[offI+s.byDim])
@@ -230,12 +304,42 @@ func (s *PointArrayExt) GetValue(i int) (val uint64) {
 	return
 }
 
+//GetBounds returns the bounding box of all points.
+func (s *PointArrayExt) GetBounds() (lowVals, highVals []uint64) {
+	lowVals = make([]uint64, s.numDims)
+	highVals = make([]uint64, s.numDims)
+	for i := 0; i < s.numPoints; i++ {
+		point := s.GetPoint(i)
+		for dim := 0; dim < s.numDims; dim++ {
+			if i == 0 || point.Vals[dim] < lowVals[dim] {
+				lowVals[dim] = point.Vals[dim]
+			}
+			if i == 0 || point.Vals[dim] > highVals[dim] {
+				highVals[dim] = point.Vals[dim]
+			}
+		}
+	}
+	return
+}
+
+//Count returns the number of points inside [lowPoint, highPoint].
+func (s *PointArrayExt) Count(lowPoint, highPoint Point) (cnt int) {
+	for i := 0; i < s.numPoints; i++ {
+		point := s.GetPoint(i)
+		if point.Inside(lowPoint, highPoint) {
+			cnt++
+		}
+	}
+	return
+}
+
 func (s *PointArrayExt) SubArray(begin, end int) (sub PointArray) {
 	sub = &PointArrayExt{
 		data:        s.data[begin*s.pointSize : end*s.pointSize],
 		numPoints:   end - begin,
 		byDim:       s.byDim,
 		bytesPerDim: s.bytesPerDim,
+		dimBytes:    s.dimBytes,
 		numDims:     s.numDims,
 		pointSize:   s.pointSize,
 	}
@@ -243,30 +347,44 @@ func (s *PointArrayExt) SubArray(begin, end int) (sub PointArray) {
 }
 
 func (s *PointArrayExt) Erase(point Point) (found bool) {
-	var i int
-	for i = 0; i < s.numPoints; i++ {
-		pI := s.GetPoint(i)
-		//assumes each point's userData is unique
-		found = point.Equal(pI)
-		if found {
-			break
-		}
+	i := s.Index(point)
+	if i >= 0 {
+		s.EraseAt(i)
+		found = true
 	}
-	if found {
-		//replace the matched point with the last point and decrease the array length
-		offI := i * s.pointSize
-		offJ := (s.numPoints - 1) * s.pointSize
-		for idx := 0; idx < s.pointSize; idx++ {
-			s.data[offI+idx] = s.data[offJ+idx]
-			s.data[offJ+idx] = 0
+	return
+}
+
+//Index returns the index of the given point, or -1 if not found.
+func (s *PointArrayExt) Index(point Point) (idx int) {
+	for idx = 0; idx < s.numPoints; idx++ {
+		pI := s.GetPoint(idx)
+		//assumes each point's userData is unique
+		if point.Equal(pI) {
+			return
 		}
-		s.numPoints--
 	}
+	idx = -1
 	return
 }
 
+//EraseAt replaces the i-th point with the last point and decrease the array length.
+func (s *PointArrayExt) EraseAt(i int) {
+	offI := i * s.pointSize
+	offJ := (s.numPoints - 1) * s.pointSize
+	for idx := 0; idx < s.pointSize; idx++ {
+		s.data[offI+idx] = s.data[offJ+idx]
+		s.data[offJ+idx] = 0
+	}
+	s.numPoints--
+}
+
 func (s *PointArrayExt) Append(point Point) {
 	off := s.numPoints * s.pointSize
+	if s.dimBytes != nil {
+		point.EncodeExt(s.data[off:], s.dimBytes)
+		return
+	}
 	point.Encode(s.data[off:], s.bytesPerDim)
 }
 
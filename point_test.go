@@ -2,6 +2,7 @@ package bkdtree
 
 import (
 	"bytes"
+	"math"
 	"math/rand"
 	"os"
 	"testing"
@@ -247,3 +248,82 @@ func TestSplitPoints(t *testing.T) {
 		}
 	}
 }
+
+func TestOrderPreservingEncoding(t *testing.T) {
+	for _, bytesPerDim := range []int{1, 2, 4, 8} {
+		bits := uint(8 * bytesPerDim)
+		minVal := -(int64(1) << (bits - 1))
+		maxVal := int64(uint64(1)<<(bits-1) - 1)
+		ints := []int64{minVal, minVal + 1, -2, -1, 0, 1, 2, maxVal - 1, maxVal}
+		for i, v := range ints {
+			u := EncodeInt(v, bytesPerDim)
+			if bits < 64 && u >= uint64(1)<<bits {
+				t.Fatalf("EncodeInt(%d, %d) = %d overflows", v, bytesPerDim, u)
+			} else if v2 := DecodeInt(u, bytesPerDim); v2 != v {
+				t.Fatalf("DecodeInt(EncodeInt(%d, %d)) = %d", v, bytesPerDim, v2)
+			} else if i != 0 && EncodeInt(ints[i-1], bytesPerDim) >= u {
+				t.Fatalf("EncodeInt(%d, %d) is not less than EncodeInt(%d, %d)", ints[i-1], bytesPerDim, v, bytesPerDim)
+			}
+		}
+	}
+
+	floats := []float64{math.Inf(-1), -math.MaxFloat64, -1.5, -math.SmallestNonzeroFloat64, 0, math.SmallestNonzeroFloat64, 1.5, math.MaxFloat64, math.Inf(1)}
+	for i, f := range floats {
+		u := EncodeFloat64(f)
+		if f2 := DecodeFloat64(u); f2 != f {
+			t.Fatalf("DecodeFloat64(EncodeFloat64(%v)) = %v", f, f2)
+		} else if i != 0 && EncodeFloat64(floats[i-1]) >= u {
+			t.Fatalf("EncodeFloat64(%v) is not less than EncodeFloat64(%v)", floats[i-1], f)
+		}
+		f32 := float32(f)
+		u = EncodeFloat32(f32)
+		if u > math.MaxUint32 {
+			t.Fatalf("EncodeFloat32(%v) = %d overflows", f32, u)
+		} else if f2 := DecodeFloat32(u); f2 != f32 {
+			t.Fatalf("DecodeFloat32(EncodeFloat32(%v)) = %v", f32, f2)
+		}
+	}
+	if EncodeFloat64(math.Copysign(0, -1)) != EncodeFloat64(0) {
+		t.Fatalf("-0 and 0 are encoded differently")
+	}
+}
+
+func TestPointCodecExt(t *testing.T) {
+	dimBytes := []int{3, 1, 8, 5}
+	pointSize := 3 + 1 + 8 + 5 + 8
+	points := []Point{
+		{[]uint64{0xabcdef, 0xff, 0x0123456789abcdef, 0x123456789a}, 7},
+		{[]uint64{1, 2, 3, 4}, 8},
+		{[]uint64{0, 0, 0, 0}, 9},
+	}
+	data := make([]byte, len(points)*pointSize)
+	pae := PointArrayExt{
+		data:        data,
+		numPoints:   0,
+		byDim:       0,
+		bytesPerDim: 8,
+		dimBytes:    dimBytes,
+		numDims:     len(dimBytes),
+		pointSize:   pointSize,
+	}
+	for _, point := range points {
+		pae.Append(point)
+		pae.numPoints++
+	}
+	for i, point := range points {
+		var p2 Point
+		p2.DecodeExt(data[i*pointSize:], dimBytes)
+		if !p2.Equal(point) {
+			t.Fatalf("point %d decoded as %v, want %v", i, p2, point)
+		}
+		if p3 := pae.GetPoint(i); !p3.Equal(point) {
+			t.Fatalf("GetPoint(%d) = %v, want %v", i, p3, point)
+		}
+		for dim := range dimBytes {
+			pae.byDim = dim
+			if val := pae.GetValue(i); val != point.Vals[dim] {
+				t.Fatalf("GetValue(%d) of dim %d = %d, want %d", i, dim, val, point.Vals[dim])
+			}
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package bkdtree
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+/**
+ * Snapshots:
+ * A snapshot is an immutable view of the tree. Readers query a snapshot without holding the lock of the tree, so they
+ * never wait for a compaction merging and bulk-loading a new subtree.
+ * 1. A view is a read-only copy of the tree. Points and payload slots of the frozen buffer and T0M in use are copied
+ *    into memory as T0M of the view, and Ti stores are shared with the tree. A view is shared by snapshots, and counts them.
+ * 2. The tree counts views referring to each Ti store. A store retired by a compaction or Close is unmapped, and its
+ *    file is removed if it has been absorbed, once the last view referring to it is released.
+ * 3. The tree caches the latest view, which is dropped when a write releases the lock. So a write becomes visible to
+ *    snapshots taken after it's done. A write which could compact caches a view before it starts, so readers keep
+ *    querying the state before the write meanwhile.
+ * 4. Ti files are never written after creation except erasing in place, which drops the cached view first. Erasing
+ *    from a Ti referred by other views records tombstones instead, as WithTombstones does. So writes never wait for views.
+ */
+
+//snapView is a read-only copy of a tree shared by snapshots.
+type snapView struct {
+	tree *BkdTree
+	refs int //snapshots and the cache of the tree holding the view. Protected by snapMu of the tree.
+}
+
+//retiredStore is a Ti store closed by the tree, which is still referred by views.
+type retiredStore struct {
+	f      *os.File
+	remove bool //the file has been absorbed by a compaction
+}
+
+//Snapshot is an immutable view of a BkdTree. Queries of a snapshot don't hold the lock of the tree, and see neither
+//writes done after the snapshot is taken nor Close of the tree. A snapshot is safe for concurrent queries.
+//The caller shall Release it. Refers to Snapshots.
+type Snapshot struct {
+	bkd      *BkdTree //the tree it's taken from
+	view     *snapView
+	released bool
+}
+
+//Snapshot returns an immutable view of the current state of the tree. The caller shall Release it.
+func (bkd *BkdTree) Snapshot() (snap *Snapshot, err error) {
+	snap, err = bkd.snapshot("(*BkdTree).Snapshot")
+	return
+}
+
+//snapshot returns a snapshot sharing the cached view, which is created if there isn't one. op is reported if the tree is closed.
+func (bkd *BkdTree) snapshot(op string) (snap *Snapshot, err error) {
+	bkd.snapMu.Lock()
+	if view := bkd.snap; view != nil {
+		view.refs++
+		bkd.snapMu.Unlock()
+		snap = &Snapshot{bkd: bkd, view: view}
+		return
+	}
+	bkd.snapMu.Unlock()
+
+	bkd.rwlock.RLock()
+	defer bkd.rwlock.RUnlock()
+	if !bkd.open {
+		err = errors.Wrap(ErrClosed, op)
+		return
+	}
+	bkd.snapMu.Lock()
+	defer bkd.snapMu.Unlock()
+	if bkd.snap == nil {
+		bkd.snap = bkd.newView()
+	}
+	bkd.snap.refs++
+	snap = &Snapshot{bkd: bkd, view: bkd.snap}
+	return
+}
+
+//newView creates a view of the current state, which is held by the cache of the tree.
+//Assumes snapMu and either lock have been acquired.
+func (bkd *BkdTree) newView() (view *snapView) {
+	tree := &BkdTree{
+		t0mCap:        bkd.t0mCap,
+		leafCap:       bkd.leafCap,
+		intraCap:      bkd.intraCap,
+		NumDims:       bkd.NumDims,
+		BytesPerDim:   bkd.BytesPerDim,
+		pointSize:     bkd.pointSize,
+		dir:           bkd.dir,
+		prefix:        bkd.prefix,
+		NumPoints:     bkd.NumPoints,
+		t0m:           BkdSubTree{meta: bkd.t0m.meta},
+		trees:         make([]BkdSubTree, len(bkd.trees)),
+		open:          true,
+		storageKind:   bkd.storageKind,
+		clampQuery:    bkd.clampQuery,
+		durability:    bkd.durability,
+		generation:    bkd.generation,
+		dimTypes:      bkd.dimTypes,
+		dimBytes:      bkd.dimBytes,
+		payloadWidth:  bkd.payloadWidth,
+		payloadMaxLen: bkd.payloadMaxLen,
+		leafCodec:     bkd.leafCodec,
+	}
+	//only points and payload slots in use are copied, and packed without spare slots. The frozen buffer, if any,
+	//precedes T0M.
+	var numPoints, slotSize int
+	for _, bst := range bkd.buffers(true) {
+		numPoints += int(bst.meta.NumPoints)
+	}
+	if bkd.hasPayload() {
+		slotSize = bkd.payloadSlotSize()
+	}
+	meta := &tree.t0m.meta
+	meta.NumPoints = uint64(numPoints)
+	meta.PointsOffEnd = uint64(numPoints * bkd.pointSize)
+	meta.PayloadOffEnd = meta.PointsOffEnd + uint64(numPoints*slotSize)
+	data := make([]byte, meta.PayloadOffEnd)
+	var pos, slotPos int
+	for _, bst := range bkd.buffers(true) {
+		numPoints := int(bst.meta.NumPoints)
+		copy(data[pos*bkd.pointSize:], bst.data[:numPoints*bkd.pointSize])
+		if slotSize != 0 {
+			begin := int(bst.meta.PointsOffEnd)
+			copy(data[int(meta.PointsOffEnd)+slotPos:], bst.data[begin:begin+numPoints*slotSize])
+			//rebase payload references to the copy
+			pae := PointArrayExt{
+				data:        data[pos*bkd.pointSize:],
+				numPoints:   numPoints,
+				byDim:       0, //not used
+				bytesPerDim: bkd.BytesPerDim,
+				dimBytes:    bkd.dimBytes,
+				numDims:     bkd.NumDims,
+				pointSize:   bkd.pointSize,
+			}
+			for i := 0; i < numPoints; i++ {
+				if ref := bkd.getPayloadRef(&pae, i); ref != 0 {
+					bkd.setPayloadRef(&pae, i, ref-bst.meta.PointsOffEnd+meta.PointsOffEnd+uint64(slotPos))
+				}
+			}
+		}
+		pos += numPoints
+		slotPos += numPoints * slotSize
+	}
+	tree.t0m.data = data
+	tree.t0m.store = &memStorage{data: data}
+
+	if bkd.snapRefs == nil {
+		bkd.snapRefs = make(map[storage]int)
+	}
+	for i, bst := range bkd.trees {
+		tree.trees[i] = BkdSubTree{meta: bst.meta, f: bst.f, store: bst.store}
+		if bst.store != nil {
+			bkd.snapRefs[bst.store]++
+		}
+	}
+	if len(bkd.tombstones) != 0 {
+		tree.tombstones = make(map[string]*tombstone, len(bkd.tombstones))
+		for key, ts := range bkd.tombstones {
+			tree.tombstones[key] = &tombstone{point: ts.point, gens: append([]uint64{}, ts.gens...)}
+		}
+	}
+	view = &snapView{tree: tree, refs: 1}
+	return
+}
+
+//releaseView drops one holder of the view. Once the view isn't held, retired stores which aren't referred by other
+//views are closed. Assumes snapMu has been acquired.
+func (bkd *BkdTree) releaseView(view *snapView) (err error) {
+	if view.refs--; view.refs > 0 {
+		return
+	}
+	for _, bst := range view.tree.trees {
+		if bst.store == nil {
+			continue
+		}
+		if bkd.snapRefs[bst.store]--; bkd.snapRefs[bst.store] > 0 {
+			continue
+		}
+		if delete(bkd.snapRefs, bst.store); len(bkd.snapRefs) == 0 {
+			bkd.snapRefs = nil
+		}
+		if rs, ok := bkd.retired[bst.store]; ok {
+			if delete(bkd.retired, bst.store); len(bkd.retired) == 0 {
+				bkd.retired = nil
+			}
+			if errC := bkd.closeRetired(bst.store, rs); errC != nil && err == nil {
+				err = errC
+			}
+		}
+	}
+	return
+}
+
+//closeRetired closes the retired store, and removes its file unless the path has been taken by another file.
+func (bkd *BkdTree) closeRetired(store storage, rs retiredStore) (err error) {
+	var same bool
+	if rs.remove {
+		if info, errS := os.Stat(rs.f.Name()); errS == nil {
+			if infoF, errF := rs.f.Stat(); errF == nil {
+				same = os.SameFile(info, infoF)
+			}
+		}
+	}
+	if err = store.Close(); err != nil {
+		return
+	}
+	if same {
+		if err = os.Remove(rs.f.Name()); err != nil && !os.IsNotExist(err) {
+			err = errors.Wrap(err, "")
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+//retireSubTree closes the store of trees[idx], and removes the file if remove is true. Both are deferred until no view
+//refers to the store. Refers to Snapshots.
+func (bkd *BkdTree) retireSubTree(idx int, remove bool) (err error) {
+	bst := &bkd.trees[idx]
+	bkd.snapMu.Lock()
+	if bkd.snapRefs[bst.store] > 0 {
+		if bkd.retired == nil {
+			bkd.retired = make(map[storage]retiredStore)
+		}
+		bkd.retired[bst.store] = retiredStore{f: bst.f, remove: remove}
+		bkd.snapMu.Unlock()
+		return
+	}
+	bkd.snapMu.Unlock()
+	err = bkd.closeRetired(bst.store, retiredStore{f: bst.f, remove: remove})
+	return
+}
+
+//pinSnapshot caches a view of the current state if inserting the given number of points fills T0M, so readers keep
+//querying it during the compaction. Assumes write lock has been acquired.
+func (bkd *BkdTree) pinSnapshot(inserts int) {
+	if int(bkd.t0m.meta.NumPoints)+inserts < bkd.t0mCap {
+		return
+	}
+	bkd.snapMu.Lock()
+	if bkd.snap == nil {
+		bkd.snap = bkd.newView()
+	}
+	bkd.snapMu.Unlock()
+}
+
+//dropSnapshot drops the cached view. Assumes snapMu has been acquired.
+func (bkd *BkdTree) dropSnapshot() (err error) {
+	if bkd.snap == nil {
+		return
+	}
+	err = bkd.releaseView(bkd.snap)
+	bkd.snap = nil
+	return
+}
+
+//eraseInPlace returns whether points of the given Ti store are able to be erased in place, which requires that the
+//tree doesn't erase by tombstones and no view refers to the store. The cached view is dropped. Refers to Snapshots.
+//Assumes write lock has been acquired.
+func (bkd *BkdTree) eraseInPlace(store storage) bool {
+	if bkd.tombstoneErase {
+		return false
+	}
+	bkd.snapMu.Lock()
+	defer bkd.snapMu.Unlock()
+	bkd.dropSnapshot()
+	return bkd.snapRefs[store] == 0
+}
+
+//unlock drops the cached view, which is stale once the write is done, and releases the write lock.
+//Errors of closing retired stores are dropped, since they're never written afterwards.
+func (bkd *BkdTree) unlock() {
+	bkd.snapMu.Lock()
+	bkd.dropSnapshot()
+	bkd.snapMu.Unlock()
+	bkd.rwlock.Unlock()
+}
+
+//NumPoints returns the number of points of the snapshot.
+func (s *Snapshot) NumPoints() int {
+	return s.view.tree.NumPoints
+}
+
+//Intersect does window query over the snapshot.
+func (s *Snapshot) Intersect(visitor IntersectVisitor) (err error) {
+	err = s.IntersectExt(visitorAdapter{visitor})
+	return
+}
+
+//IntersectExt does window query over the snapshot. Refers to (*BkdTree).IntersectExt.
+func (s *Snapshot) IntersectExt(visitor IntersectVisitorExt) (err error) {
+	if s.released {
+		err = errors.Wrap(ErrClosed, "(*Snapshot).Intersect")
+		return
+	}
+	//settings of queries belong to the tree
+	lowP, highP, err := s.bkd.checkQuery(visitor.GetLowPoint(), visitor.GetHighPoint())
+	if err != nil {
+		return
+	}
+	err = s.view.tree.intersect(boundedVisitor{visitor, lowP, highP})
+	return
+}
+
+//Count returns the number of points of the snapshot inside [lowPoint, highPoint].
+func (s *Snapshot) Count(lowPoint, highPoint Point) (cnt int, err error) {
+	if s.released {
+		err = errors.Wrap(ErrClosed, "(*Snapshot).Count")
+		return
+	}
+	if lowPoint, highPoint, err = s.bkd.checkQuery(lowPoint, highPoint); err != nil {
+		return
+	}
+	cnt, err = s.view.tree.count(lowPoint, highPoint)
+	return
+}
+
+//Nearest returns the k points of the snapshot closest to query. Refers to (*BkdTree).Nearest.
+func (s *Snapshot) Nearest(query Point, k int, metric Metric) (neighbors []Neighbor, err error) {
+	if s.released {
+		err = errors.Wrap(ErrClosed, "(*Snapshot).Nearest")
+		return
+	}
+	neighbors, err = s.view.tree.nearest(query, k, metric)
+	return
+}
+
+//NewIterator creates a cursor of points of the snapshot inside [lowPoint, highPoint]. The cursor holds the snapshot
+//by itself, so the snapshot could be released before the cursor. The caller shall Close it.
+func (s *Snapshot) NewIterator(lowPoint, highPoint Point) (it *BkdIterator, err error) {
+	if s.released {
+		err = errors.Wrap(ErrClosed, "(*Snapshot).NewIterator")
+		return
+	}
+	s.bkd.snapMu.Lock()
+	s.view.refs++
+	s.bkd.snapMu.Unlock()
+	it, err = newIterator(&Snapshot{bkd: s.bkd, view: s.view}, lowPoint, highPoint)
+	return
+}
+
+//Release releases the snapshot. Stores retired by the tree meanwhile are closed once no snapshot refers to them.
+//It's safe to call Release multiple times.
+func (s *Snapshot) Release() (err error) {
+	if s.released {
+		return
+	}
+	s.released = true
+	s.bkd.snapMu.Lock()
+	defer s.bkd.snapMu.Unlock()
+	err = s.bkd.releaseView(s.view)
+	return
+}
@@ -0,0 +1,192 @@
+package bkdtree
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+//StorageKind is the way to access files of a BkdTree.
+type StorageKind int
+
+const (
+	//StorageMmap maps files into memory. This is the default.
+	StorageMmap StorageKind = iota
+	//StoragePread reads and writes files via pread/pwrite with bounded buffers. Only T0M is held in memory.
+	StoragePread
+)
+
+//Durability is the level of crash safety of a BkdTree.
+type Durability int
+
+const (
+	//DurabilityNone leaves flushing to the OS. Acknowledged mutations could be lost at power loss. This is the default.
+	DurabilityNone Durability = iota
+	//DurabilitySync fsyncs T0M after every mutation which touches it, fsyncs the file of a subtree after erasing from it,
+	//and fsyncs new subtree files and the directory before old subtree files are removed.
+	DurabilitySync
+)
+
+//storage is the content of a file.
+type storage interface {
+	//ReadAt returns the content of [off, off+size). The result is either a slice of the mapping, or a slice of buf
+	//which is allocated if it's shorter than size. The result shall not be modified unless WriteAt follows.
+	ReadAt(buf []byte, off, size int) (data []byte, err error)
+	//WriteAt writes p at off.
+	WriteAt(p []byte, off int) (err error)
+	//Size returns the file size.
+	Size() int
+	//Sync flushes written content to the disk.
+	Sync() (err error)
+	//Close releases resources and closes the file.
+	Close() (err error)
+}
+
+type mmapStorage struct {
+	f    *os.File
+	data []byte //file content via mmap
+}
+
+type preadStorage struct {
+	f    *os.File
+	size int
+}
+
+//memStorage is content held in memory, such as the copy of T0M of a snapshot. It isn't backed by a file.
+type memStorage struct {
+	data []byte
+}
+
+//newStorage creates a storage of the given file. The file shall not be resized later.
+func newStorage(f *os.File, kind StorageKind) (s storage, err error) {
+	switch kind {
+	case StorageMmap:
+		var data []byte
+		if data, err = FileMmap(f); err != nil {
+			return
+		}
+		s = &mmapStorage{f: f, data: data}
+	case StoragePread:
+		var info os.FileInfo
+		if info, err = f.Stat(); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+		s = &preadStorage{f: f, size: int(info.Size())}
+	default:
+		err = newInvalidArgument("storageKind", kind)
+	}
+	return
+}
+
+func (s *mmapStorage) ReadAt(buf []byte, off, size int) (data []byte, err error) {
+	if off < 0 || size < 0 || off+size > len(s.data) {
+		err = errors.Wrapf(ErrCorrupt, "%s read [%d, %d) is out of range [0, %d)", s.f.Name(), off, off+size, len(s.data))
+		return
+	}
+	data = s.data[off : off+size]
+	return
+}
+
+func (s *mmapStorage) WriteAt(p []byte, off int) (err error) {
+	if off < 0 || off+len(p) > len(s.data) {
+		err = errors.Wrapf(ErrCorrupt, "%s write [%d, %d) is out of range [0, %d)", s.f.Name(), off, off+len(p), len(s.data))
+		return
+	}
+	copy(s.data[off:], p)
+	return
+}
+
+func (s *mmapStorage) Size() int {
+	return len(s.data)
+}
+
+//Sync flushes the dirty pages of the mapping via msync, which unlike fsync covers them on every OS.
+func (s *mmapStorage) Sync() (err error) {
+	err = FileMsync(s.data)
+	return
+}
+
+func (s *mmapStorage) Close() (err error) {
+	if err = FileMunmap(s.data); err != nil {
+		return
+	}
+	if err = s.f.Close(); err != nil {
+		err = errors.Wrap(err, "")
+	}
+	return
+}
+
+func (s *preadStorage) ReadAt(buf []byte, off, size int) (data []byte, err error) {
+	if off < 0 || size < 0 || off+size > s.size {
+		err = errors.Wrapf(ErrCorrupt, "%s read [%d, %d) is out of range [0, %d)", s.f.Name(), off, off+size, s.size)
+		return
+	}
+	if len(buf) < size {
+		buf = make([]byte, size)
+	}
+	data = buf[:size]
+	if _, err = s.f.ReadAt(data, int64(off)); err != nil {
+		err = errors.Wrap(err, "")
+	}
+	return
+}
+
+func (s *preadStorage) WriteAt(p []byte, off int) (err error) {
+	if off < 0 || off+len(p) > s.size {
+		err = errors.Wrapf(ErrCorrupt, "%s write [%d, %d) is out of range [0, %d)", s.f.Name(), off, off+len(p), s.size)
+		return
+	}
+	if _, err = s.f.WriteAt(p, int64(off)); err != nil {
+		err = errors.Wrap(err, "")
+	}
+	return
+}
+
+func (s *preadStorage) Size() int {
+	return s.size
+}
+
+func (s *preadStorage) Sync() (err error) {
+	if err = s.f.Sync(); err != nil {
+		err = errors.Wrap(err, "")
+	}
+	return
+}
+
+func (s *preadStorage) Close() (err error) {
+	if err = s.f.Close(); err != nil {
+		err = errors.Wrap(err, "")
+	}
+	return
+}
+
+func (s *memStorage) ReadAt(buf []byte, off, size int) (data []byte, err error) {
+	if off < 0 || size < 0 || off+size > len(s.data) {
+		err = errors.Wrapf(ErrCorrupt, "memory read [%d, %d) is out of range [0, %d)", off, off+size, len(s.data))
+		return
+	}
+	data = s.data[off : off+size]
+	return
+}
+
+func (s *memStorage) WriteAt(p []byte, off int) (err error) {
+	if off < 0 || off+len(p) > len(s.data) {
+		err = errors.Wrapf(ErrCorrupt, "memory write [%d, %d) is out of range [0, %d)", off, off+len(p), len(s.data))
+		return
+	}
+	copy(s.data[off:], p)
+	return
+}
+
+func (s *memStorage) Size() int {
+	return len(s.data)
+}
+
+func (s *memStorage) Sync() (err error) {
+	return
+}
+
+func (s *memStorage) Close() (err error) {
+	return
+}
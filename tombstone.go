@@ -0,0 +1,428 @@
+package bkdtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+/**
+ * Tombstones:
+ * With WithTombstones, erasing a point from Ti doesn't touch the file. Instead a tombstone is appended to the tombstone
+ * file, which is filtered from queries and physically applied when the compaction absorbing Ti extracts its points.
+ * So Ti files are write-once. T0M is erased in place regardless of the mode.
+ * 1. A tombstone is the encoded point without its payload reference, and the generation of the Ti it's erased from.
+ *    So a point re-inserted after being erased is never hidden by the old tombstone.
+ *    A tombstone erases one copy of the point. Copies of a point differ in payload references only, so a traversal of Ti
+ *    skips the first n copies of a point it sees, where n is the number of tombstones of the point and the generation.
+ * 2. The tombstone file is a sequence of records: Generation uint64, the encoded point, and CRC-32 (IEEE) of both.
+ *    Records are appended on erasing, and the file is replaced atomically once some tombstones are applied.
+ * 3. Tombstones of generations other than live trees have been applied by a compaction, and are dropped at Open.
+ *    A torn record at the end of the file is left by a crash during erasing, and is dropped as well.
+ * Tombstones are loaded at Open regardless of the mode, so a tree is able to be reopened without WithTombstones.
+ */
+
+//tombstone is a point erased from trees of the given generations. A generation appears once per erased copy.
+type tombstone struct {
+	point Point
+	gens  []uint64
+}
+
+//erasedCopy identifies copies of a point in the tree of a generation.
+type erasedCopy struct {
+	gen uint64
+	key string
+}
+
+//erasedSeen counts erased copies skipped by a traversal of trees so far. Refers to Tombstones.
+type erasedSeen map[erasedCopy]int
+
+//TombstonesPath returns the tombstone file path
+func (bkd *BkdTree) TombstonesPath() string {
+	return filepath.Join(bkd.dir, fmt.Sprintf("%s_tombstones", bkd.prefix))
+}
+
+//tombstoneKeySize returns the size of the part of a record which identifies a point, excluding the payload reference.
+func (bkd *BkdTree) tombstoneKeySize() int {
+	if bkd.hasPayload() {
+		return bkd.pointSize - 8
+	}
+	return bkd.pointSize
+}
+
+//tombstoneKey returns the key of the given point.
+func (bkd *BkdTree) tombstoneKey(point Point) []byte {
+	buf := make([]byte, bkd.pointSize)
+	bkd.encodePoint(buf, point)
+	return buf[:bkd.tombstoneKeySize()]
+}
+
+//erasedCopies returns the number of copies of the point of the given key erased from the tree of the given generation.
+func (bkd *BkdTree) erasedCopies(gen uint64, key []byte) (n int) {
+	if len(bkd.tombstones) == 0 {
+		return
+	}
+	ts, ok := bkd.tombstones[string(key)]
+	if !ok {
+		return
+	}
+	for _, g := range ts.gens {
+		if g == gen {
+			n++
+		}
+	}
+	return
+}
+
+//isErased returns whether the i-th point of the given leaf of Ti has been erased. seen is shared by the traversal.
+func (bkd *BkdTree) isErased(meta *KdTreeExtMeta, pae *PointArrayExt, i int, seen erasedSeen) bool {
+	if len(bkd.tombstones) == 0 {
+		return false
+	}
+	off := i * pae.pointSize
+	key := pae.data[off : off+bkd.tombstoneKeySize()]
+	n := bkd.erasedCopies(meta.Generation, key)
+	if n == 0 {
+		return false
+	}
+	c := erasedCopy{gen: meta.Generation, key: string(key)}
+	if seen[c] >= n {
+		return false
+	}
+	seen[c]++
+	return true
+}
+
+//dropErased returns a copy of the given leaf of Ti without erased points. seen is shared by the traversal.
+func (bkd *BkdTree) dropErased(meta *KdTreeExtMeta, pae PointArrayExt, seen erasedSeen) (res PointArrayExt) {
+	res = pae
+	res.data = make([]byte, 0, len(pae.data))
+	res.numPoints = 0
+	for i := 0; i < pae.numPoints; i++ {
+		if bkd.isErased(meta, &pae, i, seen) {
+			continue
+		}
+		res.data = append(res.data, pae.data[i*pae.pointSize:(i+1)*pae.pointSize]...)
+		res.numPoints++
+	}
+	return
+}
+
+//numTombstones returns the number of tombstones of the given generation.
+func (bkd *BkdTree) numTombstones(gen uint64) (cnt int) {
+	for _, ts := range bkd.tombstones {
+		for _, g := range ts.gens {
+			if g == gen {
+				cnt++
+			}
+		}
+	}
+	return
+}
+
+//countTombstones returns the number of tombstones of the given generation inside [lowPoint, highPoint].
+func (bkd *BkdTree) countTombstones(gen uint64, lowPoint, highPoint Point) (cnt int) {
+	for _, ts := range bkd.tombstones {
+		if !ts.point.Inside(lowPoint, highPoint) {
+			continue
+		}
+		for _, g := range ts.gens {
+			if g == gen {
+				cnt++
+			}
+		}
+	}
+	return
+}
+
+//encodeTombstone appends the record of the given tombstone to b.
+func encodeTombstone(b []byte, gen uint64, key []byte) []byte {
+	begin := len(b)
+	var genBuf [8]byte
+	binary.BigEndian.PutUint64(genBuf[:], gen)
+	b = append(b, genBuf[:]...)
+	b = append(b, key...)
+	var crcBuf [4]byte
+	binary.BigEndian.PutUint32(crcBuf[:], crc32.ChecksumIEEE(b[begin:]))
+	return append(b, crcBuf[:]...)
+}
+
+//addTombstones records that points of the given keys have been erased from the tree of the given generation.
+func (bkd *BkdTree) addTombstones(gen uint64, keys [][]byte) (err error) {
+	if len(keys) == 0 {
+		return
+	}
+	created := len(bkd.tombstones) == 0
+	f, err := os.OpenFile(bkd.TombstonesPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	defer f.Close()
+	var data []byte
+	for _, key := range keys {
+		data = encodeTombstone(data, gen, key)
+	}
+	if _, err = f.Write(data); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if bkd.durability == DurabilitySync {
+		if err = f.Sync(); err != nil {
+			err = errors.Wrap(err, "")
+			return
+		}
+	}
+	if created {
+		if err = bkd.syncDir(); err != nil {
+			return
+		}
+	}
+	for _, key := range keys {
+		bkd.putTombstone(gen, key)
+	}
+	return
+}
+
+//putTombstone adds the given tombstone to the in-memory set.
+func (bkd *BkdTree) putTombstone(gen uint64, key []byte) {
+	if bkd.tombstones == nil {
+		bkd.tombstones = make(map[string]*tombstone)
+	}
+	ts, ok := bkd.tombstones[string(key)]
+	if !ok {
+		pae := PointArrayExt{
+			data:        key,
+			numPoints:   1,
+			byDim:       0, //not used
+			bytesPerDim: bkd.BytesPerDim,
+			dimBytes:    bkd.dimBytes,
+			numDims:     bkd.NumDims,
+			pointSize:   bkd.pointSize,
+		}
+		ts = &tombstone{point: pae.GetPoint(0)}
+		bkd.tombstones[string(key)] = ts
+	}
+	ts.gens = append(ts.gens, gen)
+}
+
+//liveGenerations returns generations of non-empty trees.
+func (bkd *BkdTree) liveGenerations() (gens map[uint64]bool) {
+	gens = make(map[uint64]bool)
+	for _, tree := range bkd.trees {
+		if tree.store != nil && tree.meta.NumPoints > 0 {
+			gens[tree.meta.Generation] = true
+		}
+	}
+	return
+}
+
+//loadTombstones reads the tombstone file, if any, and drops tombstones which have been applied. Refers to Tombstones.
+func (bkd *BkdTree) loadTombstones() (err error) {
+	bkd.tombstones = nil
+	data, err := ioutil.ReadFile(bkd.TombstonesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = errors.Wrap(err, "")
+		}
+		return
+	}
+	keySize := bkd.tombstoneKeySize()
+	recSize := 8 + keySize + 4
+	live := bkd.liveGenerations()
+	dirty := len(data)%recSize != 0 //torn record
+	for off := 0; off+recSize <= len(data); off += recSize {
+		rec := data[off : off+recSize]
+		if checksum := binary.BigEndian.Uint32(rec[recSize-4:]); checksum != crc32.ChecksumIEEE(rec[:recSize-4]) {
+			err = errors.Wrapf(ErrCorrupt, "%s record at %d checksum %d, want %d", bkd.TombstonesPath(), off, checksum, crc32.ChecksumIEEE(rec[:recSize-4]))
+			return
+		}
+		gen := binary.BigEndian.Uint64(rec)
+		if !live[gen] {
+			dirty = true
+			continue
+		}
+		bkd.putTombstone(gen, rec[8:8+keySize])
+	}
+	if dirty {
+		err = bkd.writeTombstones()
+	}
+	return
+}
+
+//dropTombstones drops tombstones of the given generation inside [lowPoint, highPoint] from the in-memory set, and
+//returns the number of dropped ones. The caller rewrites the tombstone file.
+func (bkd *BkdTree) dropTombstones(gen uint64, lowPoint, highPoint Point) (cnt int) {
+	for key, ts := range bkd.tombstones {
+		if !ts.point.Inside(lowPoint, highPoint) {
+			continue
+		}
+		gens := ts.gens[:0]
+		for _, g := range ts.gens {
+			if g == gen {
+				cnt++
+			} else {
+				gens = append(gens, g)
+			}
+		}
+		ts.gens = gens
+		if len(gens) == 0 {
+			delete(bkd.tombstones, key)
+		}
+	}
+	return
+}
+
+//tombstoneRangeTi records a tombstone for each point of trees[idx] inside [lowPoint, highPoint] which hasn't been erased.
+func (bkd *BkdTree) tombstoneRangeTi(lowPoint, highPoint Point, idx int) (n int, err error) {
+	if bkd.trees[idx].meta.NumPoints <= 0 {
+		return
+	}
+	collector := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = bkd.intersectTi(visitorAdapter{collector}, idx); err != nil {
+		return
+	}
+	keys := make([][]byte, 0, len(collector.Points))
+	for _, point := range collector.Points {
+		keys = append(keys, bkd.tombstoneKey(point))
+	}
+	if err = bkd.addTombstones(bkd.trees[idx].meta.Generation, keys); err != nil {
+		return
+	}
+	n = len(keys)
+	return
+}
+
+//pruneTombstones drops tombstones of trees absorbed by a compaction, which have been applied.
+func (bkd *BkdTree) pruneTombstones() (err error) {
+	if len(bkd.tombstones) == 0 {
+		return
+	}
+	live := bkd.liveGenerations()
+	var dirty bool
+	for key, ts := range bkd.tombstones {
+		gens := ts.gens[:0]
+		for _, g := range ts.gens {
+			if live[g] {
+				gens = append(gens, g)
+			}
+		}
+		if len(gens) != len(ts.gens) {
+			dirty = true
+		}
+		ts.gens = gens
+		if len(gens) == 0 {
+			delete(bkd.tombstones, key)
+		}
+	}
+	if dirty {
+		err = bkd.writeTombstones()
+	}
+	return
+}
+
+//writeTombstones replaces the tombstone file with the in-memory set atomically. The file is removed if the set is empty.
+func (bkd *BkdTree) writeTombstones() (err error) {
+	fp := bkd.TombstonesPath()
+	if len(bkd.tombstones) == 0 {
+		if err = os.Remove(fp); err != nil && !os.IsNotExist(err) {
+			err = errors.Wrap(err, "")
+			return
+		}
+		err = bkd.syncDir()
+		return
+	}
+	var data []byte
+	for key, ts := range bkd.tombstones {
+		for _, g := range ts.gens {
+			data = encodeTombstone(data, g, []byte(key))
+		}
+	}
+	tmpFp := fp + ".tmp"
+	f, err := os.OpenFile(tmpFp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if _, err = f.Write(data); err == nil && bkd.durability == DurabilitySync {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if err = os.Rename(tmpFp, fp); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	err = bkd.syncDir()
+	return
+}
+
+//tombstoneTi records a tombstone if trees[idx] holds a copy of the given point which hasn't been erased.
+func (bkd *BkdTree) tombstoneTi(point Point, idx int) (found bool, err error) {
+	if found, err = bkd.hasLiveCopy(point, idx, bkd.newLeafBuf()); err != nil || !found {
+		return
+	}
+	err = bkd.addTombstones(bkd.trees[idx].meta.Generation, [][]byte{bkd.tombstoneKey(point)})
+	return
+}
+
+//hasLiveCopy returns whether trees[idx] holds a copy of the given point which hasn't been erased. buf is used to read leaves.
+func (bkd *BkdTree) hasLiveCopy(point Point, idx int, buf []byte) (found bool, err error) {
+	bst := &bkd.trees[idx]
+	if bst.meta.NumPoints <= 0 {
+		return
+	}
+	var cnt int
+	if cnt, err = bkd.countCopies(point, bst.store, &bst.meta, int(bst.meta.RootOff), buf); err != nil {
+		return
+	}
+	found = cnt > bkd.erasedCopies(bst.meta.Generation, bkd.tombstoneKey(point))
+	return
+}
+
+//countCopies returns the number of copies of the given point in the subtree rooted at the given intra node.
+func (bkd *BkdTree) countCopies(point Point, store storage, meta *KdTreeExtMeta, nodeOffset int, buf []byte) (cnt int, err error) {
+	node, err := readIntraNode(store, meta, nodeOffset)
+	if err != nil {
+		return
+	}
+	compare := func(lowVals, highVals []uint64) Relation {
+		return CompareBox(lowVals, highVals, point, point)
+	}
+	for i, child := range node.Children {
+		if child.NumPoints <= 0 || relateChild(&node, i, bkd.NumDims, compare, point, point) == CellOutsideQuery {
+			continue
+		}
+		if child.Offset < meta.PointsOffEnd {
+			//leaf node
+			var pae PointArrayExt
+			if pae, err = bkd.readLeaf(store, meta, buf, child, bkd.leafSize(&node, i)); err != nil {
+				return
+			}
+			for j := 0; j < pae.numPoints; j++ {
+				if point.Equal(pae.GetPoint(j)) {
+					cnt++
+				}
+			}
+		} else {
+			//intra node
+			var cntC int
+			cntC, err = bkd.countCopies(point, store, meta, int(child.Offset), buf)
+			cnt += cntC
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
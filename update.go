@@ -0,0 +1,91 @@
+package bkdtree
+
+import (
+	"github.com/pkg/errors"
+)
+
+/**
+ * Update:
+ * If the old point is in T0M, the new point overwrites its slot in one write, and the payload reference is kept.
+ * Otherwise the update is an erase of the old point and an insert of the new point protected by the journal. Refers to Journal.
+ */
+
+//Update replaces the old point with the new point under one lock acquisition, and carries the payload over.
+//It's atomic against crashes, and undoes the erase if the insert fails, the same as Apply.
+func (bkd *BkdTree) Update(oldPoint, newPoint Point) (found bool, err error) {
+	bkd.rwlock.Lock()
+	defer bkd.unlock()
+	if err = bkd.finishMerge(); err != nil {
+		return
+	}
+	if !bkd.open {
+		err = errors.Wrap(ErrClosed, "(*BkdTree).Update")
+		return
+	}
+	if err = bkd.checkPoint("oldPoint", oldPoint); err != nil {
+		return
+	} else if err = bkd.checkPoint("newPoint", newPoint); err != nil {
+		return
+	}
+
+	pae := PointArrayExt{
+		data:        bkd.t0m.data,
+		numPoints:   int(bkd.t0m.meta.NumPoints),
+		byDim:       0, //not used
+		bytesPerDim: bkd.BytesPerDim,
+		dimBytes:    bkd.dimBytes,
+		numDims:     bkd.NumDims,
+		pointSize:   bkd.pointSize,
+	}
+	if idx := pae.Index(oldPoint); idx >= 0 {
+		found = true
+		err = bkd.updateT0MAt(&pae, idx, newPoint)
+		return
+	}
+
+	var payload []byte
+	if found, payload, err = bkd.findTi(oldPoint); err != nil || !found {
+		return
+	}
+	err = bkd.applyJournaled([]batchOp{{erase: true, point: oldPoint}, {point: newPoint, payload: payload}})
+	return
+}
+
+//updateT0MAt overwrites the idx-th point of T0M with the given point in one write.
+func (bkd *BkdTree) updateT0MAt(pae *PointArrayExt, idx int, point Point) (err error) {
+	if bkd.t0mIndex != nil {
+		bkd.moveT0MSlot(bkd.userDataAt(pae, idx), idx, -1)
+		bkd.t0mIndex[point.UserData] = append(bkd.t0mIndex[point.UserData], idx)
+	}
+	off := idx * bkd.pointSize
+	bkd.encodePoint(bkd.t0m.data[off:], point) //the payload reference is kept
+	if err = bkd.t0m.store.WriteAt(bkd.t0m.data[off:off+bkd.pointSize], off); err != nil {
+		return
+	}
+	err = bkd.syncStore(bkd.t0m.store)
+	return
+}
+
+//findTi returns whether the given point is in some Ti and hasn't been erased, and its payload if the tree carries payloads.
+func (bkd *BkdTree) findTi(point Point) (found bool, payload []byte, err error) {
+	buf := bkd.newLeafBuf()
+	for i := 0; i < len(bkd.trees) && !found; i++ {
+		if found, err = bkd.hasLiveCopy(point, i, buf); err != nil {
+			return
+		}
+		if !found || !bkd.hasPayload() {
+			continue
+		}
+		collector := &PayloadCollector{LowPoint: point, HighPoint: point}
+		if err = bkd.intersectTi(visitorAdapter{collector}, i); err != nil {
+			return
+		}
+		for j, p := range collector.Points {
+			if p.Equal(point) {
+				payload = collector.Payloads[j]
+				break
+			}
+		}
+	}
+	return
+}
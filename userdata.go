@@ -0,0 +1,395 @@
+package bkdtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+/**
+ * UserData index:
+ * With WithUserDataIndex, points are able to be located by UserData without knowing coordinates.
+ * 1. T0M is indexed in memory, from UserData to the slots of points. It's rebuilt at Open.
+ * 2. Each Ti is indexed by the file TiPath(i)+".uidx", which is created together with Ti and never modified. The index
+ *    of a merged tree is built along with it outside the lock, and renamed on installing the tree.
+ *    Header: Generation uint64 of Ti, NumRecords uint64, and CRC-32 (IEEE) of records. Records are encoded points
+ *    without payload references, which end with UserData, in the order of UserData.
+ * 3. An index is a cache of Ti. It's rebuilt at Open if it's missing or of another generation, which is left by a crash or
+ *    by opening the tree without WithUserDataIndex.
+ * 4. Points erased from Ti are left in the index. A candidate from the index is confirmed by Ti and tombstones.
+ */
+
+const userDataIndexHeaderSize = 8 + 8 + 4
+
+//UserDataIndexPath returns the path of the UserData index of Ti.
+func (bkd *BkdTree) UserDataIndexPath(i int) string {
+	return bkd.TiPath(i) + ".uidx"
+}
+
+//userDataAt returns UserData of the i-th point of pae.
+func (bkd *BkdTree) userDataAt(pae *PointArrayExt, i int) uint64 {
+	return binary.BigEndian.Uint64(pae.data[i*pae.pointSize+bkd.tombstoneKeySize()-8:])
+}
+
+//indexT0M rebuilds the index of T0M if UserData index is enabled.
+func (bkd *BkdTree) indexT0M() {
+	if !bkd.userDataIndex {
+		bkd.t0mIndex = nil
+		return
+	}
+	bkd.t0mIndex = make(map[uint64][]int)
+	pae := PointArrayExt{
+		data:      bkd.t0m.data,
+		numPoints: int(bkd.t0m.meta.NumPoints),
+		pointSize: bkd.pointSize,
+	}
+	for i := 0; i < pae.numPoints; i++ {
+		id := bkd.userDataAt(&pae, i)
+		bkd.t0mIndex[id] = append(bkd.t0mIndex[id], i)
+	}
+}
+
+//moveT0MSlot updates the index of T0M after the point of the given UserData has moved from slot from to slot to.
+//to < 0 means the point has been erased.
+func (bkd *BkdTree) moveT0MSlot(id uint64, from, to int) {
+	if bkd.t0mIndex == nil {
+		return
+	}
+	slots := bkd.t0mIndex[id]
+	for j, slot := range slots {
+		if slot != from {
+			continue
+		}
+		if to >= 0 {
+			slots[j] = to
+		} else if len(slots) == 1 {
+			delete(bkd.t0mIndex, id)
+		} else {
+			bkd.t0mIndex[id] = append(slots[:j], slots[j+1:]...)
+		}
+		return
+	}
+}
+
+//openUserDataIndex opens the index of trees[idx], and rebuilds it if it doesn't match the tree.
+func (bkd *BkdTree) openUserDataIndex(idx int) (err error) {
+	bst := &bkd.trees[idx]
+	if !bkd.userDataIndex || bst.store == nil || bst.index != nil {
+		return
+	}
+	var built bool
+	for {
+		var f *os.File
+		if f, err = os.Open(bkd.UserDataIndexPath(idx)); err != nil && !os.IsNotExist(err) {
+			err = errors.Wrap(err, "")
+			return
+		} else if err == nil {
+			var store storage
+			if store, err = newStorage(f, bkd.storageKind); err != nil {
+				f.Close()
+				return
+			}
+			var valid bool
+			if valid, err = bkd.checkUserDataIndexHeader(store, &bst.meta); err != nil {
+				store.Close()
+				return
+			} else if valid {
+				bst.index = store
+				return
+			}
+			if err = store.Close(); err != nil {
+				return
+			}
+		}
+		if built {
+			err = errors.Wrapf(ErrCorrupt, "%s doesn't match the tree", bkd.UserDataIndexPath(idx))
+			return
+		}
+		if err = bkd.buildUserDataIndex(idx); err != nil {
+			return
+		}
+		built = true
+	}
+}
+
+//checkUserDataIndexHeader returns whether the header of the index matches the given tree.
+func (bkd *BkdTree) checkUserDataIndexHeader(store storage, meta *KdTreeExtMeta) (valid bool, err error) {
+	if store.Size() < userDataIndexHeaderSize {
+		return
+	}
+	header, err := store.ReadAt(nil, 0, userDataIndexHeaderSize)
+	if err != nil {
+		return
+	}
+	gen := binary.BigEndian.Uint64(header)
+	numRecords := binary.BigEndian.Uint64(header[8:])
+	valid = gen == meta.Generation &&
+		uint64(store.Size()) == userDataIndexHeaderSize+numRecords*uint64(bkd.tombstoneKeySize())
+	return
+}
+
+//buildUserDataIndex writes the index of trees[idx] and replaces the existing one atomically.
+func (bkd *BkdTree) buildUserDataIndex(idx int) (err error) {
+	bst := &bkd.trees[idx]
+	lowPoint := Point{Vals: make([]uint64, bkd.NumDims)}
+	highPoint := Point{Vals: make([]uint64, bkd.NumDims)}
+	for dim := range highPoint.Vals {
+		highPoint.Vals[dim] = ^uint64(0)
+	}
+	collector := &IntersectCollector{lowPoint, highPoint, make([]Point, 0)}
+	if err = bkd.intersectTi(visitorAdapter{collector}, idx); err != nil {
+		return
+	}
+	keys := make([][]byte, 0, len(collector.Points))
+	for _, point := range collector.Points {
+		keys = append(keys, bkd.tombstoneKey(point))
+	}
+	fp := bkd.UserDataIndexPath(idx)
+	if err = bkd.writeUserDataIndex(fp+".tmp", bst.meta.Generation, keys); err != nil {
+		return
+	}
+	if err = os.Rename(fp+".tmp", fp); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	err = bkd.syncDir()
+	return
+}
+
+//writeUserDataIndex writes the index of the tree of the given generation holding points of the given keys into fp.
+//keys are sorted in place.
+func (bkd *BkdTree) writeUserDataIndex(fp string, gen uint64, keys [][]byte) (err error) {
+	keySize := bkd.tombstoneKeySize()
+	sort.SliceStable(keys, func(i, j int) bool {
+		return binary.BigEndian.Uint64(keys[i][keySize-8:]) < binary.BigEndian.Uint64(keys[j][keySize-8:])
+	})
+	data := make([]byte, userDataIndexHeaderSize, userDataIndexHeaderSize+len(keys)*keySize)
+	for _, key := range keys {
+		data = append(data, key...)
+	}
+	binary.BigEndian.PutUint64(data, gen)
+	binary.BigEndian.PutUint64(data[8:], uint64(len(keys)))
+	binary.BigEndian.PutUint32(data[16:], crc32.ChecksumIEEE(data[userDataIndexHeaderSize:]))
+
+	f, err := os.OpenFile(fp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	if _, err = f.Write(data); err == nil && bkd.durability == DurabilitySync {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		err = errors.Wrap(err, "")
+	}
+	return
+}
+
+//buildMergedIndex writes the index of the merged tree of the given generation into the temp file of the index of
+//trees[k], from points extracted into the first numPoints slots of tmpF. It's renamed by installMerged.
+func (bkd *BkdTree) buildMergedIndex(k int, gen uint64, tmpF *os.File, numPoints int) (err error) {
+	data := make([]byte, numPoints*bkd.pointSize)
+	if _, err = tmpF.ReadAt(data, 0); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	keySize := bkd.tombstoneKeySize()
+	keys := make([][]byte, 0, numPoints)
+	for off := 0; off < len(data); off += bkd.pointSize {
+		keys = append(keys, data[off:off+keySize])
+	}
+	err = bkd.writeUserDataIndex(bkd.UserDataIndexPath(k)+".tmp", gen, keys)
+	return
+}
+
+//closeUserDataIndex closes the index of trees[idx], if any, and removes the file if remove is true.
+func (bkd *BkdTree) closeUserDataIndex(idx int, remove bool) (err error) {
+	bst := &bkd.trees[idx]
+	if bst.index != nil {
+		if err = bst.index.Close(); err != nil {
+			return
+		}
+		bst.index = nil
+	}
+	if remove {
+		if err = os.Remove(bkd.UserDataIndexPath(idx)); err != nil && !os.IsNotExist(err) {
+			err = errors.Wrap(err, "")
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+//lookupUserDataIndex returns points of the given UserData in the index of trees[idx], including erased ones.
+func (bkd *BkdTree) lookupUserDataIndex(idx int, id uint64) (points []Point, err error) {
+	store := bkd.trees[idx].index
+	keySize := bkd.tombstoneKeySize()
+	numRecords := (store.Size() - userDataIndexHeaderSize) / keySize
+	userDataOf := func(i int) (v uint64) {
+		if err != nil {
+			return
+		}
+		var rec []byte
+		if rec, err = store.ReadAt(nil, userDataIndexHeaderSize+i*keySize, keySize); err != nil {
+			return
+		}
+		v = binary.BigEndian.Uint64(rec[keySize-8:])
+		return
+	}
+	begin := sort.Search(numRecords, func(i int) bool {
+		return userDataOf(i) >= id
+	})
+	for i := begin; i < numRecords && err == nil; i++ {
+		var rec []byte
+		if rec, err = store.ReadAt(nil, userDataIndexHeaderSize+i*keySize, keySize); err != nil {
+			return
+		}
+		pae := PointArrayExt{
+			data:        rec,
+			numPoints:   1,
+			byDim:       0, //not used
+			bytesPerDim: bkd.BytesPerDim,
+			dimBytes:    bkd.dimBytes,
+			numDims:     bkd.NumDims,
+			pointSize:   bkd.pointSize,
+		}
+		point := pae.GetPoint(0)
+		if point.UserData != id {
+			break
+		}
+		points = append(points, point)
+	}
+	return
+}
+
+//findUserData returns a live point of the given UserData, and the index of the tree holding it, -1 for T0M.
+func (bkd *BkdTree) findUserData(id uint64) (point Point, idx int, found bool, err error) {
+	if !bkd.userDataIndex {
+		err = errors.Wrap(ErrInvalidArgument, "UserData index is disabled, refers to WithUserDataIndex")
+		return
+	}
+	if slots := bkd.t0mIndex[id]; len(slots) != 0 {
+		pae := PointArrayExt{
+			data:        bkd.t0m.data,
+			numPoints:   int(bkd.t0m.meta.NumPoints),
+			byDim:       0, //not used
+			bytesPerDim: bkd.BytesPerDim,
+			dimBytes:    bkd.dimBytes,
+			numDims:     bkd.NumDims,
+			pointSize:   bkd.pointSize,
+		}
+		point, idx, found = pae.GetPoint(slots[0]), -1, true
+		return
+	}
+	if bkd.frozen != nil {
+		//the frozen buffer isn't indexed, and is scanned
+		pae := PointArrayExt{
+			data:        bkd.frozen.data,
+			numPoints:   int(bkd.frozen.meta.NumPoints),
+			byDim:       0, //not used
+			bytesPerDim: bkd.BytesPerDim,
+			dimBytes:    bkd.dimBytes,
+			numDims:     bkd.NumDims,
+			pointSize:   bkd.pointSize,
+		}
+		for i := 0; i < pae.numPoints; i++ {
+			if point = pae.GetPoint(i); point.UserData == id {
+				idx, found = -1, true
+				return
+			}
+		}
+	}
+	buf := bkd.newLeafBuf()
+	for idx = 0; idx < len(bkd.trees); idx++ {
+		bst := &bkd.trees[idx]
+		if bst.meta.NumPoints <= 0 || bst.index == nil {
+			continue
+		}
+		var candidates []Point
+		if candidates, err = bkd.lookupUserDataIndex(idx, id); err != nil {
+			return
+		}
+		for _, point = range candidates {
+			//the point could have been erased in place or by tombstones
+			if found, err = bkd.hasLiveCopy(point, idx, buf); err != nil || found {
+				return
+			}
+		}
+	}
+	return
+}
+
+//GetByUserData returns the point of the given UserData. It requires WithUserDataIndex.
+func (bkd *BkdTree) GetByUserData(id uint64) (point Point, found bool, err error) {
+	bkd.rwlock.RLock()
+	defer bkd.rwlock.RUnlock()
+	if !bkd.open {
+		err = errors.Wrap(ErrClosed, "(*BkdTree).GetByUserData")
+		return
+	}
+	point, _, found, err = bkd.findUserData(id)
+	return
+}
+
+//EraseByUserData erases the point of the given UserData. It requires WithUserDataIndex.
+func (bkd *BkdTree) EraseByUserData(id uint64) (found bool, err error) {
+	bkd.rwlock.Lock()
+	defer bkd.unlock()
+	if err = bkd.finishMerge(); err != nil {
+		return
+	}
+	if !bkd.open {
+		err = errors.Wrap(ErrClosed, "(*BkdTree).EraseByUserData")
+		return
+	}
+	point, idx, found, err := bkd.findUserData(id)
+	if err != nil || !found {
+		return
+	}
+	if idx < 0 {
+		found, err = bkd.eraseT0M(point)
+	} else if bkd.eraseInPlace(bkd.trees[idx].store) {
+		found, err = bkd.eraseTi(point, idx)
+	} else {
+		found, err = bkd.tombstoneTi(point, idx)
+	}
+	if err == nil && found {
+		bkd.NumPoints--
+	}
+	return
+}
+
+//verifyUserDataIndex checks the header and the checksum of the index of trees[idx], and that records are in order.
+func (bkd *BkdTree) verifyUserDataIndex(idx int) (err error) {
+	bst := &bkd.trees[idx]
+	var valid bool
+	if valid, err = bkd.checkUserDataIndexHeader(bst.index, &bst.meta); err != nil {
+		return
+	} else if !valid {
+		err = errors.Wrapf(ErrCorrupt, "%s doesn't match the tree", bkd.UserDataIndexPath(idx))
+		return
+	}
+	data, err := bst.index.ReadAt(nil, 0, bst.index.Size())
+	if err != nil {
+		return
+	}
+	if checksum := crc32.ChecksumIEEE(data[userDataIndexHeaderSize:]); checksum != binary.BigEndian.Uint32(data[16:]) {
+		err = errors.Wrapf(ErrCorrupt, "%s checksum %d, want %d", bkd.UserDataIndexPath(idx), checksum, binary.BigEndian.Uint32(data[16:]))
+		return
+	}
+	keySize := bkd.tombstoneKeySize()
+	for off := userDataIndexHeaderSize + keySize; off < len(data); off += keySize {
+		prev, cur := data[off-keySize:off], data[off:off+keySize]
+		if bytes.Compare(prev[keySize-8:], cur[keySize-8:]) > 0 {
+			err = errors.Wrapf(ErrCorrupt, "%s records at %d are not in order", bkd.UserDataIndexPath(idx), off)
+			return
+		}
+	}
+	return
+}
@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"sort"
 	"syscall"
+	"unsafe"
 
 	"github.com/pkg/errors"
 )
@@ -43,6 +44,33 @@ func FileMunmap(data []byte) (err error) {
 	return
 }
 
+//FileMsync flushes the dirty pages of the given mapping to the file, and waits for them to be written.
+func FileMsync(data []byte) (err error) {
+	if len(data) == 0 {
+		return
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		err = errors.Wrap(errno, "")
+		return
+	}
+	return
+}
+
+//FileSyncDir fsyncs the given directory so that entries created, renamed or removed in it are durable.
+func FileSyncDir(dir string) (err error) {
+	var f *os.File
+	if f, err = os.Open(dir); err != nil {
+		err = errors.Wrap(err, "")
+		return
+	}
+	defer f.Close()
+	if err = f.Sync(); err != nil {
+		err = errors.Wrap(err, "")
+	}
+	return
+}
+
 //FileUnmarshal unmarshals the given file to object.
 func FileUnmarshal(fp string, v interface{}) (err error) {
 	var f *os.File
@@ -0,0 +1,78 @@
+package bkdtree
+
+import (
+	"fmt"
+	"math"
+)
+
+//maxValue returns the max encoded value of the given dimension.
+func (bkd *BkdTree) maxValue(dim int) uint64 {
+	if bkd.dimTypes[dim] == DimFloat32 {
+		return math.MaxUint32
+	}
+	width := bkd.dimWidth(dim)
+	if width >= 8 {
+		return math.MaxUint64
+	}
+	return uint64(1)<<uint(8*width) - 1
+}
+
+//checkPoint ensures the point has NumDims dimensions and each value fits into the width of its dimension.
+func (bkd *BkdTree) checkPoint(field string, point Point) (err error) {
+	if len(point.Vals) != bkd.NumDims {
+		err = newDimensionMismatch(field, len(point.Vals), bkd.NumDims)
+		return
+	}
+	for dim, val := range point.Vals {
+		if val > bkd.maxValue(dim) {
+			err = newInvalidArgument(fmt.Sprintf("%s.Vals[%d]", field, dim), val)
+			return
+		}
+	}
+	return
+}
+
+//checkQuery validates the query bounds. If query clamping is enabled, out of range values are saturated instead of rejected:
+//a high value is clamped to the max value, and a low value above the max value makes the query empty, which is
+//represented as an inverted range [maxVal, maxVal-1] on that dimension.
+func (bkd *BkdTree) checkQuery(lowPoint, highPoint Point) (lowP, highP Point, err error) {
+	if !bkd.clampQuery {
+		if err = bkd.checkPoint("lowPoint", lowPoint); err != nil {
+			return
+		}
+		if err = bkd.checkPoint("highPoint", highPoint); err != nil {
+			return
+		}
+		lowP, highP = lowPoint, highPoint
+		return
+	}
+	if len(lowPoint.Vals) != bkd.NumDims {
+		err = newDimensionMismatch("lowPoint", len(lowPoint.Vals), bkd.NumDims)
+		return
+	} else if len(highPoint.Vals) != bkd.NumDims {
+		err = newDimensionMismatch("highPoint", len(highPoint.Vals), bkd.NumDims)
+		return
+	}
+	lowP = Point{Vals: make([]uint64, bkd.NumDims), UserData: lowPoint.UserData}
+	highP = Point{Vals: make([]uint64, bkd.NumDims), UserData: highPoint.UserData}
+	for dim := 0; dim < bkd.NumDims; dim++ {
+		maxVal := bkd.maxValue(dim)
+		lowP.Vals[dim], highP.Vals[dim] = lowPoint.Vals[dim], highPoint.Vals[dim]
+		if lowP.Vals[dim] > maxVal {
+			lowP.Vals[dim], highP.Vals[dim] = maxVal, maxVal-1
+		} else if highP.Vals[dim] > maxVal {
+			highP.Vals[dim] = maxVal
+		}
+	}
+	return
+}
+
+//boundedVisitor overrides the query bounds of a visitor with the validated ones.
+type boundedVisitor struct {
+	IntersectVisitorExt
+	lowPoint  Point
+	highPoint Point
+}
+
+func (v boundedVisitor) GetLowPoint() Point  { return v.lowPoint }
+func (v boundedVisitor) GetHighPoint() Point { return v.highPoint }